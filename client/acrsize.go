@@ -0,0 +1,93 @@
+package client
+
+import (
+	"time"
+)
+
+const (
+	// acrLossHigh is the loss ratio of an ACR above which the ACR size
+	// shrinks in proportion to the loss.
+	acrLossHigh = 0.1
+	// acrLossLow is the loss ratio of an ACR up to which the ACR size grows.
+	acrLossLow = 0.02
+	// acrRTTInflation is the ratio of the RTT of an ACR to the minimum RTT
+	// above which the ACR size does not grow, as a queue is building up.
+	acrRTTInflation = 1.5
+	// maxACRSizeChanges is the number of changes of the ACR size kept for
+	// Result.ACRSizes.
+	maxACRSizeChanges = 1024
+)
+
+// ACRSizeChange records that the number of chunks per ACR was set to Size.
+type ACRSizeChange struct {
+	Time time.Time
+	Size int
+}
+
+// acrSizeBounds returns the range the number of chunks per ACR is chosen
+// from for a server allowing maxChunksInACR.
+func (conf *ClientConfig) acrSizeBounds(maxChunksInACR uint16) (lower int, upper int) {
+	upper = int(maxChunksInACR)
+	if conf.MaxACRSize > 0 && conf.MaxACRSize < upper {
+		upper = conf.MaxACRSize
+	}
+	lower = conf.MinACRSize
+	if lower < 1 {
+		lower = 1
+	}
+	if lower > upper {
+		lower = upper
+	}
+	return lower, upper
+}
+
+// chunksPerACR returns the number of chunks to request in the next ACR,
+// the server's maximum until the ACR size is chosen.
+func (metadata *fileMetadata) chunksPerACR() int {
+	if metadata.acrSize < 1 || metadata.acrSize > int(metadata.maxChunksInACR) {
+		return int(metadata.maxChunksInACR)
+	}
+	return metadata.acrSize
+}
+
+// setACRSize sets the number of chunks per ACR and records the change.
+func (metadata *fileMetadata) setACRSize(size int, now time.Time) {
+	if size == metadata.acrSize {
+		return
+	}
+	metadata.acrSize = size
+	changes := metadata.stats.acrSizes
+	if len(changes) >= 2*maxACRSizeChanges {
+		// Results may still refer to the old array
+		changes = append([]ACRSizeChange(nil), changes[len(changes)-maxACRSizeChanges:]...)
+	}
+	metadata.stats.acrSizes = append(changes, ACRSizeChange{Time: now, Size: size})
+}
+
+// adaptACRSize updates the number of chunks per ACR after p is complete or
+// expired, like a congestion window: it shrinks in proportion to the loss
+// of p, and grows by an eighth while there is hardly any loss and the RTT
+// does not grow.
+func adaptACRSize(metadata *fileMetadata, p *pendingACR, conf *ClientConfig, now time.Time) {
+	lower, upper := conf.acrSizeBounds(metadata.maxChunksInACR)
+	size := metadata.chunksPerACR()
+	if rtt, ok := p.rtt(); ok && (metadata.minRTT == 0 || rtt < metadata.minRTT) {
+		metadata.minRTT = rtt
+	}
+	loss := 1 - float64(len(p.Received))/float64(p.Chunks)
+	switch {
+	case loss > acrLossHigh:
+		size = int(float64(size) * (1 - loss))
+	case loss <= acrLossLow && 2*p.Chunks >= size:
+		// The ACR was not limited by the end of the file
+		if rtt, ok := p.rtt(); ok && float64(rtt) > acrRTTInflation*float64(metadata.minRTT) {
+			break
+		}
+		size += max(1, size/8)
+	}
+	size = min(max(size, lower), upper)
+	if size != metadata.acrSize {
+		conf.Logger.Debug("Changed ACR size", "uri", metadata.url, "size", size, "loss", loss)
+	}
+	metadata.setACRSize(size, now)
+}
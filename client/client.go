@@ -1,18 +1,25 @@
 package client
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"hash"
+	"io"
+	"log/slog"
 	"math"
 	"net"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/logging"
 	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/markov"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/merkle"
 	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/metrics"
 )
 
 type ClientConfig struct {
@@ -21,15 +28,44 @@ type ClientConfig struct {
 	InitialPacketRate  uint32        // Initial packet rate in pkt/s
 	NCRRsToWait        int           // Number of virtual CRR to wait for the next CRR to arrive
 	MinTimeout         time.Duration // Minimum value that timeout can take
+	MaxACRsInFlight    int           // Number of ACRs that may be outstanding at the same time
+	MinACRSize         int           // Minimum number of chunks per ACR
+	MaxACRSize         int           // Maximum number of chunks per ACR, 0 for the maximum of the server
+	StreamBuffer       int           // Bytes of out-of-order chunks buffered by FetchTo, 0 for DefaultStreamBuffer
+	VerifyChunks       bool          // Verify every chunk with the Merkle tree of the file sent by the server
+	MaxVerifiedChunks  uint64        // Largest file in chunks whose Merkle tree is fetched for VerifyChunks, 0 for DefaultMaxVerifiedChunks
 
 	// Markov simulation of packet loss
 	MarkovP float64 // Probability of losing packet n+1 if n was not lost
 	MarkovQ float64 // Probability of losing packet n+1 if n was lost
 
-	// Debugging
-	DebugLogger *log.Logger
-	InfoLogger  *log.Logger
-	WarnLogger  *log.Logger
+	// Resume keeps a journal next to partial downloads so that an interrupted
+	// transfer only requests the missing chunks when it is started again.
+	Resume bool
+
+	// SkipUnchanged makes Fetch keep an existing local file without
+	// requesting any chunks if it has the checksum advertised by the server.
+	SkipUnchanged bool
+
+	// Metrics is the registry the metrics of the transfers are added to. New
+	// creates one if it is nil.
+	Metrics *metrics.Registry
+
+	// Progress, if not nil, is called after every ACR with the current state
+	// of the transfer. It is called from the goroutine running the transfer
+	// and must not block.
+	Progress func(Result)
+
+	// Logger gets the messages of the client
+	Logger *slog.Logger
+
+	// CongestionControl is the name of the CongestionController of the
+	// transfers, one of CongestionControls; empty for the default.
+	CongestionControl string
+	// NewCongestionController, if not nil, creates the CongestionController
+	// of every transfer instead, starting at initialRate with at most
+	// maxWindow outstanding ACRs.
+	NewCongestionController func(initialRate uint32, maxWindow int) CongestionController
 }
 
 var DefaultConfig = ClientConfig{
@@ -37,18 +73,24 @@ var DefaultConfig = ClientConfig{
 	InitialPacketRate:  256,
 	NCRRsToWait:        3,
 	MinTimeout:         500*time.Millisecond,
+	MaxACRsInFlight:    1,
+	MinACRSize:         1,
 	MarkovP:            0,
 	MarkovQ:            0,
-	DebugLogger:        log.New(ioutil.Discard, "DEBUG: ", log.LstdFlags),
-	InfoLogger:         log.New(os.Stderr, "INFO: ", log.LstdFlags),
-	WarnLogger:         log.New(os.Stderr, "WARN: ", log.LstdFlags),
+	Logger:             slog.New(slog.NewTextHandler(os.Stderr, nil)),
 }
 
 type transferStats struct {
-	requested int // Number of requested chunks
-	received  int // Number of received chunks
-	invalid   int // Number of invalid messages
-	late      int // Number of messages with wrong message number
+	requested     int    // Number of requested chunks
+	received      int    // Number of received chunks
+	invalid       int    // Number of invalid messages
+	late          int    // Number of messages with wrong message number
+	bytes         uint64 // Number of bytes written to the local file
+	retransmitted int    // Number of retransmitted MDRs
+	resumed       int    // Number of chunks restored from a journal
+	corrupt       int    // Number of chunks that did not match their hash
+
+	acrSizes []ACRSizeChange // Changes of the number of chunks per ACR
 }
 
 type fileMetadata struct {
@@ -67,16 +109,36 @@ type fileMetadata struct {
 	chunkMap     map[uint64]bool //chunkMap[chunk] == true iff chunk has been received
 	firstMissing uint64          // The index of the first chunk not yet received
 
+	// Checksum of the chunks before firstMissing
+
+	hash    hash.Hash // SHA-256 of the first hashed chunks, created with the first chunk
+	hashed  uint64
+	hashBuf []byte // For chunks read back from the local file
+
+	// Leaves of the Merkle tree of the file, see ClientConfig.VerifyChunks
+
+	leaves     [][merkle.Size]byte // nil until received
+	unverified bool                // The server did not send the leaves
+
 	// Information on the connection
 
 	timeout        time.Duration
 	packetRate     uint32
 	messageCounter uint8
+	cc             CongestionController // Created with the first ACR
+	acrSize        int                  // Number of chunks per ACR, 0 before the first ACR
+	minRTT         time.Duration        // Shortest RTT of an ACR
 	stats          transferStats
 
+	// Outstanding ACRs
+
+	pending  map[uint8]*pendingACR // Outstanding ACRs by message number
+	inFlight map[uint64]bool       // inFlight[chunk] == true iff chunk is requested by an outstanding ACR
+
 	// Local file pointer
 
 	localFile *os.File
+	stream    *reorderBuffer // Instead of localFile, see FetchTo
 }
 
 // These are fixed by the specification
@@ -86,63 +148,369 @@ const (
 	maxChunkSize      uint16        = 65517
 )
 
-// RequestFile connects to the server at address:port and tries to perform a
-// complete SANFT exchange to request the file identified by URI. If the
-// transfer works, the requested file will be written to localFilename.
-func RequestFile(ip net.IP, port int, URI string, localFilename string, conf *ClientConfig) error {
-	var err error
-	err = checkConfig(conf)
+// ErrFileNotFound is returned when the server does not know the requested
+// file.
+var ErrFileNotFound = errors.New("file not found on server")
+
+// Client downloads files from a single SANFT server. Fetch may be called
+// concurrently from several goroutines; all transfers share one socket and
+// therefore one token.
+type Client struct {
+	IP     net.IP
+	Host   string // Resolved by every new socket if IP is nil, see NewHost
+	Port   int
+	Config ClientConfig
+
+	mu    sync.Mutex
+	mux   *mux      // Shared socket, created by the first transfer
+	token [32]uint8 // Last token received from the server
+
+	metrics *clientMetrics
+}
+
+// Result describes the state of a transfer.
+type Result struct {
+	URI             string
+	FileID          uint32
+	Bytes           uint64        // Number of bytes received
+	Chunks          uint64        // Size of the file in chunks
+	Received        int           // Number of chunks received
+	Resumed         int           // Number of chunks kept from a previous transfer
+	Requested       int           // Number of chunks requested
+	Retransmissions int           // Number of retransmitted MDRs and chunk requests
+	Invalid         int           // Number of invalid messages received
+	Late            int           // Number of messages with a wrong message number
+	Corrupt         int           // Number of chunks that did not match their hash and were requested again
+	PacketRate      uint32        // Packet rate used in the last ACR
+	ACRSize         int           // Number of chunks per ACR
+	Checksum        [32]byte      // Checksum advertised by the server
+	Duration        time.Duration // Time since the start of the transfer
+	Skipped         bool          // The local file was already up to date
+
+	// ACRSizes are the recent changes of ACRSize, oldest first.
+	ACRSizes []ACRSizeChange
+}
+
+// New returns a Client for the server at ip:port. The configuration is
+// copied and checked.
+func New(ip net.IP, port int, conf *ClientConfig) (*Client, error) {
+	c := &Client{IP: ip, Port: port, Config: *conf}
+	err := checkConfig(&c.Config)
 	if err != nil {
-		return fmt.Errorf("invalid configuration: %w", err)
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
-	conn, err := markov.CreateClientSocket(ip, port, conf.MarkovP, conf.MarkovQ)
-	if err != nil {
-		return fmt.Errorf("create client socket: %w", err)
+	if c.Config.Metrics == nil {
+		c.Config.Metrics = metrics.NewRegistry()
 	}
-	defer conn.Close()
+	c.metrics = newClientMetrics(c.Config.Metrics)
+	return c, nil
+}
 
-	// Request file metadata
+// Fetch performs a complete SANFT exchange to request the file identified by
+// URI and writes it to localFilename. The transfer is aborted when ctx is
+// done. The returned Result is never nil and describes the progress made even
+// if an error occurred.
+func (c *Client) Fetch(ctx context.Context, URI string, localFilename string) (*Result, error) {
+	tm := c.metrics.start()
+	r, err := c.fetch(ctx, URI, localFilename, tm)
+	tm.done(*r, err)
+	return r, err
+}
+
+func (c *Client) fetch(ctx context.Context, URI string, localFilename string, tm *transferMetrics) (*Result, error) {
+	conf := &c.Config
+	start := time.Now()
 	metadata := new(fileMetadata)
 	metadata.url = URI
 	metadata.timeout = initialTimeout
 	metadata.packetRate = conf.InitialPacketRate
-	err = updateMetadata(conn, metadata, conf)
+	result := func() *Result { return metadata.result(start) }
+
+	if err := ctx.Err(); err != nil {
+		return result(), err
+	}
+	conn, err := c.open(ctx)
 	if err != nil {
-		return fmt.Errorf("get metadata: %w", err)
+		return result(), fmt.Errorf("create client socket: %w", err)
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+	metadata.token = c.getToken()
+	defer func() { c.setToken(metadata.token) }()
+
+	var resumeFrom *fileMetadata
+	if conf.Resume {
+		resumeFrom = new(fileMetadata)
+		err = loadJournal(localFilename, resumeFrom)
+		if err == nil {
+			err = checkPartialFile(localFilename, resumeFrom)
+			if err != nil {
+				// Start over rather than trust chunks that are gone
+				err = fmt.Errorf("partial download does not match: %v", err)
+				removeJournal(localFilename)
+			}
+		}
+		if err == nil {
+			metadata.chunkSize = resumeFrom.chunkSize
+			metadata.fileID = resumeFrom.fileID
+			metadata.fileSize = resumeFrom.fileSize
+			metadata.checksum = resumeFrom.checksum
+			metadata.chunkMap = resumeFrom.chunkMap
+			metadata.firstMissing = resumeFrom.firstMissing
+			metadata.stats.resumed = resumeFrom.stats.resumed
+		} else {
+			if !errors.Is(err, os.ErrNotExist) {
+				conf.Logger.Warn("Ignoring journal", "file", localFilename, "err", err)
+			}
+			resumeFrom = nil
+		}
 	}
 
-	localFile, err := os.Create(localFilename)
+	// Request file metadata
+	err = updateMetadata(ctx, conn, metadata, conf)
+	c.setToken(metadata.token)
 	if err != nil {
-		return fmt.Errorf("open file %s: %w", localFilename, err)
+		if errors.Is(err, ErrFileNotFound) && resumeFrom != nil {
+			// The file is gone, the partial download is useless
+			os.Remove(localFilename)
+			removeJournal(localFilename)
+		}
+		return result(), fmt.Errorf("get metadata: %w", err)
+	}
+
+	if conf.SkipUnchanged && resumeFrom == nil && isUnchanged(localFilename, metadata) {
+		r := result()
+		r.Skipped = true
+		return r, nil
+	}
+
+	var localFile *os.File
+	if resumeFrom != nil && metadata.fileID == resumeFrom.fileID &&
+		metadata.chunkSize == resumeFrom.chunkSize && metadata.checksum == resumeFrom.checksum {
+		conf.Logger.Info("Resuming transfer", "uri", URI, "file_id", logging.FileID(metadata.fileID), "chunks", metadata.stats.resumed, "total", metadata.fileSize)
+		localFile, err = os.OpenFile(localFilename, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		localFile, err = os.Create(localFilename)
+	}
+	if err != nil {
+		return result(), fmt.Errorf("open file %s: %w", localFilename, err)
 	}
 	metadata.localFile = localFile
+	if conf.Resume {
+		err = saveJournal(localFilename, metadata)
+		if err != nil {
+			conf.Logger.Warn("Could not save journal", "file", localFilename, "err", err)
+		}
+	}
 	// Request chunks
-	fmt.Printf("%s(0x%x): %d/%d chunks (%dchunks/s)\r", metadata.url, metadata.fileID, metadata.stats.received, metadata.fileSize, metadata.packetRate)
+	lastSaved := time.Now()
 	for metadata.firstMissing < metadata.fileSize {
-		err := getMissingChunks(conn, metadata, conf)
+		err := ensureLeaves(ctx, conn, metadata, conf)
+		if err == nil {
+			err = getMissingChunks(ctx, conn, metadata, conf)
+		}
+		if err == nil && metadata.firstMissing == metadata.fileSize {
+			err = metadata.recheckChunks(localFile, conf)
+		}
 		if err != nil {
-			localFile.Close()
-			os.Remove(localFilename)
-			return fmt.Errorf("get missing chunks: %w", err)
+			if conf.Resume && !errors.Is(err, ErrFileNotFound) {
+				// Keep the partial download to resume it later
+				err2 := syncJournal(localFilename, metadata)
+				localFile.Close()
+				if err2 != nil {
+					conf.Logger.Warn("Could not save journal", "file", localFilename, "err", err2)
+				}
+			} else {
+				localFile.Close()
+				os.Remove(localFilename)
+				removeJournal(localFilename)
+			}
+			return result(), fmt.Errorf("get missing chunks: %w", err)
+		}
+		if conf.Resume && time.Since(lastSaved) > journalInterval {
+			err = syncJournal(localFilename, metadata)
+			if err != nil {
+				conf.Logger.Warn("Could not save journal", "file", localFilename, "err", err)
+			}
+			lastSaved = time.Now()
+		}
+		tm.update(*result())
+		if conf.Progress != nil {
+			conf.Progress(*result())
 		}
-		fmt.Printf("%s(0x%x): %d/%d chunks (%dchunks/s); req:%d;invalid:%d;late:%d  \r", metadata.url, metadata.fileID, metadata.stats.received, metadata.fileSize, metadata.packetRate, metadata.stats.requested, metadata.stats.invalid, metadata.stats.late)
 	}
-	fmt.Println()
-	localFile.Close()
+	removeJournal(localFilename)
 
-	checksum, err := computeChecksum(localFilename)
+	checksum, err := metadata.finishChecksum(localFile)
+	localFile.Close()
 	if err != nil {
-		return fmt.Errorf("compute checksum of %s: %w", localFilename, err)
+		return result(), fmt.Errorf("compute checksum of %s: %w", localFilename, err)
 	}
 	if checksum != metadata.checksum {
 		os.Remove(localFilename)
-		return fmt.Errorf("checksum not matching. Expected %x got %x", metadata.checksum, checksum)
+		return result(), fmt.Errorf("checksum not matching. Expected %x got %x", metadata.checksum, checksum)
 	}
 
-	return nil
+	return result(), nil
+}
+
+// isUnchanged reports whether localFilename is the file described by
+// metadata.
+func isUnchanged(localFilename string, metadata *fileMetadata) bool {
+	info, err := os.Stat(localFilename)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	// only hash files with the right number of chunks
+	size := uint64(info.Size())
+	chunks := (size + uint64(metadata.chunkSize) - 1) / uint64(metadata.chunkSize)
+	if chunks != metadata.fileSize {
+		return false
+	}
+	checksum, err := computeChecksum(localFilename)
+	return err == nil && checksum == metadata.checksum
+}
+
+// syncJournal flushes the local file to disk and then records its state in
+// the journal, so that the journal never claims chunks that were not stored.
+func syncJournal(localFilename string, metadata *fileMetadata) error {
+	err := metadata.localFile.Sync()
+	if err != nil {
+		return fmt.Errorf("sync %s: %w", localFilename, err)
+	}
+	return saveJournal(localFilename, metadata)
+}
+
+// open returns a new endpoint on the shared socket of c. The socket is
+// created without holding c.mu; if another transfer created one meanwhile,
+// that one is used.
+func (c *Client) open(ctx context.Context) (*endpoint, error) {
+	c.mu.Lock()
+	if c.mux != nil {
+		defer c.mu.Unlock()
+		return c.mux.Open(), nil
+	}
+	token := c.token
+	c.mu.Unlock()
+
+	dialed := new(probeResult)
+	var err error
+	if c.IP != nil {
+		dialed.conn, err = markov.CreateClientSocket(c.IP, c.Port, c.Config.MarkovP, c.Config.MarkovQ)
+	} else {
+		dialed, err = c.dial(ctx, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mux != nil {
+		dialed.conn.Close()
+		return c.mux.Open(), nil
+	}
+	if dialed.token != nil {
+		c.token = *dialed.token
+	}
+	c.mux = newMux(dialed.conn, dialed.sent)
+	return c.mux.Open(), nil
+}
+
+// Close closes the socket of the client. Transfers still in progress fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mux == nil {
+		return nil
+	}
+	err := c.mux.Close()
+	c.mux = nil
+	return err
+}
+
+func (c *Client) getToken() [32]uint8 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+func (c *Client) setToken(token [32]uint8) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// RequestFile connects to the server at address:port and tries to perform a
+// complete SANFT exchange to request the file identified by URI. If the
+// transfer works, the requested file will be written to localFilename.
+func RequestFile(ip net.IP, port int, URI string, localFilename string, conf *ClientConfig) error {
+	c, err := New(ip, port, conf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Fetch(context.Background(), URI, localFilename)
+	return err
+}
+
+// result returns a summary of the transfer described by metadata.
+func (metadata *fileMetadata) result(start time.Time) *Result {
+	r := &Result{
+		URI:        metadata.url,
+		FileID:     metadata.fileID,
+		Bytes:      metadata.stats.bytes,
+		Chunks:     metadata.fileSize,
+		Received:   metadata.stats.received,
+		Resumed:    metadata.stats.resumed,
+		Requested:  metadata.stats.requested,
+		Invalid:    metadata.stats.invalid,
+		Late:       metadata.stats.late,
+		Corrupt:    metadata.stats.corrupt,
+		PacketRate: metadata.packetRate,
+		ACRSize:    metadata.chunksPerACR(),
+		Checksum:   metadata.checksum,
+		Duration:   time.Since(start),
+	}
+	r.Retransmissions = metadata.stats.retransmitted + r.Requested - r.Received
+	sizes := metadata.stats.acrSizes
+	sizes = sizes[max(0, len(sizes)-maxACRSizeChanges):]
+	r.ACRSizes = sizes[:len(sizes):len(sizes)]
+	return r
+}
+
+// watchContext moves the read deadline of conn to now once ctx is done, so
+// that a pending read returns immediately. The returned function stops the
+// watcher and must be called once the connection is no longer used.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// setReadDeadline sets the read deadline of conn unless ctx is already done.
+// ctx is checked again afterwards so that a cancellation racing with the
+// update is not overwritten.
+func setReadDeadline(ctx context.Context, conn net.Conn, deadline time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+	return ctx.Err()
 }
 
 func checkConfig(conf *ClientConfig) error {
+	if conf.Logger == nil {
+		conf.Logger = DefaultConfig.Logger
+	}
 	if conf.InitialPacketRate == 0 {
 		return errors.New("initialPacketRate cannot be 0")
 	}
@@ -150,7 +518,16 @@ func checkConfig(conf *ClientConfig) error {
 		return errors.New("retransmissionsMDR must be at least 2")
 	}
 	if conf.NCRRsToWait < 3 {
-		conf.WarnLogger.Printf("nCRRsToWait is set to %d. The specification recommands to wait for at least 3 CRRs\n", conf.NCRRsToWait)
+		conf.Logger.Warn("The specification recommends to wait for at least 3 CRRs", "nCRRsToWait", conf.NCRRsToWait)
+	}
+	if conf.MaxACRsInFlight > 128 {
+		return errors.New("MaxACRsInFlight must be at most 128 to keep message numbers unique")
+	}
+	if conf.MinACRSize < 0 || conf.MaxACRSize < 0 {
+		return errors.New("MinACRSize and MaxACRSize cannot be negative")
+	}
+	if conf.MaxACRSize > 0 && conf.MinACRSize > conf.MaxACRSize {
+		return errors.New("MinACRSize cannot be larger than MaxACRSize")
 	}
 	if conf.MarkovP < 0 || conf.MarkovP > 1 {
 		return errors.New("MarkovP must be in interval [0;1]")
@@ -158,18 +535,59 @@ func checkConfig(conf *ClientConfig) error {
 	if conf.MarkovQ < 0 || conf.MarkovQ > 1 {
 		return errors.New("MarkovQ must be in interval [0;1]")
 	}
+	if _, err := NewCongestionController(conf.CongestionControl, conf.InitialPacketRate, 1); err != nil {
+		return err
+	}
 	return nil
 }
 
+// acrWindow returns the number of ACRs that may be outstanding at the same
+// time.
+func (conf *ClientConfig) acrWindow() int {
+	if conf.MaxACRsInFlight < 1 {
+		return 1
+	}
+	return conf.MaxACRsInFlight
+}
+
+// ccWindow returns the window of cc, limited so that the message numbers of
+// the outstanding ACRs stay unique.
+func ccWindow(cc CongestionController) int {
+	window := cc.NextWindow()
+	if window < 1 {
+		return 1
+	}
+	if window > 128 {
+		return 128
+	}
+	return window
+}
+
+// newCongestionController returns the CongestionController of a transfer.
+func (conf *ClientConfig) newCongestionController(initialRate uint32) CongestionController {
+	if conf.NewCongestionController != nil {
+		return conf.NewCongestionController(initialRate, conf.acrWindow())
+	}
+	// checked by checkConfig
+	cc, err := NewCongestionController(conf.CongestionControl, initialRate, conf.acrWindow())
+	if err != nil {
+		return NewMeasuringController(initialRate, conf.acrWindow())
+	}
+	return cc
+}
+
 // updateMetadata sends a MetaData Request to the server and parses the response
 // to update metadata.
-func updateMetadata(conn net.Conn, metadata *fileMetadata, conf *ClientConfig) error {
+func updateMetadata(ctx context.Context, conn net.Conn, metadata *fileMetadata, conf *ClientConfig) error {
 	buf := make([]byte, 0x10000) // 64kB
 	if metadata.timeout == 0 {
 		return errors.New("metadata.timeout cannot be 0.")
 	}
 retransmit:
 	for i := 0; i < conf.RetransmissionsMDR; i++ {
+		if i > 0 {
+			metadata.stats.retransmitted++
+		}
 		mdr := messages.GetMDR(metadata.messageCounter, &metadata.token, metadata.url)
 		metadata.messageCounter++
 		t_send := time.Now()
@@ -182,15 +600,18 @@ retransmit:
 			return fmt.Errorf("send MDR: %w", err)
 		}
 		deadline := t_send.Add(metadata.timeout)
-		err = conn.SetReadDeadline(deadline)
+		err = setReadDeadline(ctx, conn, deadline)
 		if err != nil {
-			return fmt.Errorf("set deadline: %w", err)
+			return err
 		}
 
 	receive:
 		for time.Now().Before(deadline) {
 			n, err := conn.Read(buf)
 			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
 				if errors.Is(err, os.ErrDeadlineExceeded) {
 					// If it's a timeout, retransmit
 					continue retransmit
@@ -208,10 +629,10 @@ retransmit:
 				} else if errors.Is(err, new(messages.UnsupporedTypeError)) ||
 					errors.Is(err, new(messages.WrongPacketLengthError)) {
 					// Ignore unknown messages, but still log the error
-					conf.WarnLogger.Printf("Invalid response received: %v. Dropped response:%x\n", err, raw)
+					conf.Logger.Warn("Invalid response received, dropped", "err", err, "response", fmt.Sprintf("%x", raw))
 					continue receive
 				}
-				conf.WarnLogger.Printf("Unknown error while parsing response: %v. Dropped response:%x\n", err, raw)
+				conf.Logger.Warn("Unknown error while parsing response, dropped", "err", err, "response", fmt.Sprintf("%x", raw))
 				continue receive
 			}
 			switch response.(type) {
@@ -219,12 +640,12 @@ retransmit:
 				header := response.(messages.ServerHeader)
 				if header.Type != messages.MDRR_t {
 					// Ignore it
-					conf.WarnLogger.Printf("Unexpected server header of type %d. Dropped response: %v\n", header.Type, header)
+					conf.Logger.Warn("Unexpected server header, dropped", "type", header.Type, "header", header)
 					continue receive
 				}
 				if header.Number != mdr.Header.Number {
 					// Not for us. Ignore it
-					conf.DebugLogger.Printf("Received response with wrong message number(%d instead of %d). Dropped\n", header.Number, mdr.Header.Number)
+					conf.Logger.Debug("Received response with wrong message number, dropped", "number", header.Number, "expected", mdr.Header.Number)
 					continue receive
 				}
 
@@ -238,7 +659,7 @@ retransmit:
 					// support one version. Something's not right -> Error
 					return fmt.Errorf("MDRR server error: the server doesn't support our protocol version (%d) and answered with version %d", mdr.Header.Version, header.Version)
 				case messages.FileNotFound:
-					return fmt.Errorf("MDRR server error: File not found on server")
+					return fmt.Errorf("MDRR server error: %w", ErrFileNotFound)
 				default:
 					return fmt.Errorf("MDRR server error: Unknown error code for MDRR %d", header.Error)
 				}
@@ -246,17 +667,19 @@ retransmit:
 				ntm := response.(messages.NTM)
 				metadata.token = ntm.Token
 				// Note: even if this is expected in the protocol, this still counts as one retransmission
-				conf.DebugLogger.Printf("Updated token to %x (from %x). Retransmitting...\n", ntm.Token, mdr.Header.Token)
+				conf.Logger.Debug("Updated token, retransmitting", "token", fmt.Sprintf("%x", ntm.Token), "old", fmt.Sprintf("%x", mdr.Header.Token))
 				continue retransmit
 			case messages.MDRR:
 				mdrr := response.(messages.MDRR)
 				if mdrr.Header.Number != mdr.Header.Number {
 					// This message is not for us. Ignore it
-					conf.DebugLogger.Printf("Received response with wrong message number(%d instead of %d). Dropped\n", mdrr.Header.Number, mdr.Header.Number)
+					conf.Logger.Debug("Received response with wrong message number, dropped", "number", mdrr.Header.Number, "expected", mdr.Header.Number)
 					continue receive
 				}
 				// Update metadata
 				oldFileID := metadata.fileID
+				oldChunkSize := metadata.chunkSize
+				oldChecksum := metadata.checksum
 				err := getMetadataFromMDRR(metadata, &mdrr)
 				if err != nil {
 					return fmt.Errorf("invalid metadata: %w", err)
@@ -268,8 +691,15 @@ retransmit:
 					metadata.timeout = rtt * time.Duration(rtt2timeoutFactor) // Sorry to all the physicists who will see this; go only accepts to multiply values of the same type
 				}
 
-				if metadata.chunkMap == nil || metadata.fileID != oldFileID {
+				if metadata.chunkMap == nil || metadata.fileID != oldFileID ||
+					metadata.chunkSize != oldChunkSize || metadata.checksum != oldChecksum {
 					// Erase the old file
+					if metadata.stream != nil {
+						if metadata.stream.next > 0 {
+							return ErrFileChanged
+						}
+						metadata.stream.reset()
+					}
 					if metadata.localFile != nil {
 						err := metadata.localFile.Truncate(0)
 						if err != nil {
@@ -278,11 +708,13 @@ retransmit:
 					}
 					metadata.chunkMap = make(map[uint64]bool, metadata.fileSize)
 					metadata.firstMissing = 0
+					metadata.hash, metadata.hashed = nil, 0
+					metadata.leaves, metadata.unverified = nil, false
 					metadata.stats = *new(transferStats)
 				}
 				return nil
 			default:
-				conf.DebugLogger.Printf("Received unexpected response of type %T. Dropped\n", response)
+				conf.Logger.Debug("Received unexpected response, dropped", "type", fmt.Sprintf("%T", response))
 				continue receive
 			}
 		}
@@ -314,35 +746,86 @@ func getMetadataFromMDRR(metadata *fileMetadata, mdrr *messages.MDRR) error {
 	return nil
 }
 
-// Sends one ACR to get missing chunks.
-// This function also receives the CRRs, write them to localFile, update the
-// chunkMap and perform packet rate measurements.
-func getMissingChunks(conn net.Conn, metadata *fileMetadata, conf *ClientConfig) error {
+// pendingACR is an ACR that has been sent and whose CRRs are still expected.
+type pendingACR struct {
+	ACRSample
+	acr       *messages.ACR
+	requested []uint64  // Requested chunks, in the order of the ACR
+	deadline  time.Time // When the missing CRRs are considered lost
+}
+
+// Sends ACRs to get missing chunks until conf.MaxACRsInFlight ACRs are
+// outstanding, then receives CRRs until at least one of them is complete.
+// CRRs are attributed to their ACR by message number. This function also
+// writes the chunks to localFile, updates the chunkMap and reports the CRRs
+// to the congestion controller. ACRs that are still outstanding when it returns are kept
+// in metadata.pending for the next call.
+func getMissingChunks(ctx context.Context, conn net.Conn, metadata *fileMetadata, conf *ClientConfig) error {
 	buf := make([]byte, 0x10000) // 64kB
-	// Build an ACR and send it
-	acr, requested := buildACR(metadata)
-	conf.DebugLogger.Printf("Requesting chunks %v\n", requested)
-	n_cr := len(requested)
-	if n_cr == 0 {
-		return fmt.Errorf("no missing chunks.%v", metadata)
+	if metadata.pending == nil {
+		metadata.pending = make(map[uint8]*pendingACR)
+		metadata.inFlight = make(map[uint64]bool)
 	}
-	metadata.stats.requested += n_cr
-	t_send := time.Now()
-	err := acr.Send(conn)
-	if err != nil {
-		return fmt.Errorf("send ACR: %w", err)
+	if metadata.cc == nil {
+		metadata.cc = conf.newCongestionController(metadata.packetRate)
+	}
+	if metadata.acrSize == 0 {
+		_, upper := conf.acrSizeBounds(metadata.maxChunksInACR)
+		metadata.setACRSize(upper, time.Now())
+	}
+	// Hash the chunks already in the file, e.g. of a resumed transfer, before
+	// CRRs arrive rather than while receiving them
+	if metadata.localFile != nil {
+		if err := metadata.hashReceived(metadata.localFile); err != nil {
+			return err
+		}
 	}
-	deadline := t_send.Add(metadata.timeout)
-	mapTimeCRRs := make(map[int]time.Time)
-	received := false
-	for time.Now().Before(deadline) {
-		err = conn.SetReadDeadline(deadline)
+	// Build ACRs and send them until the window is full
+	for len(metadata.pending) < ccWindow(metadata.cc) {
+		metadata.packetRate = metadata.cc.NextRate()
+		acr, requested := buildACR(metadata)
+		if len(requested) == 0 {
+			break
+		}
+		conf.Logger.Debug("Requesting chunks", "chunks", requested)
+		t_send := time.Now()
+		err := acr.Send(conn)
 		if err != nil {
-			return fmt.Errorf("set deadline: %w", err)
+			return fmt.Errorf("send ACR: %w", err)
+		}
+		metadata.stats.requested += len(requested)
+		p := &pendingACR{
+			ACRSample: ACRSample{Sent: t_send, Rate: acr.PacketRate, Chunks: len(requested),
+				Received: make(map[int]time.Time)},
+			acr:       acr,
+			requested: requested,
+			deadline:  t_send.Add(metadata.timeout),
+		}
+		metadata.pending[acr.Header.Number] = p
+		for _, cn := range requested {
+			metadata.inFlight[cn] = true
+		}
+		metadata.cc.OnACRSent(&p.ACRSample)
+	}
+	if len(metadata.pending) == 0 {
+		return fmt.Errorf("no missing chunks.%v", metadata)
+	}
+
+	for {
+		deadline := metadata.nextDeadline()
+		if !time.Now().Before(deadline) {
+			break
+		}
+		err := setReadDeadline(ctx, conn, deadline)
+		if err != nil {
+			return err
 		}
 		n, err := conn.Read(buf)
 		t_recv := time.Now()
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if os.IsTimeout(err) {
 				// If it's a timeout, continue in case the deadline was extended
 				continue
@@ -361,52 +844,67 @@ func getMissingChunks(conn net.Conn, metadata *fileMetadata, conf *ClientConfig)
 			} else if errors.Is(err, new(messages.UnsupporedTypeError)) ||
 				errors.Is(err, new(messages.WrongPacketLengthError)) {
 				// Ignore unknown messages, but still log the error
-				conf.WarnLogger.Printf("Invalid response received: %v. Dropped response:%x\n", err, raw)
+				conf.Logger.Warn("Invalid response received, dropped", "err", err, "response", fmt.Sprintf("%x", raw))
 				continue
 			}
-			conf.WarnLogger.Printf("Unknown error while parsing response: %v. Dropped response:%x\n", err, raw)
+			conf.Logger.Warn("Unknown error while parsing response, dropped", "err", err, "response", fmt.Sprintf("%x", raw))
 			continue
 		}
 		switch response.(type) {
 		case messages.ServerHeader:
 			header := response.(messages.ServerHeader)
-			if header.Number != acr.Header.Number {
+			p, ok := metadata.pending[header.Number]
+			if !ok {
 				// Ignore it
 				metadata.stats.invalid++
-				conf.DebugLogger.Printf("Received response with wrong message number(%d instead of %d). Dropped\n", header.Number, acr.Header.Number)
+				conf.Logger.Debug("Received response matching no outstanding ACR, dropped", "number", header.Number)
 				continue
 			}
+			n_cr := len(p.requested)
 			switch header.Error {
 			case messages.UnsupportedVersion:
 				return fmt.Errorf("CRR server error: the server doesn't support our protocol version (%d) and answered with version %d", messages.VERS, header.Version)
 			case messages.InvalidFileID:
-				// Request new metadata and update it
+				// All outstanding ACRs use the old file ID. Request new
+				// metadata and update it
+				metadata.dropPending()
 				oldFileID := metadata.fileID
-				err := updateMetadata(conn, metadata, conf)
-				conf.InfoLogger.Printf("Updated metadata. Old fileID:%x, new fileID:%x\n", oldFileID, metadata.fileID)
+				err := updateMetadata(ctx, conn, metadata, conf)
+				conf.Logger.Info("Updated metadata", "old_file_id", logging.FileID(oldFileID), "file_id", logging.FileID(metadata.fileID))
 				if err != nil {
 					return fmt.Errorf("get metadata after invalid fileID: %w", err)
 				}
+				return nil
 			case messages.TooManyChunks:
 				// Let's check
 				if n_cr > int(metadata.maxChunksInACR) {
 					// Our mistake... Let's throw an error to investigate
-					return fmt.Errorf("malformed ACR: we requested %d chunks in an ACR. Max is %d. (%v)", n_cr, metadata.maxChunksInACR, acr)
-				} else {
-					metadata.stats.invalid++
-					conf.WarnLogger.Printf("Received TooManyChunks error for ACR %v. MaxChunksInACR=%d; # of chunks in ACR:%d. Ignored...\n", acr, metadata.maxChunksInACR, n_cr)
-					continue
+					return fmt.Errorf("malformed ACR: we requested %d chunks in an ACR. Max is %d. (%v)", n_cr, metadata.maxChunksInACR, p.acr)
+				}
+				// The server lowered its maximum since we got the metadata.
+				// All outstanding ACRs may be too large, so request new
+				// metadata with the new maximum
+				metadata.dropPending()
+				oldMax := metadata.maxChunksInACR
+				err := updateMetadata(ctx, conn, metadata, conf)
+				if err != nil {
+					return fmt.Errorf("get metadata after TooManyChunks: %w", err)
+				}
+				conf.Logger.Info("Updated metadata", "old_max_chunks_in_acr", oldMax, "max_chunks_in_acr", metadata.maxChunksInACR)
+				if n_cr <= int(metadata.maxChunksInACR) {
+					return fmt.Errorf("CRR server error: TooManyChunks for %d chunks, but the maximum is %d", n_cr, metadata.maxChunksInACR)
 				}
+				return nil
 			case messages.ZeroLengthCR:
 				// Let's check
-				for _, cr := range acr.CRs {
+				for _, cr := range p.acr.CRs {
 					if cr.Length == 0 {
 						// Our mistake
-						return fmt.Errorf("malformed ACR: we sent a CR with length 0. (%v)", acr)
+						return fmt.Errorf("malformed ACR: we sent a CR with length 0. (%v)", p.acr)
 					}
 				}
 				metadata.stats.invalid++
-				conf.WarnLogger.Printf("Received ZeroLengthCR error for ACR %v. Ignored.\n", acr)
+				conf.Logger.Warn("Received ZeroLengthCR error, ignored", "acr", p.acr)
 				continue
 			default:
 				return fmt.Errorf("CRR server error: Unknown error code for CRR %d", header.Error)
@@ -414,23 +912,27 @@ func getMissingChunks(conn net.Conn, metadata *fileMetadata, conf *ClientConfig)
 		case messages.NTM:
 			ntm := response.(messages.NTM)
 			if ntm.Token != metadata.token {
+				conf.Logger.Debug("Updated token, retransmitting", "token", fmt.Sprintf("%x", ntm.Token), "old", fmt.Sprintf("%x", metadata.token))
 				metadata.token = ntm.Token
-				conf.DebugLogger.Printf("Updated token to %x (from %x). Retransmitting...\n", ntm.Token, acr.Header.Token)
-				return nil // We shouldn't receive any further chunks if we used a wrong token.
-				// Should it be an error, though ? No, we just want to resume normally
+				// We shouldn't receive any further chunks for ACRs with a
+				// wrong token.
+				metadata.dropPending()
+				return nil
 			}
 		case messages.CRR:
 			crr := response.(messages.CRR)
-			if crr.Header.Number != acr.Header.Number {
-				// This message is not for us. Ignore it
+			p, ok := metadata.pending[crr.Header.Number]
+			if !ok {
+				// This message is not for an outstanding ACR. Ignore it
 				metadata.stats.late++
-				conf.DebugLogger.Printf("Received response with wrong message number(%d instead of %d). Dropped\n", crr.Header.Number, acr.Header.Number)
+				conf.Logger.Debug("Received response matching no outstanding ACR, dropped", "number", crr.Header.Number)
 				continue
 			}
+			n_cr := len(p.requested)
 			chunkNumber := messages.Uint8_6_arr2Int(crr.ChunkNumber)
 			// Let's find its position in the ACR
 			chunkIndexInACR := -1
-			for i, cn := range requested {
+			for i, cn := range p.requested {
 				if cn == chunkNumber {
 					chunkIndexInACR = i
 					break
@@ -439,7 +941,7 @@ func getMissingChunks(conn net.Conn, metadata *fileMetadata, conf *ClientConfig)
 			if chunkIndexInACR == -1 {
 				// This is not a chunk we requested. Ignore it.
 				metadata.stats.invalid++
-				conf.InfoLogger.Printf("Received CRR for unrequested chunk %d. (The requested chunks are %v). Dropped.\n", chunkNumber, requested)
+				conf.Logger.Info("Received CRR for unrequested chunk, dropped", "chunk", chunkNumber, "requested", p.requested)
 				continue
 			}
 			// We need to check that there is no error
@@ -451,67 +953,141 @@ func getMissingChunks(conn net.Conn, metadata *fileMetadata, conf *ClientConfig)
 				// Let's do a few checks
 				if chunkNumber >= metadata.fileSize {
 					// That's our fault. Let's throw an error to investigate
-					return fmt.Errorf("malformed ACR: we requested chunk #%d for a file of size %d (%v)", chunkNumber, metadata.fileSize, acr)
+					return fmt.Errorf("malformed ACR: we requested chunk #%d for a file of size %d (%v)", chunkNumber, metadata.fileSize, p.acr)
 				} else {
 					metadata.stats.invalid++
-					conf.WarnLogger.Printf("Received ChunkOutOfBounds error for chunk #%d in file of size %d. (%v)\n", chunkNumber, metadata.fileSize, acr)
+					conf.Logger.Warn("Received ChunkOutOfBounds error", "chunk", chunkNumber, "chunks", metadata.fileSize, "acr", p.acr)
 					continue
 				}
 			}
-			if !received {
-				// If it's the first CRR we receive, update RTT
-				rtt := time.Since(t_send) 
+			if len(p.Received) == 0 {
+				// If it's the first CRR we receive for this ACR, update RTT
+				rtt := time.Since(p.Sent)
 				if 2*rtt < conf.MinTimeout {
 					metadata.timeout = conf.MinTimeout
 				} else {
 					metadata.timeout = rtt * time.Duration(rtt2timeoutFactor)
 				}
-				received = true
 			}
-			mapTimeCRRs[chunkIndexInACR] = t_recv
-			deadline = t_recv.Add(time.Duration(conf.NCRRsToWait+n_cr-chunkIndexInACR) * time.Second / time.Duration(metadata.packetRate))
+			_, duplicate := p.Received[chunkIndexInACR]
+			p.Received[chunkIndexInACR] = t_recv
+			if !duplicate {
+				metadata.cc.OnCRR(&p.ACRSample, chunkIndexInACR)
+			}
+			if len(p.Received) == n_cr {
+				// Nothing left to wait for
+				p.deadline = t_recv
+			} else {
+				// The server sends at the rate requested in this ACR
+				p.deadline = t_recv.Add(time.Duration(conf.NCRRsToWait+n_cr-chunkIndexInACR) * time.Second / time.Duration(p.acr.PacketRate))
+			}
 
+			if !metadata.verifyChunk(chunkNumber, crr.Data) {
+				// Not written, so that it is requested again
+				metadata.stats.corrupt++
+				conf.Logger.Warn("Received corrupt chunk, requesting it again", "chunk", chunkNumber, "uri", metadata.url)
+				continue
+			}
+			if metadata.stream != nil {
+				err = writeChunkToStream(metadata, chunkNumber, crr.Data)
+				if metadata.stream.err != nil {
+					return fmt.Errorf("write to stream: %w", metadata.stream.err)
+				}
+				if err != nil {
+					conf.Logger.Warn("Could not write chunk", "chunk", chunkNumber, "uri", metadata.url, "err", err)
+				}
+				continue
+			}
 			err = writeChunkToFile(metadata, chunkNumber, crr.Data, metadata.localFile)
 			if err != nil {
-				conf.WarnLogger.Printf("Could not write chunk #%d to file %s : %v", chunkNumber, metadata.localFile.Name(), err)
+				conf.Logger.Warn("Could not write chunk", "chunk", chunkNumber, "file", metadata.localFile.Name(), "err", err)
 				continue
 			}
 		default:
 			// Ignore irrelevant messages
 			metadata.stats.received++
-			conf.WarnLogger.Printf("Received unexpected response type to ACR: %T. Dropped...\n", response)
+			conf.Logger.Warn("Received unexpected response to ACR, dropped", "type", fmt.Sprintf("%T", response))
 			continue
 		}
 	}
-	if received {
-		if n_cr > 1 {
-			newPacketRate, err := computePacketRate(mapTimeCRRs, n_cr, metadata.packetRate)
-			if err != nil {
-				return fmt.Errorf("compute new packetRate: %w", err)
-			}
-			metadata.packetRate = newPacketRate
+	return completeExpiredACRs(metadata, conf, time.Now())
+}
+
+// nextDeadline returns the earliest deadline of the outstanding ACRs.
+func (metadata *fileMetadata) nextDeadline() time.Time {
+	var next time.Time
+	for _, p := range metadata.pending {
+		if next.IsZero() || p.deadline.Before(next) {
+			next = p.deadline
 		}
-	} else {
+	}
+	return next
+}
+
+// dropPending forgets about all outstanding ACRs. Their chunks will be
+// requested again.
+func (metadata *fileMetadata) dropPending() {
+	metadata.pending = make(map[uint8]*pendingACR)
+	metadata.inFlight = make(map[uint64]bool)
+}
+
+// completeExpiredACRs removes the outstanding ACRs whose deadline has passed,
+// reports their losses to the congestion controller, adapts the ACR size and
+// backs off the timeout if none of the chunks of an ACR arrived. The chunks
+// that did not arrive become available for the next ACR.
+func completeExpiredACRs(metadata *fileMetadata, conf *ClientConfig, now time.Time) error {
+	expired := []*pendingACR{}
+	for number, p := range metadata.pending {
+		if !now.Before(p.deadline) {
+			expired = append(expired, p)
+			delete(metadata.pending, number)
+		}
+	}
+	// The most recent measurement wins
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Sent.Before(expired[j].Sent) })
+	lost := false
+	for _, p := range expired {
+		for _, cn := range p.requested {
+			delete(metadata.inFlight, cn)
+		}
+		switch {
+		case len(p.Received) == 0:
+			lost = true
+			metadata.cc.OnTimeout(&p.ACRSample)
+		case !p.Complete():
+			metadata.cc.OnLoss(&p.ACRSample)
+		}
+		adaptACRSize(metadata, p, conf, now)
+	}
+	if lost {
 		// Exponential backoff
 		metadata.timeout *= 2
 	}
 	return nil
 }
 
-// Build an ACR to request the missing chunks according to metadata.chunkMap
+// Build an ACR to request the missing chunks according to metadata.chunkMap,
+// at most metadata.chunksPerACR() of them. Chunks requested by an outstanding
+// ACR are skipped.
 func buildACR(metadata *fileMetadata) (acr *messages.ACR, requested []uint64) {
 	chunksInACR := 0
 	requested = []uint64{}
 	chunkRequests := []messages.CR{}
+	maxChunks := metadata.chunksPerACR()
+	limit := metadata.requestLimit()
 	offset := metadata.firstMissing
-	for chunksInACR < int(metadata.maxChunksInACR) && offset < metadata.fileSize {
+	for metadata.chunkMap[offset] || metadata.inFlight[offset] {
+		offset++
+	}
+	for chunksInACR < maxChunks && offset < limit {
 		requested = append(requested, offset)
 		length := 1
 		// Find longest length of missing chunks starting from offset
-		for uint64(length)+offset < metadata.fileSize &&
-			length < int(metadata.maxChunksInACR)-chunksInACR &&
+		for uint64(length)+offset < limit &&
+			length < maxChunks-chunksInACR &&
 			length < 255 &&
-			!metadata.chunkMap[uint64(length)+offset] {
+			!metadata.chunkMap[uint64(length)+offset] &&
+			!metadata.inFlight[uint64(length)+offset] {
 			requested = append(requested, uint64(length)+offset)
 			length++
 		}
@@ -520,7 +1096,7 @@ func buildACR(metadata *fileMetadata) (acr *messages.ACR, requested []uint64) {
 		chunksInACR += length
 		// Find the next offset of a missing chunk
 		offset += uint64(length)
-		for metadata.chunkMap[offset] {
+		for metadata.chunkMap[offset] || metadata.inFlight[offset] {
 			offset++
 		}
 	}
@@ -543,13 +1119,82 @@ func writeChunkToFile(metadata *fileMetadata, chunkNumber uint64, data []byte, f
 		// Update chunkMap and first Missing
 		metadata.chunkMap[chunkNumber] = true
 		metadata.stats.received++
+		metadata.stats.bytes += uint64(len(data))
 		for metadata.chunkMap[metadata.firstMissing] {
 			metadata.firstMissing++
 		}
+		if err := metadata.hashPrefix(file, chunkNumber, data); err != nil {
+			return fmt.Errorf("hash received chunks: %w", err)
+		}
+	}
+	return nil
+}
+
+// hashPrefix adds the chunks that joined the contiguous prefix of received
+// chunks to metadata.hash, so that the checksum is ready as soon as the last
+// chunk arrives. data is chunk chunkNumber; chunks that arrived out of order
+// are read back from file, one at a time.
+func (metadata *fileMetadata) hashPrefix(file *os.File, chunkNumber uint64, data []byte) error {
+	if metadata.hash == nil {
+		metadata.hash = sha256.New()
+	}
+	for metadata.hashed < metadata.firstMissing {
+		if metadata.hashed == chunkNumber {
+			metadata.hash.Write(data)
+		} else {
+			if metadata.hashBuf == nil {
+				metadata.hashBuf = make([]byte, metadata.chunkSize)
+			}
+			n, err := file.ReadAt(metadata.hashBuf, int64(metadata.hashed)*int64(metadata.chunkSize))
+			if err != nil && !(errors.Is(err, io.EOF) && metadata.hashed == metadata.fileSize-1) {
+				return fmt.Errorf("read chunk %d: %w", metadata.hashed, err)
+			}
+			metadata.hash.Write(metadata.hashBuf[:n])
+		}
+		metadata.hashed++
 	}
 	return nil
 }
 
+// hashReceived adds the contiguous prefix of received chunks in file that is
+// not hashed yet, e.g. restored from a journal, to metadata.hash in one go.
+func (metadata *fileMetadata) hashReceived(file *os.File) error {
+	if metadata.hashed >= metadata.firstMissing {
+		return nil
+	}
+	if metadata.hash == nil {
+		metadata.hash = sha256.New()
+	}
+	offset := int64(metadata.hashed) * int64(metadata.chunkSize)
+	length := int64(metadata.firstMissing)*int64(metadata.chunkSize) - offset
+	n, err := io.Copy(metadata.hash, io.NewSectionReader(file, offset, length))
+	if err == nil && n < length && metadata.firstMissing < metadata.fileSize {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("hash received chunks: %w", err)
+	}
+	metadata.hashed = metadata.firstMissing
+	return nil
+}
+
+// finishChecksum returns the checksum of file, hashing the part after the
+// chunks hashed by hashPrefix, e.g. of a resumed transfer, from the file.
+func (metadata *fileMetadata) finishChecksum(file *os.File) ([32]byte, error) {
+	var checksum [32]byte
+	if metadata.hash == nil {
+		metadata.hash = sha256.New()
+	}
+	offset := int64(metadata.hashed) * int64(metadata.chunkSize)
+	_, err := io.Copy(metadata.hash, io.NewSectionReader(file, offset, math.MaxInt64-offset))
+	if err != nil {
+		return checksum, fmt.Errorf("compute checksum: %w", err)
+	}
+	metadata.hashed = metadata.fileSize
+	metadata.hash.Sum(checksum[:0])
+	return checksum, nil
+}
+
 // computePacketRate computes a new packet rate from:
 //   - timeReceiveCRR: a map that contains the time each CRR was received at.
 //     They are indexed by their position in the ACR that caused the response.
@@ -620,12 +1265,16 @@ func computePacketRate(timeReceiveCRR map[int]time.Time, n_expected int, packetR
 
 func computeChecksum(filename string) ([32]byte, error) {
 	var hash [32]byte
-	data, err := os.ReadFile(filename)
+	f, err := os.Open(filename)
 	if err != nil {
 		return hash, fmt.Errorf("compute checksum: %w", err)
 	}
+	defer f.Close()
 	h := sha256.New()
-	h.Write(data)
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return hash, fmt.Errorf("compute checksum: %w", err)
+	}
 	copy(hash[:], h.Sum(nil))
 
 	return hash, nil
@@ -1,20 +1,26 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
+	mathrand "math/rand"
 	"net"
 	"os"
+	"reflect"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/merkle"
 	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
 )
 
@@ -25,9 +31,7 @@ var testConfig = ClientConfig{
 	NCRRsToWait:        3,
 	MarkovP:            0,
 	MarkovQ:            0,
-	DebugLogger:        log.New(ioutil.Discard, "DEBUG: ", log.LstdFlags),
-	InfoLogger:         log.New(ioutil.Discard, "INFO: ", log.LstdFlags),
-	WarnLogger:         log.New(os.Stderr, "WARN: ", log.LstdFlags),
+	Logger:             slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
 }
 
 func startMockServer(quit <-chan bool, conn net.PacketConn, filename string, chunkSize uint16, maxChunksInACR uint16, fileID uint32, fileData []byte) {
@@ -147,6 +151,41 @@ func startMockServer(quit <-chan bool, conn net.PacketConn, filename string, chu
 						tNext = time.Now().Add(time.Second / time.Duration(packetRate))
 					}
 				}
+			case messages.HSR:
+				hsr := msg.(messages.HSR)
+				if hsr.Header.Token != token {
+					response := messages.GetNTM(hsr.Header.Number, 0, &token)
+					err = response.Send(conn, addr)
+					if err != nil {
+						fmt.Printf("Mock Server: Error while sending NTM: %v\n", err)
+					}
+					break
+				}
+				pageSize := merkle.PageSize(int(chunkSize) / merkle.Size)
+				pages := merkle.Pages(int(fileSize), pageSize)
+				if hsr.FileID != fileID || int(hsr.Page) >= pages {
+					response := messages.ServerHeader{Version: messages.VERS, Type: messages.HSRR_t, Number: hsr.Header.Number, Error: messages.InvalidFileID}
+					if hsr.FileID == fileID {
+						response.Error = messages.PageOutOfBounds
+					}
+					err = response.Send(conn, addr)
+					if err != nil {
+						fmt.Printf("Mock Server: Error while sending header: %v\n", err)
+					}
+					break
+				}
+				leaves := make([][merkle.Size]byte, fileSize)
+				for i := range leaves {
+					leaves[i] = merkle.LeafHash(fileData[i*int(chunkSize) : min((i+1)*int(chunkSize), len(fileData))])
+				}
+				tree := merkle.New(leaves)
+				root := tree.Root()
+				page, proof := tree.Page(int(hsr.Page), pageSize)
+				response := messages.GetHSRR(hsr.Header.Number, 0, fileID, hsr.Page, uint32(pages), uint32(pageSize), &root, proof, page)
+				err = response.Send(conn, addr)
+				if err != nil {
+					fmt.Printf("Mock Server: Error while sending HSRR: %v\n", err)
+				}
 			}
 		}
 	}
@@ -294,6 +333,60 @@ func TestChecksum(t *testing.T) {
 	}
 }
 
+func TestIncrementalChecksum(t *testing.T) {
+	chunkSize := 16
+	data := make([]byte, 10*chunkSize+5)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatalf("Could not read random data: %v", err)
+	}
+	chunk := func(i uint64) []byte {
+		return data[int(i)*chunkSize : min(int(i+1)*chunkSize, len(data))]
+	}
+
+	for _, test := range []struct {
+		name    string
+		resumed []uint64 // Already in the file, read back to hash them
+		order   []uint64
+		hashed  []uint64 // After each chunk of order
+	}{
+		{"in order", nil, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{"out of order", nil, []uint64{3, 1, 10, 0, 2, 4, 9, 8, 7, 6, 5}, []uint64{0, 0, 0, 2, 4, 5, 5, 5, 5, 5, 11}},
+		{"resumed", []uint64{0, 1, 2, 7}, []uint64{4, 3, 5, 6, 8, 9, 10}, []uint64{3, 5, 6, 8, 9, 10, 11}},
+	} {
+		tmp, err := os.CreateTemp("", "checksum_test_go")
+		if err != nil {
+			t.Fatalf("Open temp file: %v", err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		metadata := fileMetadata{chunkMap: make(map[uint64]bool), chunkSize: uint16(chunkSize), fileSize: 11}
+		for _, i := range test.resumed {
+			tmp.WriteAt(chunk(i), int64(i)*int64(chunkSize))
+			metadata.chunkMap[i] = true
+		}
+		for metadata.chunkMap[metadata.firstMissing] {
+			metadata.firstMissing++
+		}
+		for n, i := range test.order {
+			if err := writeChunkToFile(&metadata, i, chunk(i), tmp); err != nil {
+				t.Fatalf("%v: writeChunkToFile failed: %v", test.name, err)
+			}
+			if metadata.hashed != test.hashed[n] {
+				t.Fatalf("%v: expected %d chunks hashed after chunk %d, got %d", test.name, test.hashed[n], i, metadata.hashed)
+			}
+		}
+		checksum, err := metadata.finishChecksum(tmp)
+		if err != nil {
+			t.Fatalf("%v: finishChecksum failed: %v", test.name, err)
+		}
+		if checksum != sha256.Sum256(data) {
+			t.Fatalf("%v: invalid checksum %x", test.name, checksum)
+		}
+	}
+}
+
 func FuzzComputePacketRate(f *testing.F) {
 	f.Add(10, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, []byte{50}, uint32(20))
 	f.Add(10, []byte{2, 3, 4, 5, 6, 7, 8, 9}, []byte{100}, uint32(10))
@@ -401,7 +494,7 @@ func TestUpdateMetadata(t *testing.T) {
 	metadata.timeout = 3 * time.Second
 	metadata.url = URI
 
-	err = updateMetadata(conn_client, metadata, &testConfig)
+	err = updateMetadata(context.Background(), conn_client, metadata, &testConfig)
 	if err != nil {
 		t.Fatalf("updateMetadata failed: %v", err)
 	}
@@ -419,7 +512,7 @@ func TestUpdateMetadata(t *testing.T) {
 	metadata.chunkMap[2] = true
 	// Simulate a file ID change and a new metadata request
 	metadata.fileID = 0xf00dbad1
-	err = updateMetadata(conn_client, metadata, &testConfig)
+	err = updateMetadata(context.Background(), conn_client, metadata, &testConfig)
 	if err != nil {
 		t.Fatalf("updateMetadata failed: %v", err)
 	}
@@ -468,7 +561,7 @@ func TestUpdateMetadataNotFound(t *testing.T) {
 	metadata.timeout = 3 * time.Second
 	metadata.url = wrongURI
 
-	err = updateMetadata(conn_client, metadata, &testConfig)
+	err = updateMetadata(context.Background(), conn_client, metadata, &testConfig)
 	if err == nil {
 		t.Fatalf("updateMetadata should have failed. It didn't")
 	}
@@ -574,7 +667,7 @@ func TestConnectionMigration(t *testing.T) {
 	metadata.url = URI
 	metadata.packetRate = 10
 
-	err = updateMetadata(conn_client, metadata, &testConfig)
+	err = updateMetadata(context.Background(), conn_client, metadata, &testConfig)
 	if err != nil {
 		t.Fatalf("updateMetadata failed: %v", err)
 	}
@@ -585,7 +678,7 @@ func TestConnectionMigration(t *testing.T) {
 	}
 	defer metadata.localFile.Close()
 
-	err = getMissingChunks(conn_client, metadata, &testConfig)
+	err = getMissingChunks(context.Background(), conn_client, metadata, &testConfig)
 	if err != nil {
 		t.Fatalf("getMissingChunks failed: %v", err)
 	}
@@ -598,7 +691,7 @@ func TestConnectionMigration(t *testing.T) {
 	defer conn_client2.Close()
 
 	for metadata.firstMissing < metadata.fileSize {
-		err = getMissingChunks(conn_client2, metadata, &testConfig)
+		err = getMissingChunks(context.Background(), conn_client2, metadata, &testConfig)
 		if err != nil {
 			t.Fatalf("getMissingChunks failed: %v", err)
 		}
@@ -647,7 +740,7 @@ func TestFileIDChange(t *testing.T) {
 	metadata.url = URI
 	metadata.packetRate = 10
 
-	err = updateMetadata(conn_client, metadata, &testConfig)
+	err = updateMetadata(context.Background(), conn_client, metadata, &testConfig)
 	if err != nil {
 		t.Fatalf("updateMetadata failed: %v", err)
 	}
@@ -658,7 +751,7 @@ func TestFileIDChange(t *testing.T) {
 	}
 	defer metadata.localFile.Close()
 
-	err = getMissingChunks(conn_client, metadata, &testConfig)
+	err = getMissingChunks(context.Background(), conn_client, metadata, &testConfig)
 	if err != nil {
 		t.Fatalf("getMissingChunks failed: %v", err)
 	}
@@ -671,7 +764,7 @@ func TestFileIDChange(t *testing.T) {
 	go startMockServer(quit, conn_server, URI, chunkSize, maxChunksInACR, fileID2, data2)
 
 	for metadata.firstMissing < metadata.fileSize {
-		err = getMissingChunks(conn_client, metadata, &testConfig)
+		err = getMissingChunks(context.Background(), conn_client, metadata, &testConfig)
 		if err != nil {
 			t.Fatalf("getMissingChunks failed: %v", err)
 		}
@@ -719,7 +812,7 @@ func TestFileDeleted(t *testing.T) {
 	metadata.url = URI
 	metadata.packetRate = 10
 
-	err = updateMetadata(conn_client, metadata, &testConfig)
+	err = updateMetadata(context.Background(), conn_client, metadata, &testConfig)
 	if err != nil {
 		t.Fatalf("updateMetadata failed: %v", err)
 	}
@@ -730,7 +823,7 @@ func TestFileDeleted(t *testing.T) {
 	}
 	defer metadata.localFile.Close()
 
-	err = getMissingChunks(conn_client, metadata, &testConfig)
+	err = getMissingChunks(context.Background(), conn_client, metadata, &testConfig)
 	if err != nil {
 		t.Fatalf("getMissingChunks failed: %v", err)
 	}
@@ -742,7 +835,7 @@ func TestFileDeleted(t *testing.T) {
 	// Start new server with no file under required URI
 	go startMockServer(quit, conn_server, "", chunkSize, maxChunksInACR, 0x0, []byte{})
 
-	err = getMissingChunks(conn_client, metadata, &testConfig)
+	err = getMissingChunks(context.Background(), conn_client, metadata, &testConfig)
 	if err == nil {
 		t.Fatalf("Expected error from getMissingChunks. Got nil.")
 	}
@@ -750,3 +843,1550 @@ func TestFileDeleted(t *testing.T) {
 		t.Fatalf("Expected %v in getMissingChunks error. Got %v.", want, err)
 	}
 }
+
+func TestFetch(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "fetch"
+	chunkSize := uint16(16)
+	maxChunksInACR := uint16(8)
+	fileID := uint32(0xfe7c4)
+	data := make([]byte, 1000)
+	filename := "/tmp/sanftTestFetch.dat"
+	quit := make(chan bool)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatalf("Could not read random data: %v", err)
+	}
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go startMockServer(quit, conn_server, URI, chunkSize, maxChunksInACR, fileID, data)
+	defer func() { quit <- true }()
+
+	progressCalls := 0
+	conf := testConfig
+	conf.Progress = func(r Result) { progressCalls++ }
+	c, err := New(IP, port, &conf)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	result, err := c.Fetch(context.Background(), URI, filename)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	defer os.Remove(filename)
+
+	if result.FileID != fileID {
+		t.Fatalf("Invalid fileID. Expected %x got %x", fileID, result.FileID)
+	}
+	if result.Bytes != uint64(len(data)) {
+		t.Fatalf("Invalid number of bytes. Expected %d got %d", len(data), result.Bytes)
+	}
+	if result.Chunks != 63 || result.Received != 63 {
+		t.Fatalf("Invalid number of chunks. Expected 63 got %d (%d received)", result.Chunks, result.Received)
+	}
+	if result.Checksum != sha256.Sum256(data) {
+		t.Fatalf("Invalid checksum %x", result.Checksum)
+	}
+	if progressCalls == 0 {
+		t.Fatalf("Progress was never called")
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	var out bytes.Buffer
+	b := newReorderBuffer(&out, 8)
+	for _, chunk := range []uint64{2, 1} {
+		if !b.add(chunk, []byte(fmt.Sprintf("c%d-", chunk))) {
+			t.Fatalf("Chunk %d not buffered", chunk)
+		}
+	}
+	if b.add(3, []byte("c3-")) {
+		t.Fatalf("Chunk 3 buffered beyond the limit")
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Chunks written out of order: %q", out.String())
+	}
+	b.add(0, []byte("c0-"))
+	if out.String() != "c0-c1-c2-" || b.next != 3 || b.buffered != 0 {
+		t.Fatalf("Expected chunks 0 to 2 in order, got %q (next %d, %d bytes buffered)", out.String(), b.next, b.buffered)
+	}
+	b.add(3, []byte("c3-"))
+	var checksum [32]byte
+	b.hash.Sum(checksum[:0])
+	if checksum != sha256.Sum256([]byte("c0-c1-c2-c3-")) {
+		t.Fatalf("Invalid checksum %x", checksum)
+	}
+	if b.window(4) != 2 {
+		t.Fatalf("Expected a window of 2 chunks, got %d", b.window(4))
+	}
+}
+
+func TestFetchTo(t *testing.T) {
+	IP := net.ParseIP("127.0.0.202")
+	port := 6666
+	URI := "stream"
+	chunkSize := uint16(16)
+	maxChunksInACR := uint16(8)
+	fileID := uint32(0x57ea)
+	data := make([]byte, 1000)
+	quit := make(chan bool)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatalf("Could not read random data: %v", err)
+	}
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go startMockServer(quit, conn_server, URI, chunkSize, maxChunksInACR, fileID, data)
+	defer func() { quit <- true }()
+
+	conf := testConfig
+	// Room for two chunks after the next one
+	conf.StreamBuffer = 2*int(chunkSize) + 1
+	maxRequested := 0
+	conf.NewCongestionController = func(initialRate uint32, maxWindow int) CongestionController {
+		return &recordingController{CongestionController: NewMeasuringController(initialRate, maxWindow), maxChunks: &maxRequested}
+	}
+	c, err := New(IP, port, &conf)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	var out bytes.Buffer
+	result, err := c.FetchTo(context.Background(), URI, &out)
+	if err != nil {
+		t.Fatalf("FetchTo failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("Streamed data differs from sent data")
+	}
+	if result.Bytes != uint64(len(data)) || result.Received != 63 {
+		t.Fatalf("Invalid result: %d bytes, %d chunks received", result.Bytes, result.Received)
+	}
+	if maxRequested != 3 {
+		t.Fatalf("Expected at most 3 chunks per ACR with the buffer limit, got %d", maxRequested)
+	}
+}
+
+// recordingController records the largest ACR.
+type recordingController struct {
+	CongestionController
+	maxChunks *int
+}
+
+func (c *recordingController) OnACRSent(acr *ACRSample) {
+	*c.maxChunks = max(*c.maxChunks, acr.Chunks)
+	c.CongestionController.OnACRSent(acr)
+}
+
+func TestFetchCancel(t *testing.T) {
+	IP := net.ParseIP("127.0.0.201")
+	port := 6667
+	filename := "/tmp/sanftTestCancel.dat"
+
+	// A server that never answers
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	c, err := New(IP, port, &testConfig)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err := c.Fetch(ctx, "never", filename)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Fetch took %v to notice the cancellation", elapsed)
+	}
+	if result == nil || result.URI != "never" {
+		t.Fatalf("Expected a result describing the transfer, got %v", result)
+	}
+	if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("No file should have been created")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	filename := "/tmp/sanftTestJournal.dat"
+	defer removeJournal(filename)
+
+	metadata := new(fileMetadata)
+	metadata.chunkSize = 1024
+	metadata.fileID = 0x10feed
+	metadata.fileSize = 21
+	metadata.checksum = sha256.Sum256([]byte("journal"))
+	metadata.chunkMap = map[uint64]bool{0: true, 1: true, 2: true, 7: true, 20: true, 13: false}
+
+	err := saveJournal(filename, metadata)
+	if err != nil {
+		t.Fatalf("saveJournal failed: %v", err)
+	}
+
+	loaded := new(fileMetadata)
+	err = loadJournal(filename, loaded)
+	if err != nil {
+		t.Fatalf("loadJournal failed: %v", err)
+	}
+	if loaded.chunkSize != metadata.chunkSize || loaded.fileID != metadata.fileID ||
+		loaded.fileSize != metadata.fileSize || loaded.checksum != metadata.checksum {
+		t.Fatalf("Loaded metadata %+v differs from saved metadata %+v", loaded, metadata)
+	}
+	for chunk := uint64(0); chunk < metadata.fileSize; chunk++ {
+		if loaded.chunkMap[chunk] != metadata.chunkMap[chunk] {
+			t.Fatalf("chunkMap differs for chunk %d", chunk)
+		}
+	}
+	if loaded.firstMissing != 3 {
+		t.Fatalf("Invalid firstMissing. Expected 3 got %d", loaded.firstMissing)
+	}
+	if loaded.stats.resumed != 5 {
+		t.Fatalf("Invalid number of resumed chunks. Expected 5 got %d", loaded.stats.resumed)
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	filename := "/tmp/sanftTestJournalCorrupt.dat"
+	defer removeJournal(filename)
+
+	metadata := new(fileMetadata)
+	metadata.chunkSize = 1024
+	metadata.fileSize = 21
+	err := saveJournal(filename, metadata)
+	if err != nil {
+		t.Fatalf("saveJournal failed: %v", err)
+	}
+	// Claim 2^48 chunks without the bitmap to back them
+	journal, err := os.ReadFile(journalName(filename))
+	if err != nil {
+		t.Fatalf("Could not read journal: %v", err)
+	}
+	binary.BigEndian.PutUint64(journal[12:20], 1<<48)
+	err = os.WriteFile(journalName(filename), journal, 0644)
+	if err != nil {
+		t.Fatalf("Could not write journal: %v", err)
+	}
+	err = loadJournal(filename, new(fileMetadata))
+	if err == nil {
+		t.Fatalf("loadJournal accepted a journal that is too short for its file size")
+	}
+}
+
+func TestCheckPartialFile(t *testing.T) {
+	filename := "/tmp/sanftTestPartial.dat"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	metadata := new(fileMetadata)
+	metadata.chunkSize = 16
+	metadata.fileSize = 4
+	metadata.chunkMap = map[uint64]bool{0: true, 2: true}
+	if err := checkPartialFile(filename, metadata); err == nil {
+		t.Fatalf("Accepted a missing partial file")
+	}
+	for size, ok := range map[int]bool{0: false, 47: false, 48: true, 64: true, 65: false} {
+		err := os.WriteFile(filename, make([]byte, size), 0644)
+		if err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+		err = checkPartialFile(filename, metadata)
+		if (err == nil) != ok {
+			t.Fatalf("Partial file of %d bytes: expected ok=%v, got %v", size, ok, err)
+		}
+	}
+	// The last chunk may be shorter than chunkSize
+	metadata.chunkMap[3] = true
+	if err := os.WriteFile(filename, make([]byte, 49), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if err := checkPartialFile(filename, metadata); err != nil {
+		t.Fatalf("Rejected a partial file with a short last chunk: %v", err)
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "resume"
+	chunkSize := uint16(16)
+	maxChunksInACR := uint16(4)
+	fileID := uint32(0x7e5c4e)
+	data := make([]byte, 500)
+	filename := "/tmp/sanftTestResume.dat"
+	quit := make(chan bool)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatalf("Could not read random data: %v", err)
+	}
+	os.Remove(filename)
+	removeJournal(filename)
+	defer os.Remove(filename)
+	defer removeJournal(filename)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go startMockServer(quit, conn_server, URI, chunkSize, maxChunksInACR, fileID, data)
+	defer func() { quit <- true }()
+
+	// Interrupt the transfer after the first ACR
+	ctx, cancel := context.WithCancel(context.Background())
+	conf := testConfig
+	conf.Resume = true
+	conf.Progress = func(r Result) { cancel() }
+	c, err := New(IP, port, &conf)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+	first, err := c.Fetch(ctx, URI, filename)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if first.Received == 0 || uint64(first.Received) >= first.Chunks {
+		t.Fatalf("Expected a partial transfer, got %d/%d chunks", first.Received, first.Chunks)
+	}
+	if _, err := os.Stat(journalName(filename)); err != nil {
+		t.Fatalf("Journal was not kept: %v", err)
+	}
+
+	// Resume it
+	c.Config.Progress = nil
+	second, err := c.Fetch(context.Background(), URI, filename)
+	if err != nil {
+		t.Fatalf("Resumed Fetch failed: %v", err)
+	}
+	if second.Resumed != first.Received {
+		t.Fatalf("Expected %d resumed chunks, got %d", first.Received, second.Resumed)
+	}
+	if uint64(second.Resumed+second.Received) != second.Chunks {
+		t.Fatalf("Resumed (%d) and received (%d) chunks do not add up to %d", second.Resumed, second.Received, second.Chunks)
+	}
+	if _, err := os.Stat(journalName(filename)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Journal should be removed after a complete transfer")
+	}
+	fileData, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	if !bytes.Equal(fileData, data) {
+		t.Fatalf("The received data and sent data differ")
+	}
+}
+
+// acrHookConn calls sent before every ACR it sends.
+type acrHookConn struct {
+	net.Conn
+	sent func()
+}
+
+func (c *acrHookConn) Write(b []byte) (int, error) {
+	if len(b) > 1 && b[1] == messages.ACR_t {
+		c.sent()
+	}
+	return c.Conn.Write(b)
+}
+
+// The chunks of a large resumed transfer are hashed before the first ACR, not
+// while the CRRs to it are received.
+func TestResumeLargeFile(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "resume-large"
+	chunkSize := uint16(1024)
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+	filename := t.TempDir() + "/large.dat"
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+	go startMockServer(quit, conn_server, URI, chunkSize, 8, 0x1a, data)
+	defer func() { quit <- true }()
+
+	client, err := messages.CreateClientSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer client.Close()
+	metadata := new(fileMetadata)
+	hashedAtACR := -1
+	conn_client := &acrHookConn{Conn: client, sent: func() {
+		if hashedAtACR < 0 {
+			hashedAtACR = int(metadata.hashed)
+		}
+	}}
+
+	conf := testConfig
+	metadata.timeout = 3 * time.Second
+	metadata.url = URI
+	metadata.packetRate = 100
+	err = updateMetadata(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("updateMetadata failed: %v", err)
+	}
+	// all but the last 8 chunks are kept from an interrupted transfer
+	resumed := metadata.fileSize - 8
+	os.WriteFile(filename, data[:resumed*uint64(chunkSize)], 0644)
+	for chunk := uint64(0); chunk < resumed; chunk++ {
+		metadata.chunkMap[chunk] = true
+	}
+	metadata.firstMissing = resumed
+	metadata.localFile, err = os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Could not open file: %v", err)
+	}
+	defer metadata.localFile.Close()
+
+	for metadata.firstMissing < metadata.fileSize {
+		err = getMissingChunks(context.Background(), conn_client, metadata, &conf)
+		if err != nil {
+			t.Fatalf("getMissingChunks failed: %v", err)
+		}
+	}
+	if hashedAtACR != int(resumed) {
+		t.Fatalf("Expected %d chunks hashed before the first ACR, got %d", resumed, hashedAtACR)
+	}
+	checksum, err := metadata.finishChecksum(metadata.localFile)
+	if err != nil || checksum != metadata.checksum {
+		t.Fatalf("Checksum of the resumed file not matching: %v", err)
+	}
+}
+
+func TestPipelinedACRs(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "pipeline"
+	chunkSize := uint16(8)
+	maxChunksInACR := uint16(4)
+	fileID := uint32(0x919e)
+	data := []byte("Alice was beginning to get very tired of sitting by her sister on the bank, and of having nothing to do: once or twice she had peeped into the book her sister was reading, but it had no pictures or conversations in it, “and what is the use of a book,” thought Alice “without pictures or conversations?”")
+	filename := "/tmp/sanftTestPipeline.dat"
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go startMockServer(quit, conn_server, URI, chunkSize, maxChunksInACR, fileID, data)
+	defer func() { quit <- true }()
+
+	conn_client, err := messages.CreateClientSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer conn_client.Close()
+
+	conf := testConfig
+	conf.MaxACRsInFlight = 4
+	// A CRR is taken for lost if it does not arrive within NCRRsToWait
+	// packets at the requested rate, some ten milliseconds here, which a
+	// descheduled mock server can exceed on a loaded machine. Nothing is
+	// lost on the loopback, so wait long enough that every chunk is
+	// requested exactly once.
+	conf.NCRRsToWait = 1 << 30
+	conf.MinTimeout = 10 * time.Second
+
+	metadata := new(fileMetadata)
+	metadata.timeout = conf.MinTimeout
+	metadata.url = URI
+	metadata.packetRate = 100
+
+	err = updateMetadata(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("updateMetadata failed: %v", err)
+	}
+
+	metadata.localFile, err = os.Create(filename)
+	if err != nil {
+		t.Fatalf("Could not open file: %v", err)
+	}
+	defer os.Remove(filename)
+	defer metadata.localFile.Close()
+
+	err = getMissingChunks(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("getMissingChunks failed: %v", err)
+	}
+	// The mock server answers the ACRs one after the other, so the first one
+	// completes while the others are still outstanding.
+	if len(metadata.pending) != 3 {
+		t.Fatalf("Expected 3 outstanding ACRs, got %d", len(metadata.pending))
+	}
+	if len(metadata.inFlight) != 3*int(maxChunksInACR) {
+		t.Fatalf("Expected %d chunks in flight, got %d", 3*maxChunksInACR, len(metadata.inFlight))
+	}
+	for _, p := range metadata.pending {
+		for _, cn := range p.requested {
+			if metadata.chunkMap[cn] {
+				t.Fatalf("Chunk %d was received but is still in flight", cn)
+			}
+		}
+	}
+
+	for metadata.firstMissing < metadata.fileSize {
+		err = getMissingChunks(context.Background(), conn_client, metadata, &conf)
+		if err != nil {
+			t.Fatalf("getMissingChunks failed: %v", err)
+		}
+	}
+	if metadata.stats.requested != int(metadata.fileSize) {
+		t.Fatalf("Expected every chunk to be requested once, %d requests for %d chunks", metadata.stats.requested, metadata.fileSize)
+	}
+	for chunk := uint64(0); chunk < metadata.fileSize; chunk++ {
+		if !metadata.chunkMap[chunk] {
+			t.Fatalf("Chunk %d did not arrive", chunk)
+		}
+	}
+
+	err = checkFileContains(metadata.localFile, data)
+	if err != nil {
+		t.Fatalf("received data differs from sent data: %v", err)
+	}
+}
+
+func TestLoweredMaxChunksInACR(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "lowered"
+	chunkSize := uint16(8)
+	fileID := uint32(0x70ad)
+	data := []byte("Alice was beginning to get very tired of sitting by her sister on the bank, and of having nothing to do: once or twice she had peeped into the book her sister was reading, but it had no pictures or conversations in it, “and what is the use of a book,” thought Alice “without pictures or conversations?”")
+	filename := "/tmp/sanftTestLowered.dat"
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go startMockServer(quit, conn_server, URI, chunkSize, 8, fileID, data)
+
+	conn_client, err := messages.CreateClientSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer conn_client.Close()
+
+	conf := testConfig
+	conf.MaxACRsInFlight = 2
+
+	metadata := new(fileMetadata)
+	metadata.timeout = 3 * time.Second
+	metadata.url = URI
+	metadata.packetRate = 100
+
+	err = updateMetadata(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("updateMetadata failed: %v", err)
+	}
+
+	metadata.localFile, err = os.Create(filename)
+	if err != nil {
+		t.Fatalf("Could not open file: %v", err)
+	}
+	defer os.Remove(filename)
+	defer metadata.localFile.Close()
+
+	err = getMissingChunks(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("getMissingChunks failed: %v", err)
+	}
+	if metadata.firstMissing >= metadata.fileSize {
+		t.Fatalf("Transfer completed before the maximum was lowered")
+	}
+
+	// The server is reloaded with a lower maximum in the middle of the
+	// transfer
+	quit <- true
+	go startMockServer(quit, conn_server, URI, chunkSize, 2, fileID, data)
+	defer func() { quit <- true }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for metadata.firstMissing < metadata.fileSize {
+		err = getMissingChunks(ctx, conn_client, metadata, &conf)
+		if err != nil {
+			t.Fatalf("getMissingChunks failed: %v", err)
+		}
+	}
+	if metadata.maxChunksInACR != 2 {
+		t.Fatalf("Expected the lowered maximum of 2 chunks per ACR, got %d", metadata.maxChunksInACR)
+	}
+
+	err = checkFileContains(metadata.localFile, data)
+	if err != nil {
+		t.Fatalf("received data differs from sent data: %v", err)
+	}
+}
+
+// corruptingConn flips a bit in the first message it receives for which
+// corrupt returns true.
+type corruptingConn struct {
+	net.Conn
+	corrupt func(data []byte) bool
+	done    bool
+}
+
+func (c *corruptingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil && !c.done && c.corrupt(b[:n]) {
+		b[n-1] ^= 1
+		c.done = true
+	}
+	return n, err
+}
+
+func TestVerifyChunks(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "verify"
+	chunkSize := uint16(8)
+	maxChunksInACR := uint16(4)
+	fileID := uint32(0x7e51)
+	data := []byte("Alice was beginning to get very tired of sitting by her sister on the bank, and of having nothing to do: once or twice she had peeped into the book her sister was reading, but it had no pictures or conversations in it, “and what is the use of a book,” thought Alice “without pictures or conversations?”")
+	filename := "/tmp/sanftTestVerify.dat"
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go startMockServer(quit, conn_server, URI, chunkSize, maxChunksInACR, fileID, data)
+	defer func() { quit <- true }()
+
+	client, err := messages.CreateClientSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer client.Close()
+	// a page of the tree and chunk 3 are corrupted on the way
+	hsrr := &corruptingConn{Conn: client, corrupt: func(d []byte) bool {
+		return d[1] == messages.HSRR_t && d[3] == messages.NoError && binary.BigEndian.Uint32(d[8:12]) == 2
+	}}
+	conn_client := &corruptingConn{Conn: hsrr, corrupt: func(d []byte) bool {
+		return d[1] == messages.CRR_t && messages.Uint8_6_arr2Int(*(*[6]uint8)(d[4:10])) == 3
+	}}
+
+	conf := testConfig
+	conf.VerifyChunks = true
+
+	metadata := new(fileMetadata)
+	metadata.timeout = 3 * time.Second
+	metadata.url = URI
+	metadata.packetRate = 100
+
+	err = updateMetadata(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("updateMetadata failed: %v", err)
+	}
+	metadata.localFile, err = os.Create(filename)
+	if err != nil {
+		t.Fatalf("Could not open file: %v", err)
+	}
+	defer os.Remove(filename)
+	defer metadata.localFile.Close()
+
+	fetchAll := func() {
+		for metadata.firstMissing < metadata.fileSize {
+			err := ensureLeaves(context.Background(), conn_client, metadata, &conf)
+			if err != nil {
+				t.Fatalf("ensureLeaves failed: %v", err)
+			}
+			err = getMissingChunks(context.Background(), conn_client, metadata, &conf)
+			if err != nil {
+				t.Fatalf("getMissingChunks failed: %v", err)
+			}
+			if metadata.firstMissing == metadata.fileSize {
+				err = metadata.recheckChunks(metadata.localFile, &conf)
+				if err != nil {
+					t.Fatalf("recheckChunks failed: %v", err)
+				}
+			}
+		}
+	}
+	fetchAll()
+	if !hsrr.done || metadata.stats.invalid == 0 {
+		t.Fatalf("Expected the corrupt HSRR to be dropped")
+	}
+	if len(metadata.leaves) != int(metadata.fileSize) {
+		t.Fatalf("Expected %d leaves, got %d", metadata.fileSize, len(metadata.leaves))
+	}
+	if metadata.stats.corrupt != 1 || metadata.stats.requested != int(metadata.fileSize)+1 {
+		t.Fatalf("Expected only the corrupt chunk to be requested again, %d corrupt, %d requests for %d chunks", metadata.stats.corrupt, metadata.stats.requested, metadata.fileSize)
+	}
+	err = checkFileContains(metadata.localFile, data)
+	if err != nil {
+		t.Fatalf("received data differs from sent data: %v", err)
+	}
+
+	// a chunk corrupted on disk, e.g. of a resumed transfer, is requested
+	// again once the checksum does not match
+	metadata.localFile.WriteAt([]byte("x"), 5*int64(chunkSize))
+	metadata.hash, metadata.hashed = nil, 0
+	err = metadata.recheckChunks(metadata.localFile, &conf)
+	if err != nil {
+		t.Fatalf("recheckChunks failed: %v", err)
+	}
+	if metadata.firstMissing != 5 || metadata.stats.corrupt != 2 {
+		t.Fatalf("Expected chunk 5 to be missing, first missing %d, %d corrupt", metadata.firstMissing, metadata.stats.corrupt)
+	}
+	fetchAll()
+	checksum, err := metadata.finishChecksum(metadata.localFile)
+	if err != nil || checksum != metadata.checksum {
+		t.Fatalf("Checksum not matching after requesting the corrupt chunk: %v", err)
+	}
+	err = checkFileContains(metadata.localFile, data)
+	if err != nil {
+		t.Fatalf("received data differs from sent data: %v", err)
+	}
+}
+
+// A file size announced by the server is only trusted as far as the Merkle
+// tree confirms it.
+func TestFetchLeavesFileSize(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "leaves"
+	data := make([]byte, 100)
+	rand.Read(data)
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+	go startMockServer(quit, conn_server, URI, 8, 4, 0x1eaf, data)
+	defer func() { quit <- true }()
+
+	conn_client, err := messages.CreateClientSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer conn_client.Close()
+
+	conf := testConfig
+	conf.VerifyChunks = true
+	conf.MaxVerifiedChunks = 1000
+	metadata := new(fileMetadata)
+	metadata.timeout = 3 * time.Second
+	metadata.url = URI
+	metadata.packetRate = 100
+	err = updateMetadata(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("updateMetadata failed: %v", err)
+	}
+	fileSize := metadata.fileSize
+
+	// more chunks than allowed are not even requested
+	metadata.fileSize = 1 << 47
+	if _, err := fetchLeaves(context.Background(), conn_client, metadata, &conf); err == nil {
+		t.Fatalf("Fetched the leaves of a file larger than the limit")
+	}
+	// the tree of the server does not have that many leaves
+	metadata.fileSize = fileSize + 100
+	if _, err := fetchLeaves(context.Background(), conn_client, metadata, &conf); err == nil {
+		t.Fatalf("Accepted a tree that does not match the file size")
+	}
+	metadata.fileSize = fileSize
+	leaves, err := fetchLeaves(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("fetchLeaves failed: %v", err)
+	}
+	if uint64(len(leaves)) != fileSize || leaves[fileSize-1] != merkle.LeafHash(data[(fileSize-1)*8:]) {
+		t.Fatalf("Wrong leaves")
+	}
+}
+
+// hsrrErrorConn turns the next left HSRRs into errors with code, as sent by
+// a server that cannot send the tree (yet).
+type hsrrErrorConn struct {
+	net.Conn
+	code uint8
+	left int
+}
+
+func (c *hsrrErrorConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil && c.left > 0 && n > 4 && b[1] == messages.HSRR_t && b[3] == messages.NoError {
+		b[3] = c.code
+		n = 4
+		c.left--
+	}
+	return n, err
+}
+
+// Pages of a tree that the server is still building are requested until it
+// is ready, without giving up after RetransmissionsMDR tries.
+func TestFetchLeavesNotReady(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "leaves"
+	data := make([]byte, 100)
+	rand.Read(data)
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+	go startMockServer(quit, conn_server, URI, 8, 4, 0x1eaf, data)
+	defer func() { quit <- true }()
+
+	client, err := messages.CreateClientSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer client.Close()
+	conn_client := &hsrrErrorConn{Conn: client, code: messages.TreeNotReady, left: 10}
+	defer func(delay time.Duration) { hsrNotReadyDelay = delay }(hsrNotReadyDelay)
+	hsrNotReadyDelay = 10 * time.Millisecond
+
+	conf := testConfig
+	conf.VerifyChunks = true
+	metadata := new(fileMetadata)
+	metadata.timeout = 3 * time.Second
+	metadata.url = URI
+	metadata.packetRate = 100
+	err = updateMetadata(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("updateMetadata failed: %v", err)
+	}
+
+	leaves, err := fetchLeaves(context.Background(), conn_client, metadata, &conf)
+	if err != nil {
+		t.Fatalf("fetchLeaves failed: %v", err)
+	}
+	if conn_client.left != 0 || uint64(len(leaves)) != metadata.fileSize {
+		t.Fatalf("Wrong leaves, %d Not Ready errors left", conn_client.left)
+	}
+
+	// a tree the server refuses to build is not verified
+	conn_client.code, conn_client.left = messages.TreeTooLarge, 1
+	err = ensureLeaves(context.Background(), conn_client, metadata, &conf)
+	if err != nil || !metadata.unverified || metadata.leaves != nil {
+		t.Fatalf("Expected the file to be unverified: %v", err)
+	}
+}
+
+func TestAdaptACRSize(t *testing.T) {
+	conf := testConfig
+	conf.MinACRSize = 4
+	metadata := new(fileMetadata)
+	metadata.maxChunksInACR = 64
+	metadata.fileSize = 1000
+	now := time.Now()
+	metadata.setACRSize(64, now)
+
+	// ack sends an ACR of the current size, of which lost chunks are lost, and
+	// returns the new size.
+	ack := func(lost int) int {
+		acr, requested := buildACR(metadata)
+		if err := checkValidACR(acr, requested, metadata); err != nil {
+			t.Fatalf("Invalid ACR: %v", err)
+		}
+		if len(requested) != metadata.chunksPerACR() {
+			t.Fatalf("Expected %d chunks in ACR, got %d", metadata.chunksPerACR(), len(requested))
+		}
+		p := &pendingACR{ACRSample: ACRSample{Sent: now, Rate: 1000, Chunks: len(requested),
+			Received: make(map[int]time.Time)}}
+		for i := lost; i < len(requested); i++ {
+			p.Received[i] = now.Add(10*time.Millisecond + time.Duration(i)*time.Millisecond)
+		}
+		now = now.Add(time.Second)
+		adaptACRSize(metadata, p, &conf, now)
+		return metadata.chunksPerACR()
+	}
+
+	if size := ack(0); size != 64 {
+		t.Fatalf("ACR size above the maximum of the server: %d", size)
+	}
+	if size := ack(32); size != 32 {
+		t.Fatalf("Expected ACR size 32 after losing half of the chunks, got %d", size)
+	}
+	if size := ack(1); size != 32 {
+		t.Fatalf("Expected ACR size 32 after a small loss, got %d", size)
+	}
+	if size := ack(0); size != 36 {
+		t.Fatalf("Expected ACR size 36 without loss, got %d", size)
+	}
+	if size := ack(36); size != 4 {
+		t.Fatalf("Expected the minimum ACR size 4 after losing all chunks, got %d", size)
+	}
+	for i := 0; i < 100; i++ {
+		ack(0)
+	}
+	if size := metadata.chunksPerACR(); size != 64 {
+		t.Fatalf("Expected ACR size to grow back to 64, got %d", size)
+	}
+
+	r := metadata.result(now)
+	if r.ACRSize != 64 {
+		t.Fatalf("Expected ACRSize 64 in result, got %d", r.ACRSize)
+	}
+	if first, last := r.ACRSizes[0], r.ACRSizes[len(r.ACRSizes)-1]; first.Size != 64 || last.Size != 64 ||
+		!first.Time.Before(last.Time) || r.ACRSizes[1].Size != 32 {
+		t.Fatalf("Unexpected ACR size changes %v", r.ACRSizes)
+	}
+
+	conf.MaxACRSize = 16
+	if size := ack(0); size != 16 {
+		t.Fatalf("ACR size above MaxACRSize: %d", size)
+	}
+}
+
+func TestMuxRoutesByNumber(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	conn_client, err := messages.CreateClientSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	m := newMux(conn_client, 0)
+	defer m.Close()
+	ep1 := m.Open()
+	defer ep1.Close()
+	ep2 := m.Open()
+	defer ep2.Close()
+
+	// Both endpoints use the same Number
+	for _, ep := range []*endpoint{ep1, ep2} {
+		mdr := messages.GetMDR(7, messages.EmptyToken(), "foo")
+		err = mdr.Send(ep)
+		if err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	var numbers []uint8
+	var addr net.Addr
+	for i := 0; i < 2; i++ {
+		var data []byte
+		addr, data, err = messages.ServerReceive(conn_server, 1000)
+		if err != nil {
+			t.Fatalf("ServerReceive failed: %v", err)
+		}
+		numbers = append(numbers, data[2])
+	}
+	if numbers[0] == numbers[1] {
+		t.Fatalf("Both requests use Number %d on the socket", numbers[0])
+	}
+	// Answer in reverse order with different errors to tell them apart
+	for i := 1; i >= 0; i-- {
+		header := messages.ServerHeader{Version: messages.VERS, Type: messages.MDRR_t, Number: numbers[i], Error: uint8(i + 1)}
+		err = header.Send(conn_server, addr)
+		if err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	buf := make([]byte, 100)
+	for i, ep := range []*endpoint{ep1, ep2} {
+		ep.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := ep.Read(buf)
+		if err != nil {
+			t.Fatalf("Read on endpoint %d failed: %v", i+1, err)
+		}
+		if buf[2] != 7 {
+			t.Fatalf("Number was not restored: expected 7 got %d", buf[2])
+		}
+		if n != 4 || buf[3] != uint8(i+1) {
+			t.Fatalf("Endpoint %d received the wrong response %x", i+1, buf[:n])
+		}
+	}
+	// Nothing else should arrive
+	ep1.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = ep1.Read(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+}
+
+func TestFetchParallel(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "parallel"
+	chunkSize := uint16(32)
+	maxChunksInACR := uint16(8)
+	fileID := uint32(0x9a4a11e1)
+	data := make([]byte, 2000)
+	quit := make(chan bool)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatalf("Could not read random data: %v", err)
+	}
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go startMockServer(quit, conn_server, URI, chunkSize, maxChunksInACR, fileID, data)
+	defer func() { quit <- true }()
+
+	c, err := New(IP, port, &testConfig)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			filename := fmt.Sprintf("/tmp/sanftTestParallel%d.dat", i)
+			defer os.Remove(filename)
+			_, errs[i] = c.Fetch(context.Background(), URI, filename)
+			if errs[i] != nil {
+				return
+			}
+			fileData, err := os.ReadFile(filename)
+			if err != nil {
+				errs[i] = err
+			} else if !bytes.Equal(fileData, data) {
+				errs[i] = errors.New("received data differs from sent data")
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Transfer %d failed: %v", i, err)
+		}
+	}
+	if c.getToken() == *messages.EmptyToken() {
+		t.Fatalf("The token was not shared with the client")
+	}
+}
+
+func TestList(t *testing.T) {
+	IP := net.ParseIP("127.0.0.202")
+	port := 6666
+	token := [32]uint8{1, 2, 3}
+	pages := [][]messages.ListEntry{
+		{{Size: 5, ModTime: 1000, Name: "a.txt"}},
+		{{Flags: messages.EntryDir, ModTime: 2000, Name: "sub"}},
+	}
+	var changes atomic.Int32
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go func() {
+		buf := make([]byte, 0x10000)
+		for {
+			n, addr, err := conn_server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			data := buf[:n]
+			msg, err := messages.ParseClient(&data)
+			if err != nil {
+				continue
+			}
+			lsr, ok := msg.(messages.LSR)
+			if !ok {
+				continue
+			}
+			switch {
+			case lsr.Header.Token != token:
+				ntm := messages.GetNTM(lsr.Header.Number, messages.NoError, &token)
+				ntm.Send(conn_server, addr)
+			case lsr.URI != "dir":
+				h := messages.ServerHeader{Version: messages.VERS, Type: messages.LSRR_t, Number: lsr.Header.Number, Error: messages.FileNotFound}
+				h.Send(conn_server, addr)
+			default:
+				// the listing changes after its first page as long as changes are left
+				listing := uint32(7)
+				if lsr.Page > 0 && changes.Load() > 0 {
+					changes.Add(-1)
+					listing++
+				}
+				lsrr := messages.GetLSRR(lsr.Header.Number, messages.NoError, lsr.Page, uint32(len(pages)), listing, pages[lsr.Page])
+				lsrr.Send(conn_server, addr)
+			}
+		}
+	}()
+
+	c, err := New(IP, port, &testConfig)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	entries, err := c.List(context.Background(), "dir")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	want := []Entry{
+		{Name: "a.txt", URI: "dir/a.txt", Size: 5, ModTime: time.Unix(1000, 0)},
+		{Name: "sub", URI: "dir/sub", Dir: true, ModTime: time.Unix(2000, 0)},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("Wrong entries. Expected %v got %v", want, entries)
+	}
+
+	_, err = c.List(context.Background(), "missing")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound, got %v", err)
+	}
+
+	// a listing that changed between pages is read again
+	changes.Store(1)
+	entries, err = c.List(context.Background(), "dir")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if !reflect.DeepEqual(entries, want) || changes.Load() != 0 {
+		t.Fatalf("Wrong entries. Expected %v got %v", want, entries)
+	}
+
+	// but not forever
+	changes.Store(1000)
+	_, err = c.List(context.Background(), "dir")
+	if !errors.Is(err, ErrListingChanged) {
+		t.Fatalf("Expected ErrListingChanged, got %v", err)
+	}
+}
+
+func TestJoinURI(t *testing.T) {
+	for _, c := range [][3]string{
+		{"", "a.txt", "a.txt"},
+		{"/", "a b", "a%20b"},
+		{"dir/", "50%#1?", "dir/50%25%231%3F"},
+		{"dir", "sanft:x", "dir/sanft%3Ax"},
+	} {
+		if got := joinURI(c[0], c[1]); got != c[2] {
+			t.Fatalf("joinURI(%q, %q) = %q, expected %q", c[0], c[1], got, c[2])
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/keep/sub", 0755)
+	os.MkdirAll(dir+"/gone/sub", 0755)
+	for _, name := range []string{"a", "a.sanft", "b", "b.sanft", "keep/c", "keep/sub/d", "gone/sub/e", "now-a-dir"} {
+		os.WriteFile(dir+"/"+name, nil, 0644)
+	}
+	entries := []Entry{
+		{Name: "a"}, {Name: "keep", Dir: true}, {Name: "keep/c"}, {Name: "keep/sub", Dir: true}, {Name: "now-a-dir", Dir: true},
+	}
+
+	removed, err := Prune(dir, entries)
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if len(removed) != 5 {
+		t.Fatalf("Expected 5 removed paths, got %v", removed)
+	}
+	for _, name := range []string{"a", "a.sanft", "keep/c", "keep/sub"} {
+		if _, err := os.Stat(dir + "/" + name); err != nil {
+			t.Fatalf("%s was removed", name)
+		}
+	}
+	for _, name := range []string{"b", "b.sanft", "keep/sub/d", "gone", "now-a-dir"} {
+		if _, err := os.Stat(dir + "/" + name); err == nil {
+			t.Fatalf("%s was not removed", name)
+		}
+	}
+
+	removed, err = Prune(dir+"/missing", entries)
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("Prune of a missing directory returned %v, %v", removed, err)
+	}
+}
+
+func TestLocalDir(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	os.Mkdir(dir+"/a b", 0755)
+	if err := os.Symlink(outside, dir+"/out"); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	for uri, want := range map[string]string{
+		"":             dir,
+		"/":            dir,
+		"a%20b":        dir + "/a b",
+		"a%20b/../new": dir + "/new",
+		"./x//y/":      dir + "/x/y",
+		"sanft:///x":   dir + "/x",
+	} {
+		got, err := LocalDir(dir, uri)
+		if err != nil || got != want {
+			t.Fatalf("LocalDir(%q) = %q, %v, expected %q", uri, got, err, want)
+		}
+	}
+	for _, uri := range []string{"..", "../x", "a/../../x", "%2e%2e/x", "..%2Fx", "out", "out/new", "sanft://host/x", "a%zz"} {
+		if got, err := LocalDir(dir, uri); err == nil {
+			t.Fatalf("LocalDir(%q) = %q, expected an error", uri, got)
+		}
+	}
+}
+
+func TestFetchSkipUnchanged(t *testing.T) {
+	IP := net.ParseIP("127.0.0.200")
+	port := 6666
+	URI := "skip"
+	chunkSize := uint16(16)
+	maxChunksInACR := uint16(8)
+	fileID := uint32(0x5c1b)
+	data := []byte("this file is already there")
+	filename := t.TempDir() + "/skip.dat"
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+
+	go startMockServer(quit, conn_server, URI, chunkSize, maxChunksInACR, fileID, data)
+	defer func() { quit <- true }()
+
+	conf := testConfig
+	conf.SkipUnchanged = true
+	c, err := New(IP, port, &conf)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	os.WriteFile(filename, data, 0644)
+	result, err := c.Fetch(context.Background(), URI, filename)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if !result.Skipped || result.Requested != 0 {
+		t.Fatalf("Up to date file was fetched: %+v", result)
+	}
+
+	// a file with other content is fetched
+	os.WriteFile(filename, []byte("this file is not there yet"), 0644)
+	result, err = c.Fetch(context.Background(), URI, filename)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if result.Skipped {
+		t.Fatalf("Changed file was skipped")
+	}
+	if got, _ := os.ReadFile(filename); !bytes.Equal(got, data) {
+		t.Fatalf("Wrong file content %q", got)
+	}
+
+	// both transfers are in the metrics of the client
+	m := c.metrics
+	if m.transfers.With("skipped").Value() != 1 || m.transfers.With("ok").Value() != 1 || m.active.Value() != 0 {
+		t.Fatalf("Wrong transfer metrics")
+	}
+	if m.received.Value() != 2 || m.bytes.Value() != float64(len(data)) || m.duration.Count() != 2 {
+		t.Fatalf("Wrong chunk metrics: %v chunks, %v bytes", m.received.Value(), m.bytes.Value())
+	}
+}
+
+func TestFetchIPv6(t *testing.T) {
+	port := 6666
+	URI := "fetch"
+	data := make([]byte, 100)
+	rand.Read(data)
+	filename := t.TempDir() + "/ipv6.dat"
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(net.IPv6loopback, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+	go startMockServer(quit, conn_server, URI, 16, 8, 0x6, data)
+	defer func() { quit <- true }()
+
+	conf := testConfig
+	c, err := NewHost("::1", port, &conf)
+	if err != nil {
+		t.Fatalf("NewHost failed: %v", err)
+	}
+	defer c.Close()
+	result, err := c.Fetch(context.Background(), URI, filename)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if result.Bytes != uint64(len(data)) {
+		t.Fatalf("Invalid number of bytes. Expected %d got %d", len(data), result.Bytes)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	IP := net.ParseIP("127.0.0.203")
+	port := 6666
+	URI := "fetch"
+	data := make([]byte, 100)
+	rand.Read(data)
+	filename := t.TempDir() + "/eyeballs.dat"
+	quit := make(chan bool)
+
+	conn_server, err := messages.CreateServerSocket(IP, port)
+	if err != nil {
+		t.Fatalf(`Creating server failed: %v`, err)
+	}
+	defer conn_server.Close()
+	go startMockServer(quit, conn_server, URI, 16, 8, 0x6, data)
+	defer func() { quit <- true }()
+	// the IPv6 address, tried first, never answers
+	blackhole, err := messages.CreateServerSocket(net.IPv6loopback, port)
+	if err != nil {
+		t.Fatalf(`Creating socket failed: %v`, err)
+	}
+	defer blackhole.Close()
+
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host != "sanft.test" {
+			return nil, fmt.Errorf("unknown host %v", host)
+		}
+		return []net.IPAddr{{IP: IP}, {IP: net.IPv6loopback}}, nil
+	}
+	defer func() { lookupIPAddr = net.DefaultResolver.LookupIPAddr }()
+
+	conf := testConfig
+	c, err := NewHost("sanft.test", port, &conf)
+	if err != nil {
+		t.Fatalf("NewHost failed: %v", err)
+	}
+	defer c.Close()
+	// the requests of the transfers do not reuse the Number of the probe
+	ep, err := c.open(context.Background())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	ep.Close()
+	c.mu.Lock()
+	next := c.mux.next
+	c.mu.Unlock()
+	if next != 1 {
+		t.Fatalf("Expected the mux to start with Number 1 after one probe, got %d", next)
+	}
+	result, err := c.Fetch(context.Background(), URI, filename)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if result.Bytes != uint64(len(data)) {
+		t.Fatalf("Invalid number of bytes. Expected %d got %d", len(data), result.Bytes)
+	}
+	c.mu.Lock()
+	remote := c.mux.conn.RemoteAddr().(*net.UDPAddr)
+	c.mu.Unlock()
+	if !remote.IP.Equal(IP) {
+		t.Fatalf("Connected to %v, expected %v", remote, IP)
+	}
+	// the token of the probe was used
+	if result.Retransmissions != 0 {
+		t.Fatalf("Expected no retransmissions, got %d", result.Retransmissions)
+	}
+
+	// a host without any answering address
+	c2, err := NewHost("sanft.test", port+1, &conf)
+	if err != nil {
+		t.Fatalf("NewHost failed: %v", err)
+	}
+	defer c2.Close()
+	for _, ip := range []net.IP{IP, net.IPv6loopback} {
+		blackhole, err := messages.CreateServerSocket(ip, port+1)
+		if err != nil {
+			t.Fatalf(`Creating socket failed: %v`, err)
+		}
+		defer blackhole.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fetched := make(chan error)
+	go func() {
+		_, err := c2.Fetch(ctx, URI, filename+".2")
+		fetched <- err
+	}()
+	// the client is not locked while the addresses are probed
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	c2.getToken()
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("getToken blocked for %v while dialing", elapsed)
+	}
+	if err := <-fetched; err == nil {
+		t.Fatalf("Fetch from a host without server succeeded")
+	}
+}
+
+func TestSortAddrs(t *testing.T) {
+	var addrs []net.IPAddr
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1", "fd00::2"} {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	got := fmt.Sprint(sortAddrs(addrs))
+	expected := "[fd00::1 10.0.0.1 fd00::2 10.0.0.2 10.0.0.3]"
+	if got != expected {
+		t.Fatalf("sortAddrs = %v, expected %v", got, expected)
+	}
+}
+
+// simLink simulates the path of the CRRs: a bottleneck link with a capacity
+// in packets per second and a FIFO queue dropping packets when full, a
+// propagation delay, and losses following a Markov chain like markov.MarkovConn.
+type simLink struct {
+	capacity  float64
+	queueSize int
+	rtt       time.Duration
+	p, q      float64
+	rng       *mathrand.Rand
+
+	busyUntil   time.Time // when the bottleneck has sent its queue
+	lastDropped bool
+}
+
+// send returns when a CRR the server sends at t arrives at the client, or
+// false if it is lost.
+func (l *simLink) send(t time.Time) (time.Time, bool) {
+	if l.lastDropped {
+		l.lastDropped = l.rng.Float64() < l.q
+	} else {
+		l.lastDropped = l.rng.Float64() < l.p
+	}
+	transmission := time.Duration(float64(time.Second) / l.capacity)
+	start := t
+	if l.busyUntil.After(start) {
+		if l.busyUntil.Sub(start) > time.Duration(l.queueSize)*transmission {
+			return time.Time{}, false
+		}
+		start = l.busyUntil
+	}
+	l.busyUntil = start.Add(transmission)
+	if l.lastDropped {
+		return time.Time{}, false
+	}
+	return l.busyUntil.Add(l.rtt / 2), true
+}
+
+// simulateTransfer fetches chunks over link with one ACR of chunksPerACR
+// chunks at a time, the server sending rateIncrease packets per second faster
+// than requested, and returns the goodput in chunks per second.
+func simulateTransfer(cc CongestionController, link *simLink, chunks int, chunksPerACR int, rateIncrease uint32) float64 {
+	start := time.Unix(0, 0)
+	now := start
+	link.busyUntil = start
+	for delivered := 0; delivered < chunks; {
+		acr := &ACRSample{
+			Sent:     now,
+			Rate:     cc.NextRate(),
+			Chunks:   min(chunksPerACR, chunks-delivered),
+			Received: make(map[int]time.Time),
+		}
+		cc.OnACRSent(acr)
+		sendRate := float64(acr.Rate + rateIncrease)
+		arrived := now.Add(link.rtt / 2)
+		end := arrived.Add(time.Duration(float64(acr.Chunks) * float64(time.Second) / sendRate))
+		for i := 0; i < acr.Chunks; i++ {
+			sent := arrived.Add(time.Duration(float64(i) * float64(time.Second) / sendRate))
+			if when, ok := link.send(sent); ok {
+				acr.Received[i] = when
+				end = when
+				cc.OnCRR(acr, i)
+			}
+		}
+		delivered += len(acr.Received)
+		switch {
+		case acr.Complete():
+			now = end
+		case len(acr.Received) == 0:
+			now = end.Add(2 * link.rtt)
+			cc.OnTimeout(acr)
+		default:
+			// the client waits for NCRRsToWait more CRRs
+			now = end.Add(time.Duration(float64(3*time.Second) / float64(acr.Rate)))
+			cc.OnLoss(acr)
+		}
+	}
+	return float64(chunks) / now.Sub(start).Seconds()
+}
+
+func TestCongestionControllers(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		p, q float64
+	}{
+		{"no loss", 0, 0},
+		// measuring the delivery rate settles well below the capacity
+		{"random loss", 0.2, 0.2},
+		{"burst loss", 0.04, 0.75},
+	} {
+		goodput := make(map[string]float64)
+		for _, name := range CongestionControls {
+			cc, err := NewCongestionController(name, 40, 1)
+			if err != nil {
+				t.Fatalf("Error creating %v: %v", name, err)
+			}
+			link := &simLink{
+				capacity:  2000,
+				queueSize: 100,
+				rtt:       20 * time.Millisecond,
+				p:         test.p,
+				q:         test.q,
+				rng:       mathrand.New(mathrand.NewSource(1)),
+			}
+			goodput[name] = simulateTransfer(cc, link, 50000, 256, 256)
+			t.Logf("%v, %v: %.0f chunks/s", test.name, name, goodput[name])
+			// the link is idle for an RTT between ACRs
+			if limit := 0.3 * link.capacity; goodput[name] < limit {
+				t.Errorf("%v, %v: goodput %.0f chunks/s below %.0f", test.name, name, goodput[name], limit)
+			}
+		}
+		if test.p > 0 && goodput["bbr"] < goodput["measure"] {
+			t.Errorf("%v: goodput of bbr %.0f chunks/s below that of measure %.0f", test.name, goodput["bbr"], goodput["measure"])
+		}
+	}
+
+	if _, err := NewCongestionController("cubic", 40, 1); err == nil {
+		t.Fatalf("Unknown congestion control accepted")
+	}
+}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// CongestionController decides the packet rate requested in the ACRs of a
+// transfer and how many ACRs may be outstanding at the same time. A
+// controller is used by a single transfer and only called from the goroutine
+// running it.
+type CongestionController interface {
+	// OnACRSent is called after acr has been sent.
+	OnACRSent(acr *ACRSample)
+	// OnCRR is called when the chunk at position index in acr arrived, after
+	// it was added to acr.Received. acr is complete if all of its chunks
+	// arrived.
+	OnCRR(acr *ACRSample, index int)
+	// OnLoss is called when the CRRs of acr are no longer waited for and
+	// some, but not all, of them arrived.
+	OnLoss(acr *ACRSample)
+	// OnTimeout is called when none of the CRRs of acr arrived in time.
+	OnTimeout(acr *ACRSample)
+	// NextRate returns the packet rate to request in the next ACR, at least
+	// 1.
+	NextRate() uint32
+	// NextWindow returns the number of ACRs that may be outstanding at the
+	// same time, at least 1.
+	NextWindow() int
+}
+
+// ACRSample is an ACR as seen by a CongestionController.
+type ACRSample struct {
+	Sent     time.Time         // When the ACR was sent
+	Rate     uint32            // Packet rate requested in the ACR
+	Chunks   int               // Number of chunks requested
+	Received map[int]time.Time // Arrival times of the CRRs by position in the ACR
+}
+
+// Complete reports whether all chunks of the ACR arrived.
+func (s *ACRSample) Complete() bool {
+	return len(s.Received) == s.Chunks
+}
+
+// deliveryRate returns the rate the chunks of the ACR arrived at, or false if
+// it cannot be measured.
+func (s *ACRSample) deliveryRate() (uint32, bool) {
+	if s.Chunks <= 1 || len(s.Received) == 0 {
+		return 0, false
+	}
+	rate, err := computePacketRate(s.Received, s.Chunks, s.Rate)
+	return rate, err == nil
+}
+
+// rtt returns the shortest round trip time of the chunks that arrived,
+// without the time the server waited to send them.
+func (s *ACRSample) rtt() (time.Duration, bool) {
+	var rtt time.Duration
+	ok := false
+	for i, when := range s.Received {
+		d := when.Sub(s.Sent) - time.Duration(uint64(i)*uint64(time.Second)/uint64(s.Rate))
+		if !ok || d < rtt {
+			rtt, ok = d, true
+		}
+	}
+	return rtt, ok && rtt > 0
+}
+
+// CongestionControls are the names of the congestion controllers of
+// NewCongestionController. The first one is the default.
+var CongestionControls = []string{"measure", "bbr"}
+
+// NewCongestionController returns the congestion controller called name,
+// one of CongestionControls, starting at initialRate with at most maxWindow
+// outstanding ACRs.
+func NewCongestionController(name string, initialRate uint32, maxWindow int) (CongestionController, error) {
+	switch name {
+	case "", "measure":
+		return NewMeasuringController(initialRate, maxWindow), nil
+	case "bbr":
+		return NewBBRController(initialRate, maxWindow), nil
+	}
+	return nil, fmt.Errorf("unknown congestion control %q", name)
+}
+
+// measuringController requests the rate the chunks of the last ACR arrived
+// at, as recommended by the specification. Together with the rate increase
+// the server adds to the requested rate, this increases the rate additively
+// while there is no loss and decreases it in proportion to the loss.
+type measuringController struct {
+	rate   uint32
+	window int
+}
+
+// NewMeasuringController returns the default congestion controller, which
+// requests the rate measured over the last ACR, with a fixed window.
+func NewMeasuringController(initialRate uint32, window int) CongestionController {
+	return &measuringController{rate: initialRate, window: window}
+}
+
+func (c *measuringController) OnACRSent(acr *ACRSample) {}
+
+func (c *measuringController) OnCRR(acr *ACRSample, index int) {
+	if acr.Complete() {
+		c.measure(acr)
+	}
+}
+
+func (c *measuringController) OnLoss(acr *ACRSample) {
+	c.measure(acr)
+}
+
+// OnTimeout keeps the rate; the client backs off its timeout.
+func (c *measuringController) OnTimeout(acr *ACRSample) {}
+
+func (c *measuringController) measure(acr *ACRSample) {
+	if rate, ok := acr.deliveryRate(); ok {
+		c.rate = rate
+	}
+}
+
+func (c *measuringController) NextRate() uint32 {
+	return c.rate
+}
+
+func (c *measuringController) NextWindow() int {
+	return c.window
+}
+
+const (
+	// bbrBandwidthSamples is the number of ACRs the bottleneck bandwidth is
+	// the maximum delivery rate of.
+	bbrBandwidthSamples = 10
+	// bbrMinRTTWindow is the time the minimum RTT is kept for.
+	bbrMinRTTWindow = 10 * time.Second
+	// bbrStartupGain is the gain while starting up, 2/ln 2 like in BBR, which
+	// at least doubles the delivery rate every ACR.
+	bbrStartupGain = 2.89
+	// bbrStartupGrowth is the bandwidth growth below which the bottleneck
+	// is considered reached after bbrStartupRounds ACRs.
+	bbrStartupGrowth = 1.25
+	bbrStartupRounds = 3
+	// bbrWindowGain is the number of bandwidth-delay products that may be
+	// outstanding.
+	bbrWindowGain = 2
+)
+
+// bbrGainCycle are the gains applied to the bandwidth estimate in turn once
+// the bottleneck is reached: probe for more bandwidth, drain the queue built
+// up by probing, then cruise.
+var bbrGainCycle = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// bbrController estimates the bottleneck bandwidth as the maximum recent
+// delivery rate and the propagation delay as the minimum recent RTT, like
+// TCP BBR, and requests the bandwidth times a gain that periodically probes
+// for more. Unlike measuringController it does not slow down on random
+// loss, which does not lower the maximum delivery rate.
+type bbrController struct {
+	rate      uint32 // before the first measurement
+	maxWindow int
+
+	samples  [bbrBandwidthSamples]float64 // delivery rates, a ring
+	next     int
+	bw       float64 // max of samples
+	minRTT   time.Duration
+	rttStamp time.Time // when minRTT was measured
+
+	startup    bool
+	fullBw     float64 // bandwidth at the last growth
+	fullRounds int     // rounds without growth
+	cycle      int     // index into bbrGainCycle
+	chunks     int     // chunks of the last ACR
+}
+
+// NewBBRController returns a congestion controller modeled on TCP BBR,
+// starting at initialRate with at most maxWindow outstanding ACRs.
+func NewBBRController(initialRate uint32, maxWindow int) CongestionController {
+	return &bbrController{rate: initialRate, maxWindow: maxWindow, startup: true}
+}
+
+func (c *bbrController) OnACRSent(acr *ACRSample) {
+	c.chunks = acr.Chunks
+}
+
+func (c *bbrController) OnCRR(acr *ACRSample, index int) {
+	if len(acr.Received) == 1 {
+		now := acr.Received[index]
+		if rtt, ok := acr.rtt(); ok && (c.minRTT == 0 || rtt <= c.minRTT ||
+			now.Sub(c.rttStamp) > bbrMinRTTWindow) {
+			c.minRTT, c.rttStamp = rtt, now
+		}
+	}
+	if acr.Complete() {
+		c.sample(acr)
+	}
+}
+
+func (c *bbrController) OnLoss(acr *ACRSample) {
+	c.sample(acr)
+}
+
+// OnTimeout halves the bandwidth estimate, as the path may have changed.
+func (c *bbrController) OnTimeout(acr *ACRSample) {
+	for i := range c.samples {
+		c.samples[i] /= 2
+	}
+	c.bw /= 2
+}
+
+// sample adds the delivery rate of acr and advances the state machine.
+func (c *bbrController) sample(acr *ACRSample) {
+	rate, ok := acr.deliveryRate()
+	if !ok {
+		return
+	}
+	c.samples[c.next] = float64(rate)
+	c.next = (c.next + 1) % len(c.samples)
+	c.bw = 0
+	for _, s := range c.samples {
+		c.bw = math.Max(c.bw, s)
+	}
+
+	if c.startup {
+		if c.bw >= c.fullBw*bbrStartupGrowth {
+			c.fullBw, c.fullRounds = c.bw, 0
+		} else if c.fullRounds++; c.fullRounds >= bbrStartupRounds {
+			c.startup = false
+			// start by draining the queue built up during startup
+			c.cycle = 1
+		}
+		return
+	}
+	c.cycle = (c.cycle + 1) % len(bbrGainCycle)
+}
+
+func (c *bbrController) NextRate() uint32 {
+	if c.bw == 0 {
+		return c.rate
+	}
+	gain := bbrGainCycle[c.cycle]
+	if c.startup {
+		gain = bbrStartupGain
+	}
+	rate := c.bw * gain
+	if rate < 1 {
+		return 1
+	}
+	if rate > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(rate)
+}
+
+// NextWindow allows bbrWindowGain bandwidth-delay products to be
+// outstanding.
+func (c *bbrController) NextWindow() int {
+	if c.bw == 0 || c.minRTT == 0 || c.chunks == 0 {
+		return 1
+	}
+	bdp := c.bw * c.minRTT.Seconds() * bbrWindowGain
+	window := int(math.Ceil(bdp / float64(c.chunks)))
+	if window < 1 {
+		return 1
+	}
+	if window > c.maxWindow {
+		return c.maxWindow
+	}
+	return window
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/markov"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
+)
+
+// connectionAttemptDelay is the time to wait for an answer from an address
+// of the server before also trying the next one (RFC 8305).
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// lookupIPAddr resolves hostnames; replaced in tests.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// NewHost returns a Client for the server at host:port, host being a
+// hostname or an IPv4 or IPv6 address. A hostname is resolved when the
+// socket is created; if it has several addresses, the first one the server
+// answers on is used.
+func NewHost(host string, port int, conf *ClientConfig) (*Client, error) {
+	c, err := New(net.ParseIP(host), port, conf)
+	if err != nil {
+		return nil, err
+	}
+	c.Host = host
+	return c, nil
+}
+
+// dial returns a socket connected to c.Host. Like "happy eyeballs" for TCP
+// (RFC 8305), connection attempts to its addresses are started
+// connectionAttemptDelay apart, alternating between IPv6 and IPv4, and the
+// first one whose probe is answered wins. The probe is an MDR for "/", the
+// root directory, sent with token; the server answers it with an NTM if the
+// token is not valid, whose token is kept for the first request. The result
+// also tells how many probes were sent on the socket, so that the requests of
+// the transfers do not reuse their Numbers. c.mu must not be held, as the
+// probes may take several timeouts.
+func (c *Client) dial(ctx context.Context, token [32]uint8) (*probeResult, error) {
+	addrs, err := lookupIPAddr(ctx, c.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error while resolving %v: %w", c.Host, err)
+	}
+	ips := sortAddrs(addrs)
+	if len(ips) == 1 {
+		conn, err := markov.CreateClientSocket(ips[0], c.Port, c.Config.MarkovP, c.Config.MarkovQ)
+		if err != nil {
+			return nil, err
+		}
+		return &probeResult{conn: conn}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.Config.RetransmissionsMDR)*initialTimeout)
+	defer cancel()
+	answers := make(chan probeResult, len(ips))
+	var conns []net.Conn
+	closeAll := func(except net.Conn) {
+		for _, conn := range conns {
+			if conn != except {
+				conn.Close()
+			}
+		}
+	}
+	next := time.NewTimer(0)
+	defer next.Stop()
+	started, failed := 0, 0
+	var lastErr error
+	for failed < len(ips) {
+		select {
+		case <-next.C:
+			conn, err := markov.CreateClientSocket(ips[started], c.Port, c.Config.MarkovP, c.Config.MarkovQ)
+			started++
+			if err != nil {
+				failed++
+				lastErr = err
+				if started < len(ips) {
+					next.Reset(0)
+				}
+				continue
+			}
+			conns = append(conns, conn)
+			go probe(ctx, conn, token, answers)
+			if started < len(ips) {
+				next.Reset(connectionAttemptDelay)
+			}
+		case a := <-answers:
+			if a.err != nil {
+				// e.g. unreachable, try the next address right away
+				failed++
+				lastErr = a.err
+				if started < len(ips) && next.Stop() {
+					next.Reset(0)
+				}
+				continue
+			}
+			closeAll(a.conn)
+			c.Config.Logger.Debug("Using server address", "host", c.Host, "addr", a.conn.RemoteAddr().String())
+			return &a, nil
+		case <-ctx.Done():
+			closeAll(nil)
+			return nil, fmt.Errorf("no address of %v answered: %w", c.Host, ctx.Err())
+		}
+	}
+	closeAll(nil)
+	return nil, fmt.Errorf("no address of %v answered: %w", c.Host, lastErr)
+}
+
+type probeResult struct {
+	conn  net.Conn
+	token *[32]uint8 // of an NTM
+	sent  uint8      // Number of probes sent, the Number of the next request
+	err   error
+}
+
+// probe sends MDRs on conn until any response is received, ctx is done or
+// conn is closed. Closing conn is how dial stops it: a read deadline set by
+// watchContext could outlive the probe and break the winning socket.
+func probe(ctx context.Context, conn net.Conn, token [32]uint8, answers chan<- probeResult) {
+	buf := make([]byte, 0x10000) // 64kB
+	var number uint8
+	for ctx.Err() == nil {
+		mdr := messages.GetMDR(number, &token, "/")
+		number++
+		if err := mdr.Send(conn); err != nil {
+			answers <- probeResult{conn: conn, err: err}
+			return
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(initialTimeout)); err != nil {
+			answers <- probeResult{conn: conn, err: err}
+			return
+		}
+	receive:
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break receive
+				}
+				answers <- probeResult{conn: conn, err: err}
+				return
+			}
+			raw := buf[:n]
+			response, err := messages.ParseServer(&raw)
+			if err != nil {
+				continue
+			}
+			// clear the deadline for the transfers
+			conn.SetReadDeadline(time.Time{})
+			result := probeResult{conn: conn, sent: number}
+			if ntm, ok := response.(messages.NTM); ok {
+				result.token = &ntm.Token
+			}
+			answers <- result
+			return
+		}
+	}
+	answers <- probeResult{conn: conn, err: ctx.Err()}
+}
+
+// sortAddrs orders the addresses of a host for connection attempts: IPv6 and
+// IPv4 addresses alternate, starting with IPv6 (RFC 8305, section 4).
+func sortAddrs(addrs []net.IPAddr) []net.IP {
+	var v6, v4 []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr.IP)
+		} else {
+			v6 = append(v6, addr.IP)
+		}
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			ips = append(ips, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			ips = append(ips, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return ips
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A transfer journal is stored next to a partial download and records which
+// chunks of which version of the file have already been written, so that an
+// interrupted transfer can be resumed (see spec 7.5).
+const (
+	journalSuffix   = ".sanft"
+	journalVersion  = 1
+	journalInterval = time.Second // Minimum time between two journal updates
+)
+
+var journalMagic = [5]byte{'S', 'A', 'N', 'F', 'T'}
+
+// journalHeader is the fixed size part of the journal. It is followed by a
+// bitmap of ceil(FileSize/8) bytes in which bit i%8 of byte i/8 is set iff
+// chunk i has been written to the local file.
+type journalHeader struct {
+	Magic     [5]byte
+	Version   uint8
+	ChunkSize uint16
+	FileID    uint32
+	FileSize  uint64
+	Checksum  [32]byte
+}
+
+func journalName(localFilename string) string {
+	return localFilename + journalSuffix
+}
+
+// saveJournal atomically writes the journal of the transfer described by
+// metadata.
+func saveJournal(localFilename string, metadata *fileMetadata) error {
+	buf := new(bytes.Buffer)
+	header := journalHeader{
+		Magic:     journalMagic,
+		Version:   journalVersion,
+		ChunkSize: metadata.chunkSize,
+		FileID:    metadata.fileID,
+		FileSize:  metadata.fileSize,
+		Checksum:  metadata.checksum,
+	}
+	err := binary.Write(buf, binary.BigEndian, header)
+	if err != nil {
+		return fmt.Errorf("encode journal header: %w", err)
+	}
+	bitmap := make([]byte, (metadata.fileSize+7)/8)
+	for chunk, received := range metadata.chunkMap {
+		if received && chunk < metadata.fileSize {
+			bitmap[chunk/8] |= 1 << (chunk % 8)
+		}
+	}
+	buf.Write(bitmap)
+
+	name := journalName(localFilename)
+	tmp := name + ".tmp"
+	err = os.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write journal: %w", err)
+	}
+	return nil
+}
+
+// loadJournal reads the journal of a previous transfer to localFilename and
+// restores the metadata and chunkMap it records.
+func loadJournal(localFilename string, metadata *fileMetadata) error {
+	f, err := os.Open(journalName(localFilename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+
+	var header journalHeader
+	err = binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return fmt.Errorf("read journal header: %w", err)
+	}
+	if header.Magic != journalMagic {
+		return errors.New("not a journal file")
+	}
+	if header.Version != journalVersion {
+		return fmt.Errorf("unsupported journal version %d", header.Version)
+	}
+	// Only trust FileSize if the journal is large enough to hold its bitmap
+	bitmapSize := uint64(info.Size()) - uint64(binary.Size(header))
+	if header.FileSize > 8*bitmapSize {
+		return fmt.Errorf("journal too short for %d chunks", header.FileSize)
+	}
+	bitmap := make([]byte, (header.FileSize+7)/8)
+	_, err = io.ReadFull(r, bitmap)
+	if err != nil {
+		return fmt.Errorf("read journal bitmap: %w", err)
+	}
+
+	metadata.chunkSize = header.ChunkSize
+	metadata.fileID = header.FileID
+	metadata.fileSize = header.FileSize
+	metadata.checksum = header.Checksum
+	metadata.chunkMap = make(map[uint64]bool)
+	metadata.stats.resumed = 0
+	for chunk := uint64(0); chunk < header.FileSize; chunk++ {
+		if bitmap[chunk/8]&(1<<(chunk%8)) != 0 {
+			metadata.chunkMap[chunk] = true
+			metadata.stats.resumed++
+		}
+	}
+	metadata.firstMissing = 0
+	for metadata.chunkMap[metadata.firstMissing] {
+		metadata.firstMissing++
+	}
+	return nil
+}
+
+// checkPartialFile reports whether localFilename can hold the chunks the
+// journal loaded into metadata claims: it must exist and extend at least to
+// the last of them but not beyond the end of the file.
+func checkPartialFile(localFilename string, metadata *fileMetadata) error {
+	info, err := os.Stat(localFilename)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", localFilename)
+	}
+	size := uint64(info.Size())
+	chunkSize := uint64(metadata.chunkSize)
+	minSize := uint64(0)
+	for chunk := range metadata.chunkMap {
+		end := (chunk + 1) * chunkSize
+		if chunk == metadata.fileSize-1 {
+			end = chunk*chunkSize + 1 // The last chunk may be shorter
+		}
+		minSize = max(minSize, end)
+	}
+	if size < minSize || size > metadata.fileSize*chunkSize {
+		return fmt.Errorf("size of %s is %d, journal implies %d to %d bytes", localFilename, size, minSize, metadata.fileSize*chunkSize)
+	}
+	return nil
+}
+
+// removeJournal deletes the journal of localFilename if there is one.
+func removeJournal(localFilename string) {
+	os.Remove(journalName(localFilename))
+}
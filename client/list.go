@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
+)
+
+// Entry is a file or directory listed by a server.
+type Entry struct {
+	Name    string // relative to the listed directory
+	URI     string // of the entry, to be passed to Fetch or List
+	Dir     bool
+	Size    uint64 // in bytes, 0 for directories
+	ModTime time.Time
+}
+
+// ErrPageOutOfBounds is returned by List if the directory kept shrinking
+// while it was listed.
+var ErrPageOutOfBounds = errors.New("page of the listing out of bounds")
+
+// ErrListingChanged is returned by List if the directory kept changing while
+// it was listed.
+var ErrListingChanged = errors.New("listing changed while reading it")
+
+// List returns the entries of the directory identified by URI, "" being the
+// root of the server, sorted by name. The listing is transferred in pages,
+// each of which is requested separately. If the directory changes between
+// pages, the listing is read again from the first page, at most
+// RetransmissionsMDR times.
+func (c *Client) List(ctx context.Context, URI string) ([]Entry, error) {
+	conf := &c.Config
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := c.open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create client socket: %w", err)
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+
+	l := lister{conn: conn, conf: conf, token: c.getToken(), timeout: initialTimeout}
+	defer func() { c.setToken(l.token) }()
+
+	for i := 0; ; i++ {
+		entries, err := l.list(ctx, URI)
+		if err == nil || !(errors.Is(err, ErrListingChanged) || errors.Is(err, ErrPageOutOfBounds)) || i+1 >= conf.RetransmissionsMDR {
+			return entries, err
+		}
+		conf.Logger.Info("Listing changed, reading it again", "uri", URI, "err", err)
+	}
+}
+
+// list reads all pages of the listing of URI once.
+func (l *lister) list(ctx context.Context, URI string) ([]Entry, error) {
+	var entries []Entry
+	var listing uint32
+	for page, pages := uint32(0), uint32(1); page < pages; page++ {
+		lsrr, err := l.requestPage(ctx, page, URI)
+		if err != nil {
+			return nil, fmt.Errorf("list page %d of %q: %w", page, URI, err)
+		}
+		// pages of different versions of the listing do not fit together,
+		// entries could be seen twice or missed
+		if page == 0 {
+			listing = lsrr.Listing
+		} else if lsrr.Listing != listing {
+			return nil, fmt.Errorf("list page %d of %q: %w", page, URI, ErrListingChanged)
+		}
+		// The number of pages may change if the directory does
+		pages = lsrr.Pages
+		for _, e := range lsrr.Entries {
+			// the names are used for local files, so only accept plain names
+			if e.Name == "" || e.Name == "." || e.Name == ".." || strings.ContainsAny(e.Name, "/\x00") {
+				l.conf.Logger.Warn("Ignoring invalid name in listing", "name", e.Name, "uri", URI)
+				continue
+			}
+			entries = append(entries, Entry{
+				Name:    e.Name,
+				URI:     joinURI(URI, e.Name),
+				Dir:     e.Flags&messages.EntryDir != 0,
+				Size:    e.Size,
+				ModTime: time.Unix(e.ModTime, 0),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// joinURI returns the URI of the entry name in the directory dir.
+func joinURI(dir string, name string) string {
+	// names may contain characters with a meaning in URIs, and a colon in
+	// the first element would be taken for a scheme
+	elem := strings.ReplaceAll(url.PathEscape(name), ":", "%3A")
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		return elem
+	}
+	return dir + "/" + elem
+}
+
+// lister holds the state of a listing across pages.
+type lister struct {
+	conn    net.Conn
+	conf    *ClientConfig
+	token   [32]uint8
+	number  uint8
+	timeout time.Duration
+}
+
+// requestPage requests a page of a listing until it is received or
+// RetransmissionsMDR requests failed.
+func (l *lister) requestPage(ctx context.Context, page uint32, URI string) (*messages.LSRR, error) {
+	buf := make([]byte, 0x10000) // 64kB
+retransmit:
+	for i := 0; i < l.conf.RetransmissionsMDR; i++ {
+		lsr := messages.GetLSR(l.number, &l.token, page, URI)
+		l.number++
+		t_send := time.Now()
+		err := lsr.Send(l.conn)
+		if err != nil {
+			return nil, fmt.Errorf("send LSR: %w", err)
+		}
+		err = setReadDeadline(ctx, l.conn, t_send.Add(l.timeout))
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := l.conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					continue retransmit
+				}
+				return nil, fmt.Errorf("read from socket: %w", err)
+			}
+			raw := buf[:n]
+			response, err := messages.ParseServer(&raw)
+			if err != nil {
+				l.conf.Logger.Warn("Invalid response received, dropped", "err", err, "response", fmt.Sprintf("%x", raw))
+				continue
+			}
+			switch r := response.(type) {
+			case messages.ServerHeader:
+				if r.Type != messages.LSRR_t || r.Number != lsr.Header.Number {
+					l.conf.Logger.Debug("Unexpected server header, dropped", "header", r)
+					continue
+				}
+				switch r.Error {
+				case messages.FileNotFound:
+					return nil, fmt.Errorf("LSRR server error: %w", ErrFileNotFound)
+				case messages.PageOutOfBounds:
+					return nil, fmt.Errorf("LSRR server error: %w", ErrPageOutOfBounds)
+				default:
+					return nil, fmt.Errorf("LSRR server error: Unknown error code for LSRR %d", r.Error)
+				}
+			case messages.NTM:
+				if r.Header.Number != lsr.Header.Number {
+					continue
+				}
+				l.token = r.Token
+				l.conf.Logger.Debug("Updated token, retransmitting", "token", fmt.Sprintf("%x", r.Token))
+				continue retransmit
+			case messages.LSRR:
+				if r.Header.Number != lsr.Header.Number || r.Page != page {
+					l.conf.Logger.Debug("Received response with wrong message number, dropped", "number", r.Header.Number, "expected", lsr.Header.Number)
+					continue
+				}
+				rtt := time.Since(t_send)
+				if 2*rtt < l.conf.MinTimeout {
+					l.timeout = l.conf.MinTimeout
+				} else {
+					l.timeout = rtt * time.Duration(rtt2timeoutFactor)
+				}
+				return &r, nil
+			default:
+				l.conf.Logger.Debug("Received unexpected response, dropped", "type", fmt.Sprintf("%T", response))
+			}
+		}
+	}
+	return nil, fmt.Errorf("no response from server after %d retransmissions", l.conf.RetransmissionsMDR)
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/metrics"
+)
+
+// clientMetrics are the metrics of the transfers of a client, registered in
+// ClientConfig.Metrics.
+type clientMetrics struct {
+	transfers       *metrics.CounterVec // finished, by outcome
+	active          *metrics.Gauge
+	requested       *metrics.Counter
+	received        *metrics.Counter
+	resumed         *metrics.Counter
+	bytes           *metrics.Counter
+	retransmissions *metrics.Counter
+	invalid         *metrics.Counter
+	late            *metrics.Counter
+	corrupt         *metrics.Counter
+	packetRate      *metrics.Histogram
+	acrSize         *metrics.Histogram
+	duration        *metrics.Histogram
+}
+
+func newClientMetrics(r *metrics.Registry) *clientMetrics {
+	return &clientMetrics{
+		transfers:       r.CounterVec("sanft_client_transfers_total", "Finished transfers by outcome: ok, skipped or error.", "outcome"),
+		active:          r.Gauge("sanft_client_active_transfers", "Transfers in progress."),
+		requested:       r.Counter("sanft_client_requested_chunks_total", "Chunks requested in ACRs."),
+		received:        r.Counter("sanft_client_received_chunks_total", "Chunks received."),
+		resumed:         r.Counter("sanft_client_resumed_chunks_total", "Chunks kept from interrupted transfers."),
+		bytes:           r.Counter("sanft_client_received_bytes_total", "Bytes of chunks received."),
+		retransmissions: r.Counter("sanft_client_retransmissions_total", "Retransmitted MDRs and chunk requests."),
+		invalid:         r.Counter("sanft_client_invalid_messages_total", "Invalid messages received."),
+		late:            r.Counter("sanft_client_late_messages_total", "Messages received with a wrong message number."),
+		corrupt:         r.Counter("sanft_client_corrupt_chunks_total", "Chunks that did not match their hash in the Merkle tree."),
+		packetRate:      r.Histogram("sanft_client_packet_rate", "Packet rate requested in ACRs, in packets per second.", metrics.ExponentialBuckets(16, 4, 8)),
+		acrSize:         r.Histogram("sanft_client_acr_size", "Chunks per ACR chosen for ACRs.", metrics.ExponentialBuckets(1, 2, 10)),
+		duration:        r.Histogram("sanft_client_transfer_duration_seconds", "Duration of finished transfers.", metrics.ExponentialBuckets(0.01, 4, 10)),
+	}
+}
+
+// transferMetrics adds the progress of a transfer to the metrics of the
+// client.
+type transferMetrics struct {
+	m    *clientMetrics
+	last Result // as last added
+}
+
+func (m *clientMetrics) start() *transferMetrics {
+	m.active.Inc()
+	return &transferMetrics{m: m}
+}
+
+// update adds the progress since the last update.
+func (t *transferMetrics) update(r Result) {
+	add(t.m.requested, r.Requested, t.last.Requested)
+	add(t.m.received, r.Received, t.last.Received)
+	add(t.m.resumed, r.Resumed, t.last.Resumed)
+	add(t.m.retransmissions, r.Retransmissions, t.last.Retransmissions)
+	add(t.m.invalid, r.Invalid, t.last.Invalid)
+	add(t.m.late, r.Late, t.last.Late)
+	add(t.m.corrupt, r.Corrupt, t.last.Corrupt)
+	if r.Bytes > t.last.Bytes {
+		t.m.bytes.Add(float64(r.Bytes - t.last.Bytes))
+	}
+	if r.Requested > t.last.Requested {
+		t.m.packetRate.Observe(float64(r.PacketRate))
+		t.m.acrSize.Observe(float64(r.ACRSize))
+	}
+	t.last = r
+}
+
+// done adds the final state of the transfer.
+func (t *transferMetrics) done(r Result, err error) {
+	t.update(r)
+	t.m.active.Dec()
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	} else if r.Skipped {
+		outcome = "skipped"
+	}
+	t.m.transfers.With(outcome).Inc()
+	t.m.duration.Observe(r.Duration.Seconds())
+}
+
+// add adds the increase from last to now to c. The statistics of a transfer
+// start over if the file changes on the server, so a decrease is ignored.
+func add(c *metrics.Counter, now int, last int) {
+	if now > last {
+		c.Add(float64(now - last))
+	}
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxWalkDepth limits the depth of the directory trees walked, as symbolic
+// links on the server may form cycles.
+const maxWalkDepth = 32
+
+// ErrOutsideDir is returned by LocalDir for directory URIs that would be
+// mirrored outside of the local directory.
+var ErrOutsideDir = errors.New("outside of the local directory")
+
+// LocalDir returns the directory below fileDir that the directory identified
+// by URI is mirrored to. Like on the server, URI is percent decoded element
+// by element and "." and ".." elements are resolved, but may not escape
+// fileDir. Neither may a symbolic link on the way to the directory, as files
+// are created in the directory and it is pruned.
+func LocalDir(fileDir string, URI string) (string, error) {
+	ref := URI
+	if !strings.HasPrefix(URI, "sanft:") {
+		ref = "./" + URI
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI: %w", err)
+	}
+	if u.Opaque != "" || u.User != nil || u.Host != "" || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return "", fmt.Errorf("invalid URI: %q is not a path", URI)
+	}
+	elems := []string{fileDir}
+	for _, raw := range strings.Split(u.EscapedPath(), "/") {
+		elem, err := url.PathUnescape(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid URI: %w", err)
+		}
+		if strings.ContainsAny(elem, "/\x00") {
+			return "", fmt.Errorf("invalid URI: %q contains a slash or NUL in a name", URI)
+		}
+		switch elem {
+		case "", ".":
+		case "..":
+			if len(elems) == 1 {
+				return "", fmt.Errorf("%q: %w", URI, ErrOutsideDir)
+			}
+			elems = elems[:len(elems)-1]
+		default:
+			elems = append(elems, elem)
+		}
+	}
+	localDir := filepath.Join(elems...)
+
+	// the directories that do not exist yet are created in the last one
+	// that does
+	existing := localDir
+	real, err := filepath.EvalSymlinks(existing)
+	for errors.Is(err, fs.ErrNotExist) && len(existing) > len(filepath.Clean(fileDir)) {
+		existing = filepath.Dir(existing)
+		real, err = filepath.EvalSymlinks(existing)
+	}
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(fileDir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q: %w", URI, ErrOutsideDir)
+	}
+	return localDir, nil
+}
+
+// Walk lists the directory identified by URI and all of its subdirectories.
+// The names of the returned entries are relative to URI, directories come
+// before their content.
+func (c *Client) Walk(ctx context.Context, URI string) ([]Entry, error) {
+	var walk func(dir Entry, depth int) ([]Entry, error)
+	walk = func(dir Entry, depth int) ([]Entry, error) {
+		if depth > maxWalkDepth {
+			return nil, fmt.Errorf("directory tree deeper than %d at %q", maxWalkDepth, dir.URI)
+		}
+		entries, err := c.List(ctx, dir.URI)
+		if err != nil {
+			return nil, err
+		}
+		var all []Entry
+		for _, e := range entries {
+			e.Name = path.Join(dir.Name, e.Name)
+			all = append(all, e)
+			if !e.Dir {
+				continue
+			}
+			sub, err := walk(e, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, sub...)
+		}
+		return all, nil
+	}
+	return walk(Entry{URI: URI, Dir: true}, 0)
+}
+
+// Prune removes everything in localDir that is not in entries, as returned by
+// Walk, and returns the removed paths. Journals of files in entries are kept.
+func Prune(localDir string, entries []Entry) ([]string, error) {
+	if _, err := os.Stat(localDir); errors.Is(err, fs.ErrNotExist) {
+		// nothing mirrored yet
+		return nil, nil
+	}
+	keep := make(map[string]bool, 2*len(entries))
+	for _, e := range entries {
+		keep[e.Name] = e.Dir
+		if !e.Dir {
+			keep[journalName(e.Name)] = false
+		}
+	}
+
+	var removed []string
+	err := filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		isDir, ok := keep[filepath.ToSlash(rel)]
+		if ok && isDir == d.IsDir() {
+			return nil
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		removed = append(removed, p)
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("prune %s: %w", localDir, err)
+	}
+	return removed, nil
+}
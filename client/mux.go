@@ -0,0 +1,234 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// endpointQueueSize is the number of datagrams buffered for an endpoint.
+// Further datagrams are dropped, like a full socket buffer would.
+const endpointQueueSize = 1024
+
+// mux shares one connected UDP socket between several transfers. Every
+// transfer gets its own endpoint which behaves like a connected net.Conn.
+//
+// The Number field of outgoing requests is rewritten so that it is unique on
+// the socket, and responses are routed back to the endpoint that sent the
+// request with their original Number restored. As Number is 8 bits, at most
+// 256 requests can be distinguished; responses to requests older than that
+// may be routed to the wrong endpoint, where they are dropped as late.
+type mux struct {
+	conn net.Conn
+
+	mu     sync.Mutex
+	next   uint8      // Next Number to use on the socket
+	routes [256]route // routes[Number on the socket] -> endpoint
+
+	done chan struct{} // Closed when the socket was closed
+}
+
+type route struct {
+	ep     *endpoint
+	number uint8 // Number chosen by the endpoint
+}
+
+// endpoint is the view of one transfer on a mux. It implements net.Conn.
+type endpoint struct {
+	m      *mux
+	in     chan []byte
+	errs   chan error
+	closed chan struct{}
+	once   sync.Once
+
+	mu              sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{} // Closed when deadline is modified
+}
+
+// newMux starts numbering requests with next, so that responses to requests
+// sent on conn before are not mistaken for responses to the transfers.
+func newMux(conn net.Conn, next uint8) *mux {
+	m := &mux{conn: conn, next: next, done: make(chan struct{})}
+	go m.receive()
+	return m
+}
+
+// receive reads datagrams from the socket and dispatches them until the
+// socket is closed.
+func (m *mux) receive() {
+	defer close(m.done)
+	buf := make([]byte, 0x10000) // 64kB
+	for {
+		n, err := m.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// E.g. an ICMP port unreachable. Report it to every transfer
+			// like a dedicated socket would.
+			m.broadcast(err)
+			continue
+		}
+		if n < 3 {
+			// Too short to contain a Number; nobody can use it
+			continue
+		}
+		m.mu.Lock()
+		r := m.routes[buf[2]]
+		m.mu.Unlock()
+		if r.ep == nil {
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		data[2] = r.number
+		select {
+		case r.ep.in <- data:
+		default:
+		}
+	}
+}
+
+func (m *mux) broadcast(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[*endpoint]bool)
+	for _, r := range m.routes {
+		if r.ep != nil && !seen[r.ep] {
+			seen[r.ep] = true
+			select {
+			case r.ep.errs <- err:
+			default:
+			}
+		}
+	}
+}
+
+// Open returns a new endpoint on the socket.
+func (m *mux) Open() *endpoint {
+	return &endpoint{
+		m:               m,
+		in:              make(chan []byte, endpointQueueSize),
+		errs:            make(chan error, 1),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// Close closes the underlying socket.
+func (m *mux) Close() error {
+	err := m.conn.Close()
+	<-m.done
+	return err
+}
+
+func (ep *endpoint) Write(p []byte) (int, error) {
+	select {
+	case <-ep.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if len(p) < 3 {
+		return ep.m.conn.Write(p)
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	// Writes are serialized since the socket may not be safe for concurrent
+	// use (e.g. markov.MarkovConn)
+	ep.m.mu.Lock()
+	defer ep.m.mu.Unlock()
+	number := ep.m.next
+	ep.m.next++
+	ep.m.routes[number] = route{ep: ep, number: p[2]}
+	data[2] = number
+	return ep.m.conn.Write(data)
+}
+
+// errDeadlineChanged makes Read wait again with the new deadline.
+var errDeadlineChanged = errors.New("deadline changed")
+
+func (ep *endpoint) Read(p []byte) (int, error) {
+	for {
+		n, err := ep.read(p)
+		if err != errDeadlineChanged {
+			return n, err
+		}
+	}
+}
+
+func (ep *endpoint) read(p []byte) (int, error) {
+	ep.mu.Lock()
+	deadline := ep.deadline
+	changed := ep.deadlineChanged
+	ep.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-ep.in:
+		return copy(p, data), nil
+	case err := <-ep.errs:
+		return 0, err
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-changed:
+		return 0, errDeadlineChanged
+	case <-ep.closed:
+		return 0, net.ErrClosed
+	case <-ep.m.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// Close releases the routes of the endpoint. The socket stays open.
+func (ep *endpoint) Close() error {
+	ep.once.Do(func() {
+		close(ep.closed)
+		ep.m.mu.Lock()
+		for i := range ep.m.routes {
+			if ep.m.routes[i].ep == ep {
+				ep.m.routes[i] = route{}
+			}
+		}
+		ep.m.mu.Unlock()
+	})
+	return nil
+}
+
+func (ep *endpoint) LocalAddr() net.Addr {
+	return ep.m.conn.LocalAddr()
+}
+
+func (ep *endpoint) RemoteAddr() net.Addr {
+	return ep.m.conn.RemoteAddr()
+}
+
+func (ep *endpoint) SetDeadline(t time.Time) error {
+	return ep.SetReadDeadline(t)
+}
+
+func (ep *endpoint) SetReadDeadline(t time.Time) error {
+	ep.mu.Lock()
+	ep.deadline = t
+	close(ep.deadlineChanged)
+	ep.deadlineChanged = make(chan struct{})
+	ep.mu.Unlock()
+	return nil
+}
+
+// Writes never block for long on a UDP socket
+func (ep *endpoint) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// DefaultStreamBuffer is the number of bytes of out-of-order chunks FetchTo
+// buffers if ClientConfig.StreamBuffer is 0.
+const DefaultStreamBuffer = 16 << 20 // 16MB
+
+// ErrFileChanged is returned by FetchTo when the file changes on the server
+// after a part of it has been written.
+var ErrFileChanged = errors.New("file changed on the server while streaming")
+
+// reorderBuffer writes the chunks of a file in order to w, keeping chunks
+// that arrive before the ones preceding them until it is their turn.
+type reorderBuffer struct {
+	w        io.Writer
+	next     uint64            // Next chunk to write
+	chunks   map[uint64][]byte // Chunks after next
+	buffered int               // Bytes in chunks
+	limit    int               // Maximum of buffered
+	hash     hash.Hash         // Of the bytes written
+	err      error             // Of w, the transfer cannot continue
+}
+
+func newReorderBuffer(w io.Writer, limit int) *reorderBuffer {
+	return &reorderBuffer{
+		w:      w,
+		chunks: make(map[uint64][]byte),
+		limit:  limit,
+		hash:   sha256.New(),
+	}
+}
+
+// reset forgets all chunks, the file is requested anew.
+func (b *reorderBuffer) reset() {
+	b.next = 0
+	b.chunks = make(map[uint64][]byte)
+	b.buffered = 0
+	b.hash.Reset()
+}
+
+// add writes chunk, and the buffered chunks following it, if it is the next
+// one, and buffers it otherwise. It reports whether the chunk was taken; it
+// is not if the buffer is full.
+func (b *reorderBuffer) add(chunk uint64, data []byte) bool {
+	if chunk != b.next {
+		if b.buffered+len(data) > b.limit {
+			return false
+		}
+		b.chunks[chunk] = append([]byte(nil), data...)
+		b.buffered += len(data)
+		return true
+	}
+	b.write(data)
+	b.next++
+	for {
+		data, ok := b.chunks[b.next]
+		if !ok {
+			return true
+		}
+		delete(b.chunks, b.next)
+		b.buffered -= len(data)
+		b.write(data)
+		b.next++
+	}
+}
+
+func (b *reorderBuffer) write(data []byte) {
+	b.hash.Write(data)
+	if b.err == nil {
+		_, b.err = b.w.Write(data)
+	}
+}
+
+// window returns the number of chunks after next that fit into the buffer.
+func (b *reorderBuffer) window(chunkSize uint16) uint64 {
+	return uint64(b.limit / int(chunkSize))
+}
+
+// writeChunkToStream passes a received chunk to metadata.stream and updates
+// the chunkMap if it was taken.
+func writeChunkToStream(metadata *fileMetadata, chunkNumber uint64, data []byte) error {
+	if metadata.chunkMap[chunkNumber] {
+		return nil
+	}
+	if chunkNumber != metadata.fileSize-1 && len(data) != int(metadata.chunkSize) {
+		return fmt.Errorf("invalid chunk size. Expected %d got %d", metadata.chunkSize, len(data))
+	}
+	if !metadata.stream.add(chunkNumber, data) {
+		// Requested again later
+		return nil
+	}
+	metadata.chunkMap[chunkNumber] = true
+	metadata.stats.received++
+	metadata.stats.bytes += uint64(len(data))
+	for metadata.chunkMap[metadata.firstMissing] {
+		metadata.firstMissing++
+	}
+	return nil
+}
+
+// requestLimit returns the chunk number up to which chunks may be requested:
+// the end of the file, or while streaming the end of what can be buffered,
+// so that the lowest missing chunks are requested first.
+func (metadata *fileMetadata) requestLimit() uint64 {
+	if metadata.stream == nil {
+		return metadata.fileSize
+	}
+	return min(metadata.fileSize, metadata.stream.next+1+metadata.stream.window(metadata.chunkSize))
+}
+
+// FetchTo requests the file at URI and writes it in order to w, so that it
+// can be piped into another program while it is downloaded. Chunks that
+// arrive out of order are buffered, up to ClientConfig.StreamBuffer bytes;
+// only the missing chunks that fit into the buffer are requested. The SHA-256
+// checksum is computed while writing: if it does not match, or the file
+// changes on the server, an error is returned, but the bytes already written
+// cannot be taken back. Transfers to w cannot be resumed.
+func (c *Client) FetchTo(ctx context.Context, URI string, w io.Writer) (*Result, error) {
+	tm := c.metrics.start()
+	r, err := c.fetchTo(ctx, URI, w, tm)
+	tm.done(*r, err)
+	return r, err
+}
+
+func (c *Client) fetchTo(ctx context.Context, URI string, w io.Writer, tm *transferMetrics) (*Result, error) {
+	conf := &c.Config
+	start := time.Now()
+	metadata := new(fileMetadata)
+	metadata.url = URI
+	metadata.timeout = initialTimeout
+	metadata.packetRate = conf.InitialPacketRate
+	limit := conf.StreamBuffer
+	if limit <= 0 {
+		limit = DefaultStreamBuffer
+	}
+	metadata.stream = newReorderBuffer(w, limit)
+	result := func() *Result { return metadata.result(start) }
+
+	if err := ctx.Err(); err != nil {
+		return result(), err
+	}
+	conn, err := c.open(ctx)
+	if err != nil {
+		return result(), fmt.Errorf("create client socket: %w", err)
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+	metadata.token = c.getToken()
+	defer func() { c.setToken(metadata.token) }()
+
+	err = updateMetadata(ctx, conn, metadata, conf)
+	c.setToken(metadata.token)
+	if err != nil {
+		return result(), fmt.Errorf("get metadata: %w", err)
+	}
+
+	for metadata.firstMissing < metadata.fileSize {
+		err := ensureLeaves(ctx, conn, metadata, conf)
+		if err == nil {
+			err = getMissingChunks(ctx, conn, metadata, conf)
+		}
+		if err != nil {
+			return result(), fmt.Errorf("get missing chunks: %w", err)
+		}
+		tm.update(*result())
+		if conf.Progress != nil {
+			conf.Progress(*result())
+		}
+	}
+
+	var checksum [32]byte
+	metadata.stream.hash.Sum(checksum[:0])
+	if checksum != metadata.checksum {
+		return result(), fmt.Errorf("checksum not matching. Expected %x got %x", metadata.checksum, checksum)
+	}
+	return result(), nil
+}
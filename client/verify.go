@@ -0,0 +1,271 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/merkle"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
+)
+
+// hsrWindow is the number of HSRs outstanding at the same time while the
+// Merkle tree of a file is fetched.
+const hsrWindow = 16
+
+// hsrNotReadyDelay is the time after which a page is requested again that the
+// server could not send yet as it is still building the Merkle tree.
+var hsrNotReadyDelay = 500 * time.Millisecond
+
+// DefaultMaxVerifiedChunks is the largest number of chunks of a file whose
+// leaves are fetched if ClientConfig.MaxVerifiedChunks is 0. The leaves of
+// such a file take 128MB.
+const DefaultMaxVerifiedChunks = 1 << 22
+
+// errStaleFileID is returned by fetchLeaves when the server no longer knows
+// the file ID, as the file changed.
+var errStaleFileID = errors.New("file ID no longer valid")
+
+// ensureLeaves fetches the leaves of the Merkle tree of the file if
+// ClientConfig.VerifyChunks is set and they are not known yet. If the server
+// does not send them, the transfer continues without verifying the chunks.
+func ensureLeaves(ctx context.Context, conn net.Conn, metadata *fileMetadata, conf *ClientConfig) error {
+	if !conf.VerifyChunks || metadata.leaves != nil || metadata.unverified || metadata.fileSize == 0 {
+		return nil
+	}
+	for i := 0; ; i++ {
+		leaves, err := fetchLeaves(ctx, conn, metadata, conf)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errStaleFileID) && i < conf.RetransmissionsMDR {
+			err = updateMetadata(ctx, conn, metadata, conf)
+			if err != nil {
+				return fmt.Errorf("get metadata after invalid fileID: %w", err)
+			}
+			continue
+		}
+		if err != nil {
+			conf.Logger.Warn("Cannot get the hashes of the chunks, not verifying them", "uri", metadata.url, "err", err)
+			metadata.unverified = true
+			return nil
+		}
+		conf.Logger.Debug("Received the hashes of the chunks", "uri", metadata.url, "chunks", len(leaves))
+		metadata.leaves = leaves
+		return nil
+	}
+}
+
+// hsrPage is a page of the Merkle tree requested by an outstanding HSR.
+type hsrPage struct {
+	page     int
+	deadline time.Time
+	notReady bool // the server is building the tree, deadline is the time to request it again
+}
+
+// fetchLeaves requests the pages of the Merkle tree of the file with up to
+// hsrWindow HSRs outstanding and returns the leaves. The first page is
+// requested alone to learn the number of pages, which must match the size of
+// the file. Every page must verify against the root of the first one; pages
+// that do not, e.g. as they were corrupted, are requested again, like pages
+// that are lost, at most RetransmissionsMDR times. Pages the server has not
+// built yet are requested again after hsrNotReadyDelay for as long as the
+// server is building them. As the size of the file is only checked against
+// the first page, the leaves are stored as the pages are verified rather than
+// allocated up front.
+func fetchLeaves(ctx context.Context, conn net.Conn, metadata *fileMetadata, conf *ClientConfig) ([][merkle.Size]byte, error) {
+	maxChunks := conf.MaxVerifiedChunks
+	if maxChunks == 0 {
+		maxChunks = DefaultMaxVerifiedChunks
+	}
+	if metadata.fileSize > maxChunks {
+		return nil, fmt.Errorf("file of %d chunks is larger than the limit of %d", metadata.fileSize, maxChunks)
+	}
+	buf := make([]byte, 0x10000) // 64kB
+	n := int(metadata.fileSize)
+	var leaves [][merkle.Size]byte
+	var root [merkle.Size]byte
+	pageSize := 0 // unknown until the first page arrived
+	todo := []int{0}
+	left := 1 // pages not received yet
+	tries := make(map[int]int)
+	outstanding := make(map[uint8]hsrPage)
+
+	for left > 0 {
+		for len(todo) > 0 && len(outstanding) < hsrWindow {
+			page := todo[0]
+			todo = todo[1:]
+			if tries[page]++; tries[page] > conf.RetransmissionsMDR {
+				return nil, fmt.Errorf("no valid HSRR for page %d after %d retransmissions", page, conf.RetransmissionsMDR)
+			}
+			hsr := messages.GetHSR(metadata.messageCounter, &metadata.token, metadata.fileID, uint32(page))
+			metadata.messageCounter++
+			t_send := time.Now()
+			if err := hsr.Send(conn); err != nil {
+				return nil, fmt.Errorf("send HSR: %w", err)
+			}
+			outstanding[hsr.Header.Number] = hsrPage{page: page, deadline: t_send.Add(metadata.timeout)}
+		}
+
+		var deadline time.Time
+		for _, p := range outstanding {
+			if deadline.IsZero() || p.deadline.Before(deadline) {
+				deadline = p.deadline
+			}
+		}
+		if err := setReadDeadline(ctx, conn, deadline); err != nil {
+			return nil, err
+		}
+		n_read, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, fmt.Errorf("read from socket: %w", err)
+			}
+			// Request the lost pages again
+			now := time.Now()
+			lost := false
+			for number, p := range outstanding {
+				if !now.Before(p.deadline) {
+					delete(outstanding, number)
+					todo = append(todo, p.page)
+					lost = lost || !p.notReady
+				}
+			}
+			if lost {
+				metadata.timeout *= 2
+			}
+			continue
+		}
+		raw := buf[:n_read]
+		response, err := messages.ParseServer(&raw)
+		if err != nil {
+			conf.Logger.Warn("Invalid response received, dropped", "err", err, "response", fmt.Sprintf("%x", raw))
+			continue
+		}
+		switch r := response.(type) {
+		case messages.ServerHeader:
+			if r.Type != messages.HSRR_t {
+				continue
+			}
+			p, ok := outstanding[r.Number]
+			if !ok || p.notReady {
+				continue
+			}
+			switch r.Error {
+			case messages.InvalidFileID:
+				return nil, errStaleFileID
+			case messages.PageOutOfBounds:
+				return nil, errors.New("HSRR server error: tree does not match the file size")
+			case messages.TreeTooLarge:
+				return nil, errors.New("HSRR server error: file too large for a tree")
+			case messages.TreeNotReady:
+				// the request was answered, it does not count as a try
+				tries[p.page]--
+				p.deadline, p.notReady = time.Now().Add(hsrNotReadyDelay), true
+				outstanding[r.Number] = p
+				conf.Logger.Debug("Merkle tree not ready, waiting", "page", p.page)
+			default:
+				return nil, fmt.Errorf("HSRR server error: Unknown error code for HSRR %d", r.Error)
+			}
+		case messages.NTM:
+			if _, ok := outstanding[r.Header.Number]; !ok {
+				continue
+			}
+			metadata.token = r.Token
+			conf.Logger.Debug("Updated token, retransmitting", "token", fmt.Sprintf("%x", r.Token))
+			// All outstanding HSRs carry the old token
+			for number, p := range outstanding {
+				delete(outstanding, number)
+				todo = append(todo, p.page)
+			}
+		case messages.HSRR:
+			p, ok := outstanding[r.Header.Number]
+			if !ok || r.Page != uint32(p.page) || r.FileID != metadata.fileID {
+				conf.Logger.Debug("Received response matching no outstanding HSR, dropped", "number", r.Header.Number)
+				continue
+			}
+			delete(outstanding, r.Header.Number)
+			if pageSize == 0 {
+				size := int(r.PageSize)
+				if size < 1 || size&(size-1) != 0 || int64(r.Pages) != int64(merkle.Pages(n, size)) {
+					return nil, fmt.Errorf("invalid HSRR: %d pages of %d leaves for %d chunks", r.Pages, r.PageSize, n)
+				}
+				if !merkle.VerifyPage(r.Root, n, p.page, size, r.Leaves, r.Proof) {
+					metadata.stats.invalid++
+					todo = append(todo, p.page)
+					continue
+				}
+				pageSize, root = size, r.Root
+				for page := 1; page < int(r.Pages); page++ {
+					todo = append(todo, page)
+				}
+				left = int(r.Pages)
+			} else if int(r.PageSize) != pageSize || r.Root != root ||
+				!merkle.VerifyPage(root, n, p.page, pageSize, r.Leaves, r.Proof) {
+				metadata.stats.invalid++
+				conf.Logger.Debug("Received HSRR that does not verify, requesting it again", "page", p.page)
+				todo = append(todo, p.page)
+				continue
+			}
+			if end := p.page*pageSize + len(r.Leaves); end > len(leaves) {
+				leaves = append(leaves, make([][merkle.Size]byte, end-len(leaves))...)
+			}
+			copy(leaves[p.page*pageSize:], r.Leaves)
+			left--
+		default:
+			metadata.stats.late++
+		}
+	}
+	return leaves, nil
+}
+
+// verifyChunk reports whether data is chunk chunkNumber according to the
+// Merkle tree of the file, or whether the chunks are not verified.
+func (metadata *fileMetadata) verifyChunk(chunkNumber uint64, data []byte) bool {
+	return metadata.leaves == nil || merkle.LeafHash(data) == metadata.leaves[chunkNumber]
+}
+
+// recheckChunks is called once all chunks of file are received. If the
+// chunks are verified but the checksum does not match, e.g. as chunks kept
+// from an interrupted transfer are corrupt, the chunks on disk are verified
+// and the corrupt ones marked as missing, so that only they are requested
+// again instead of the whole file.
+func (metadata *fileMetadata) recheckChunks(file *os.File, conf *ClientConfig) error {
+	if metadata.leaves == nil {
+		return nil
+	}
+	checksum, err := metadata.finishChecksum(file)
+	if err != nil || checksum == metadata.checksum {
+		return err
+	}
+	buf := make([]byte, metadata.chunkSize)
+	corrupt := 0
+	for chunk := uint64(0); chunk < metadata.fileSize; chunk++ {
+		n, err := file.ReadAt(buf, int64(chunk)*int64(metadata.chunkSize))
+		if err != nil && !(errors.Is(err, io.EOF) && chunk == metadata.fileSize-1) {
+			return fmt.Errorf("read chunk %d: %w", chunk, err)
+		}
+		if metadata.verifyChunk(chunk, buf[:n]) {
+			continue
+		}
+		delete(metadata.chunkMap, chunk)
+		metadata.firstMissing = min(metadata.firstMissing, chunk)
+		metadata.stats.corrupt++
+		corrupt++
+	}
+	if corrupt == 0 {
+		// The final check fails
+		return nil
+	}
+	conf.Logger.Warn("Checksum not matching, requesting corrupt chunks again", "uri", metadata.url, "chunks", corrupt)
+	// The checksum is computed again from the file
+	metadata.hash, metadata.hashed = nil, 0
+	return nil
+}
@@ -1,6 +1,6 @@
 module gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft
 
-go 1.18
+go 1.25
 
 require (
 	github.com/stretchr/testify v1.8.0
@@ -0,0 +1,42 @@
+// Package logging creates the slog loggers of the client and the server and
+// holds the formatting shared by their log messages.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Formats are the valid formats of New.
+var Formats = []string{"text", "json"}
+
+// Levels are the valid levels of ParseLevel, from most to least verbose.
+var Levels = []string{"debug", "info", "warn"}
+
+// New returns a logger writing records of level and above to w, as JSON
+// objects if format is "json" and as key=value pairs otherwise.
+func New(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// ParseLevel returns the slog level of one of Levels. Unknown levels are
+// treated as "info".
+func ParseLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// FileID formats a file ID for the logs.
+func FileID(id uint32) string {
+	return fmt.Sprintf("0x%08x", id)
+}
@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "json", ParseLevel("warn"))
+	logger.Info("hidden")
+	logger.Warn("shown", "file_id", FileID(0xfeed))
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "shown" || record["file_id"] != "0x0000feed" {
+		t.Fatalf("Wrong record %v", record)
+	}
+
+	buf.Reset()
+	New(&buf, "text", nil).Info("text", "n", 1)
+	if !strings.Contains(buf.String(), "msg=text n=1") {
+		t.Fatalf("Wrong text record %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for level, want := range map[string]slog.Level{
+		"debug": slog.LevelDebug, "info": slog.LevelInfo, "warn": slog.LevelWarn, "other": slog.LevelInfo,
+	} {
+		if got := ParseLevel(level); got != want {
+			t.Fatalf("ParseLevel(%q) = %v, expected %v", level, got, want)
+		}
+	}
+}
@@ -1,97 +1,553 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"math"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"sync"
+	"syscall"
+	"time"
 
 	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/client"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/logging"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/metrics"
 	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/server"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
-	host           = kingpin.Arg("host", "The host to request from (hostname or IPv4 address).").ResolvedIP()
-	serverMode     = kingpin.Flag("server", "Server mode: accept incoming requests from any host. Operate in client mode if “-s” is not specified.").Short('s').Default("false").Bool()
-	port           = kingpin.Flag("port", "Specify the port number to use (use 1337 as default if not given).").Default("1337").Short('t').Int()
-	markovP        = kingpin.Flag("p", "Specify the loss probabilities for the Markov chain model.").Short('p').Default("0").Float64()
-	markovQ        = kingpin.Flag("q", "Specify the loss probabilities for the Markov chain model.").Short('q').Default("0").Float64()
-	fileDir        = kingpin.Flag("file-dir", "Server: Specify the directory containing the files that the server should serve. Client: Specify the directory where the requested files will be saved").Short('d').Default("./").ExistingDir()
-	chunkSize      = kingpin.Flag("chunk-size", "The chunk size advertised and used by the server.").Default("4048").Int()
-	maxChunksInACR = kingpin.Flag("max-chunks-in-acr", "The maximum number of chunks in an ACR allowed by the server.").Default("128").Int()
-	rateIncrease   = kingpin.Flag("rate-increase", "Amount that the server sending rate should be increased in packet per second.").Default("256").Float64()
-	files          = kingpin.Arg("files", "The name of the file(s) to fetch.").Default("").Strings()
+	getCmd          = kingpin.Command("get", "Fetch files, or serve them with “-s”.").Default()
+	host            = getCmd.Arg("host", "The host to request from (hostname, IPv4 or IPv6 address). Server: the address to listen on, “::” for all IPv4 and IPv6 addresses; a hostname listens on all of its addresses.").String()
+	serverMode      = kingpin.Flag("server", "Server mode: accept incoming requests from any host. Operate in client mode if “-s” is not specified.").Short('s').Default("false").Bool()
+	port            = kingpin.Flag("port", "Specify the port number to use (use 1337 as default if not given).").Default("1337").Short('t').Int()
+	markovP         = kingpin.Flag("p", "Specify the loss probabilities for the Markov chain model.").Short('p').Default("0").Float64()
+	markovQ         = kingpin.Flag("q", "Specify the loss probabilities for the Markov chain model.").Short('q').Default("0").Float64()
+	fileDir         = kingpin.Flag("file-dir", "Server: Specify the directory containing the files that the server should serve. Client: Specify the directory where the requested files will be saved").Short('d').Default("./").ExistingDir()
+	chunkSize       = kingpin.Flag("chunk-size", "The chunk size advertised and used by the server.").Default("4048").Int()
+	maxChunksInACR  = kingpin.Flag("max-chunks-in-acr", "The maximum number of chunks in an ACR allowed by the server.").Default("128").Int()
+	rateIncrease    = kingpin.Flag("rate-increase", "Amount that the server sending rate should be increased in packet per second.").Default("256").Float64()
+	acrWindow       = kingpin.Flag("acr-window", "Client: number of ACRs that may be outstanding at the same time.").Default("1").Int()
+	minACRSize      = kingpin.Flag("min-acr-size", "Client: smallest number of chunks per ACR when losses shrink the ACRs.").Default("1").Int()
+	maxACRSize      = kingpin.Flag("max-acr-size", "Client: largest number of chunks per ACR, 0 for the maximum of the server.").Default("0").Int()
+	congestion      = kingpin.Flag("congestion-control", "Client: how the packet rate is chosen: “measure” the rate of the last ACR, or estimate the bottleneck bandwidth like TCP BBR (“bbr”).").Default(client.CongestionControls[0]).Enum(client.CongestionControls...)
+	parallel        = kingpin.Flag("parallel", "Client: number of files to fetch concurrently.").Default("1").Int()
+	recursive       = kingpin.Flag("recursive", "Client: the given URIs are directories, mirror them with all subdirectories, skipping files that are already up to date.").Short('r').Bool()
+	deleteExtra     = kingpin.Flag("delete", "Client: with “-r”, remove local files and directories that are not on the server.").Bool()
+	output          = kingpin.Flag("output", "Client: write the single requested file to this path instead of below “--file-dir”, “-” for stdout. The file is written in order while it is downloaded, so it can be piped into another program.").Short('o').String()
+	verifyChunks    = kingpin.Flag("verify-chunks", "Client: verify every chunk on arrival with the Merkle tree of the file sent by the server and request corrupt chunks again.").Bool()
+	resume          = kingpin.Flag("resume", "Client: keep a journal next to partial downloads and resume interrupted transfers.").Bool()
+	shutdownTimeout = kingpin.Flag("shutdown-timeout", "Server: time given to in-flight requests to finish on SIGINT/SIGTERM.").Default("30s").Duration()
+	archives        = kingpin.Flag("archives", "Server: also serve the members of tar and zip archives, e.g. “archive.tar/path/inside”.").Bool()
+	hidden          = kingpin.Flag("hidden", "Server: serve files and directories whose name starts with a dot.").Bool()
+	allow           = kingpin.Flag("allow", "Server: only serve files matching this glob pattern (repeatable). Patterns without a slash match file names, others paths.").Strings()
+	deny            = kingpin.Flag("deny", "Server: never serve files or directories matching this glob pattern (repeatable).").Strings()
+	symlinks        = kingpin.Flag("symlinks", "Server: symbolic links to follow: inside the served directory, all or none.").Default("inside").Enum(server.SymlinkPolicies...)
+	index           = kingpin.Flag("index", "Server: keep file IDs and checksums in this file, so that they survive restarts.").String()
+	prehash         = kingpin.Flag("prehash", "Server: compute the checksums of all served files at startup instead of on the first request.").Bool()
+	rescanInterval  = kingpin.Flag("rescan-interval", "Server: look for new and changed files every interval and hash them, e.g. “10m”. 0 to never rescan.").Default("0").Duration()
+	hashWorkers     = kingpin.Flag("hash-workers", "Server: number of files hashed at the same time.").Default("2").Int()
+	maxTreeChunks   = kingpin.Flag("max-tree-chunks", "Server: largest number of chunks of a file whose Merkle tree is sent to clients.").Default("4194304").Int64()
+	rateLimit       = kingpin.Flag("rate-limit", "Server: maximum number of packets per second sent to all clients together, 0 for no limit.").Default("0").Float64()
+	clientRateLimit = kingpin.Flag("client-rate-limit", "Server: maximum number of packets per second sent to a client IP address, 0 for no limit.").Default("0").Float64()
+	maxACRs         = kingpin.Flag("max-acrs", "Server: maximum number of ACRs answered at the same time, 0 for no limit.").Default("0").Int()
+	dropWhenBusy    = kingpin.Flag("drop-when-busy", "Server: drop ACRs exceeding “--max-acrs” instead of queueing them.").Bool()
+	configFile      = kingpin.Flag("config", "Server: read the server parameters from a JSON file, reloaded on SIGHUP. Flags given on the command line take precedence.").ExistingFile()
+	metricsAddr     = kingpin.Flag("metrics-addr", "Serve metrics in the Prometheus text format on http://<addr>/metrics, e.g. “localhost:9090”.").String()
+	logLevel        = kingpin.Flag("log-level", "The least severe messages to log.").Default("info").Enum(logging.Levels...)
+	logFormat       = kingpin.Flag("log-format", "Log messages as key=value pairs (“text”) or JSON objects.").Default("text").Enum(logging.Formats...)
+	accessLog       = kingpin.Flag("access-log", "Server: append a record of every answered MDR and ACR to this file, “-” for stderr.").String()
+	listen          = kingpin.Flag("listen", "Server: also listen on this IP address (repeatable), e.g. “::1” next to host “127.0.0.1”.").Strings()
+	keyFile         = kingpin.Flag("key-file", "Server: keep the token keys in this file, so that tokens stay valid across restarts and servers sharing the file accept each other's tokens.").String()
+	keyOverlap      = kingpin.Flag("key-overlap", "Server: accept tokens of the previous key for this long after a key rotation, e.g. “10m”.").Default(server.DefaultKeyOverlap.String()).Duration()
+	files           = getCmd.Arg("files", "The name of the file(s) to fetch.").Default("").Strings()
+	lsCmd           = kingpin.Command("ls", "List a directory served by a host.")
+	lsHost          = lsCmd.Arg("host", "The host to list (hostname, IPv4 or IPv6 address).").Required().String()
+	lsPath          = lsCmd.Arg("path", "The directory to list, the served directory if not given.").Default("").String()
+
+	// status gets the progress and results of the client, stderr if the file
+	// is written to stdout.
+	status io.Writer = os.Stdout
 )
 
 func main() {
-	kingpin.Parse()
+	cmd := kingpin.MustParse(kingpin.CommandLine.Parse(commandLineArgs()))
 
 	// check that p and q are valid
 	if *markovP > 1 || *markovP < 0 || *markovQ > 1 || *markovQ < 0 {
 		fmt.Println("error: p and/or q values for the markov chain are invalid")
 		os.Exit(1)
 	}
-	if *host == nil {
+	if cmd == lsCmd.FullCommand() {
+		list()
+		return
+	}
+	if *host == "" && !(*serverMode && *configFile != "") {
 		fmt.Println("error: When running in client mode, a server IP/hostname must be provided! When running in server mode a host ip must be provided!")
 		os.Exit(1)
 	}
 
-	fmt.Printf("Host: %s, Server Mode: %t, port: %d, markovP: %f markovQ: %f, file-dir: %s, files: %s\n", *host, *serverMode, *port, *markovP, *markovQ, *fileDir, *files)
-	fmt.Println("files: ", *files)
+	logger := logging.New(os.Stderr, *logFormat, logging.ParseLevel(*logLevel))
+	logger.Debug("Parameters", "host", *host, "server", *serverMode, "port", *port, "p", *markovP, "q", *markovQ,
+		"file_dir", *fileDir, "files", *files)
 
 	if *serverMode { /* server mode */
-		// replace empty path with "." and add trailing "/"
-		if *fileDir == "" {
-			*fileDir = "./"
-		}
-		folder := *fileDir
-		if folder[len(folder)-1] != '/' {
-			folder = folder + "/"
-		}
-		// Protocol specification limitations
-		if *chunkSize == 0 || *chunkSize > 65517 {
-			fmt.Println("error: Chunk size must be non-zero and no larger than 65517")
+		logger.Info("Starting server")
+
+		conf, err := serverConfig()
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
 			os.Exit(1)
 		}
-		// Avoid an overflow when casting to uint16
-		if *maxChunksInACR == 0 || *maxChunksInACR > math.MaxUint16 {
-			fmt.Printf("error: max-chunks-in-acr must be non-zero and no larger than %d\n", math.MaxUint16)
+		s, err := server.New(conf)
+		if err != nil {
+			logger.Error("Error creating server", "err", err)
 			os.Exit(1)
 		}
+		// the config file may set another log format and level
+		logger = s.Logger
+		if conf.MetricsAddr != "" {
+			serveMetrics(conf.MetricsAddr, s.Metrics, logger)
+		}
 
-		log.Println("Starting server")
+		// reload the config file on SIGHUP
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for range hup {
+				if *configFile == "" {
+					logger.Warn("No config file to reload")
+					continue
+				}
+				conf, err := serverConfig()
+				if err == nil {
+					err = s.Reload(conf)
+				}
+				if err != nil {
+					logger.Error("Error reloading config, keeping the old one", "err", err)
+				}
+			}
+		}()
 
-		s, err := server.Init(*host, *port, folder, uint16(*chunkSize), uint16(*maxChunksInACR),
-			*markovP, *markovQ, *rateIncrease)
-		if err != nil {
-			log.Panicf(`Error creating server: %v`, err)
+		// serve until interrupted, then give in-flight ACRs time to finish
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = s.Serve(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logger.Error("Error while serving", "err", err)
 		}
-		defer s.Conn.Close()
+		stop() // a second signal terminates immediately
 
-		close := make(chan bool)
-		s.Listen(close)
+		logger.Info("Shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Server did not shut down cleanly", "err", err)
+		}
 
 	} else { /* client mode */
 		if len(*files) < 1 {
 			fmt.Println("error: When running in client mode, at least one file URI must be provided!")
 			os.Exit(1)
 		}
+		if *output != "" && (len(*files) != 1 || *recursive) {
+			fmt.Println("error: “--output” requires a single file URI and no “-r”!")
+			os.Exit(1)
+		}
+		if *output == "-" {
+			status = os.Stderr
+		}
 
 		clientConfig := client.DefaultConfig
 
 		clientConfig.MarkovP = *markovP
 		clientConfig.MarkovQ = *markovQ
+		clientConfig.Resume = *resume
+		clientConfig.MaxACRsInFlight = *acrWindow
+		clientConfig.MinACRSize = *minACRSize
+		clientConfig.MaxACRSize = *maxACRSize
+		clientConfig.CongestionControl = *congestion
+		clientConfig.VerifyChunks = *verifyChunks
+		clientConfig.SkipUnchanged = *recursive
+		clientConfig.Logger = logger
+		if *metricsAddr != "" {
+			clientConfig.Metrics = metrics.NewRegistry()
+			serveMetrics(*metricsAddr, clientConfig.Metrics, logger)
+		}
+		if *parallel <= 1 {
+			clientConfig.Progress = func(r client.Result) {
+				fmt.Fprintf(status, "%s(0x%x): %d/%d chunks (%dchunks/s); acr:%d;req:%d;invalid:%d;late:%d  \r", r.URI, r.FileID, r.Resumed+r.Received, r.Chunks, r.PacketRate, r.ACRSize, r.Requested, r.Invalid, r.Late)
+			}
+		}
+
+		c, err := client.NewHost(*host, *port, &clientConfig)
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		defer c.Close()
+
+		var jobs []fetchJob
+		if *recursive {
+			jobs, err = mirrorJobs(c, *files, *deleteExtra)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				c.Close()
+				os.Exit(1)
+			}
+		} else if *output != "" {
+			out := io.WriteCloser(os.Stdout)
+			if *output != "-" {
+				out, err = os.Create(*output)
+				if err != nil {
+					fmt.Printf("error: %v\n", err)
+					c.Close()
+					os.Exit(1)
+				}
+			}
+			defer out.Close()
+			jobs = append(jobs, fetchJob{file: (*files)[0], out: out})
+		} else {
+			for _, file := range *files {
+				jobs = append(jobs, fetchJob{file: file, local: path.Join(*fileDir, file)})
+			}
+		}
+		outcomes := fetchAll(c, jobs, *parallel)
+
+		failed := 0
+		for _, o := range outcomes {
+			if o.err != nil {
+				failed++
+				fmt.Fprintf(status, "FAILED %s: %v\n", o.file, o.err)
+			} else if o.result.Skipped {
+				fmt.Fprintf(status, "SKIP   %s (up to date)\n", o.file)
+			} else {
+				fmt.Fprintf(status, "OK     %s (%d bytes in %v)\n", o.file, o.result.Bytes, o.result.Duration.Round(time.Millisecond))
+			}
+		}
+		if failed > 0 {
+			fmt.Fprintf(status, "%d/%d file requests failed\n", failed, len(outcomes))
+			c.Close()
+			os.Exit(1)
+		}
+	}
+
+}
+
+// serveMetrics serves the metrics in r on addr in the background.
+func serveMetrics(addr string, r *metrics.Registry, logger *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			logger.Error("Error serving metrics", "err", err)
+		}
+	}()
+}
+
+// list prints the entries of a directory of the server, one per line.
+func list() {
+	clientConfig := client.DefaultConfig
+	clientConfig.MarkovP = *markovP
+	clientConfig.MarkovQ = *markovQ
+	clientConfig.Logger = logging.New(os.Stderr, *logFormat, logging.ParseLevel(*logLevel))
+	c, err := client.NewHost(*lsHost, *port, &clientConfig)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	entries, err := c.List(context.Background(), *lsPath)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		c.Close()
+		os.Exit(1)
+	}
+	for _, e := range entries {
+		kind, name := "-", e.Name
+		if e.Dir {
+			kind, name = "d", name+"/"
+		}
+		fmt.Printf("%s %12d %s %s\n", kind, e.Size, e.ModTime.Format("2006-01-02 15:04"), name)
+	}
+}
+
+// serverConfig returns the server parameters from the config file, if any,
+// overridden by the flags given on the command line.
+func serverConfig() (*server.Config, error) {
+	conf := server.DefaultConfig
+	setByUser := map[string]bool{}
+	if *configFile != "" {
+		c, err := server.LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		conf = *c
+		setByUser = flagsSetByUser()
+	}
+	// without a config file the flags, including their defaults, are used
+	use := func(name string) bool {
+		return *configFile == "" || setByUser[name]
+	}
+
+	// the further addresses of a hostname are listened on too
+	var hostIPs []string
+	if *host != "" && use("host") {
+		ips, err := listenIPs(*host)
+		if err != nil {
+			return nil, err
+		}
+		conf.Host, hostIPs = ips[0], ips[1:]
+	}
+	if use("listen") {
+		conf.Listen = *listen
+	}
+	conf.Listen = append(hostIPs, conf.Listen...)
+	if use("port") {
+		conf.Port = *port
+	}
+	if use("file-dir") {
+		conf.RootDir = *fileDir
+		// replace empty path with "."
+		if conf.RootDir == "" {
+			conf.RootDir = "./"
+		}
+	}
+	if use("chunk-size") {
+		// Protocol specification limitations
+		if *chunkSize == 0 || *chunkSize > 65517 {
+			return nil, errors.New("Chunk size must be non-zero and no larger than 65517")
+		}
+		conf.ChunkSize = uint16(*chunkSize)
+	}
+	if use("max-chunks-in-acr") {
+		// Avoid an overflow when casting to uint16
+		if *maxChunksInACR == 0 || *maxChunksInACR > math.MaxUint16 {
+			return nil, fmt.Errorf("max-chunks-in-acr must be non-zero and no larger than %d", math.MaxUint16)
+		}
+		conf.MaxChunksInACR = uint16(*maxChunksInACR)
+	}
+	if use("rate-increase") {
+		conf.RateIncrease = *rateIncrease
+	}
+	if use("p") {
+		conf.MarkovP = *markovP
+	}
+	if use("q") {
+		conf.MarkovQ = *markovQ
+	}
+	if use("archives") {
+		conf.Archives = *archives
+	}
+	if use("hidden") {
+		conf.Hidden = *hidden
+	}
+	if use("allow") {
+		conf.Allow = *allow
+	}
+	if use("deny") {
+		conf.Deny = *deny
+	}
+	if use("symlinks") {
+		conf.Symlinks = *symlinks
+	}
+	if use("index") {
+		conf.Index = *index
+	}
+	if use("prehash") {
+		conf.Prehash = *prehash
+	}
+	if use("rescan-interval") {
+		conf.RescanInterval = rescanInterval.String()
+	}
+	if use("hash-workers") {
+		conf.HashWorkers = *hashWorkers
+	}
+	if use("max-tree-chunks") {
+		conf.MaxTreeChunks = *maxTreeChunks
+	}
+	if use("rate-limit") {
+		conf.RateLimit = *rateLimit
+	}
+	if use("client-rate-limit") {
+		conf.ClientRateLimit = *clientRateLimit
+	}
+	if use("max-acrs") {
+		conf.MaxACRs = *maxACRs
+	}
+	if use("drop-when-busy") {
+		conf.DropWhenBusy = *dropWhenBusy
+	}
+	if use("metrics-addr") {
+		conf.MetricsAddr = *metricsAddr
+	}
+	if use("log-level") {
+		conf.LogLevel = *logLevel
+	}
+	if use("log-format") {
+		conf.LogFormat = *logFormat
+	}
+	if use("access-log") {
+		conf.AccessLog = *accessLog
+	}
+	if use("key-file") {
+		conf.KeyFile = *keyFile
+	}
+	if use("key-overlap") {
+		conf.KeyOverlap = keyOverlap.String()
+	}
+	return &conf, nil
+}
+
+// listenIPs returns the IP addresses of host, which is an IP address or a
+// hostname.
+func listenIPs(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("error while resolving %v: %w", host, err)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	return addrs, nil
+}
+
+// commandLineArgs returns the arguments of the program. kingpin takes “-” for
+// a flag, so “-o -” is passed on as “--output=-”.
+func commandLineArgs() []string {
+	var args []string
+	for i := 1; i < len(os.Args); i++ {
+		if (os.Args[i] == "-o" || os.Args[i] == "--output") && i+1 < len(os.Args) && os.Args[i+1] == "-" {
+			args = append(args, "--output=-")
+			i++
+			continue
+		}
+		args = append(args, os.Args[i])
+	}
+	return args
+}
+
+// flagsSetByUser returns the names of the flags and arguments given on the
+// command line.
+func flagsSetByUser() map[string]bool {
+	set := map[string]bool{}
+	ctx, err := kingpin.CommandLine.ParseContext(commandLineArgs())
+	if err != nil {
+		return set
+	}
+	for _, el := range ctx.Elements {
+		switch c := el.Clause.(type) {
+		case *kingpin.FlagClause:
+			set[c.Model().Name] = true
+		case *kingpin.ArgClause:
+			set[c.Model().Name] = true
+		}
+	}
+	return set
+}
 
-		// Request files sequentially
-		for _, file := range *files {
-			localFileName := path.Join(*fileDir, file)
-			err := client.RequestFile(*host, *port, file, localFileName, &clientConfig)
+// mirrorJobs returns the files below the directories dirs on the server,
+// to be fetched to the same paths below the file directory. With prune,
+// local files and directories that are not on the server are removed.
+func mirrorJobs(c *client.Client, dirs []string, prune bool) ([]fetchJob, error) {
+	var jobs []fetchJob
+	for _, dir := range dirs {
+		entries, err := c.Walk(context.Background(), dir)
+		if err != nil {
+			return nil, err
+		}
+		localDir, err := client.LocalDir(*fileDir, dir)
+		if err != nil {
+			return nil, err
+		}
+		if prune {
+			removed, err := client.Prune(localDir, entries)
+			for _, p := range removed {
+				fmt.Printf("DELETE %s\n", p)
+			}
 			if err != nil {
-				fmt.Printf("File request for %q failed: %v\n", file, err)
+				return nil, err
 			}
 		}
+		for _, e := range entries {
+			local := path.Join(localDir, e.Name)
+			if e.Dir {
+				if err := os.MkdirAll(local, 0755); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			jobs = append(jobs, fetchJob{file: e.URI, local: local})
+		}
 	}
+	return jobs, nil
+}
 
+type fetchJob struct {
+	file  string // URI on the server
+	local string
+	out   io.Writer // If not nil, the file is written to it in order instead of to local
+}
+
+type fetchOutcome struct {
+	file   string
+	result *client.Result
+	err    error
+}
+
+// fetchAll requests files with at most parallel transfers at the same time
+// and returns the outcome of every request in the order of files.
+func fetchAll(c *client.Client, files []fetchJob, parallel int) []fetchOutcome {
+	if parallel < 1 {
+		parallel = 1
+	}
+	outcomes := make([]fetchOutcome, len(files))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				file, localFileName := files[i].file, files[i].local
+				var result *client.Result
+				var err error
+				if files[i].out != nil {
+					result, err = c.FetchTo(context.Background(), file, files[i].out)
+				} else {
+					// e.g. for members of archives
+					if err := os.MkdirAll(path.Dir(localFileName), 0755); err != nil {
+						outcomes[i] = fetchOutcome{file: file, result: &client.Result{URI: file}, err: err}
+						continue
+					}
+					result, err = c.Fetch(context.Background(), file, localFileName)
+				}
+				if parallel == 1 {
+					// Terminate the progress line
+					fmt.Fprintln(status)
+				}
+				outcomes[i] = fetchOutcome{file: file, result: result, err: err}
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return outcomes
 }
@@ -3,6 +3,8 @@ package markov
 import (
 	"fmt"
 	"net"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
 )
 
 // IP:   net.ParseIP(ip),
@@ -11,7 +13,7 @@ func CreateServerSocket(ip net.IP, port int, p float64, q float64) (net.PacketCo
 		Port: port,
 		IP:   ip,
 	}
-	conn, err := net.ListenUDP("udp", &laddr)
+	conn, err := net.ListenUDP(messages.Network(ip), &laddr)
 	if err != nil {
 		return nil, fmt.Errorf("error creating ListenUDP: %w", err)
 	}
@@ -31,7 +33,7 @@ func CreateClientSocket(ip net.IP, port int, p float64, q float64) (net.Conn, er
 	}
 
 	// this automatically takes local laddr
-	conn, err := net.DialUDP("udp", nil, raddr)
+	conn, err := net.DialUDP(messages.Network(ip), nil, raddr)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing to server: %w", err)
 	}
@@ -3,6 +3,7 @@ package markov
 import (
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -11,34 +12,32 @@ type MarkovConn struct {
 	P       float64
 	Q       float64
 
+	mu          sync.Mutex // Protects lastDropped against concurrent writers
 	lastDropped bool
 }
 
+// drop advances the Markov chain and reports whether the next packet is lost.
+func (mc *MarkovConn) drop() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.lastDropped {
+		mc.lastDropped = rand.Float64() < mc.Q
+	} else {
+		mc.lastDropped = rand.Float64() < mc.P
+	}
+	return mc.lastDropped
+}
+
 // Implement the interface for net.PacketConn
 func (mc *MarkovConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	return mc.UDPConn.ReadFrom(p)
 }
 
 func (mc *MarkovConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	if mc.lastDropped {
-		if rand.Float64() < mc.Q {
-			// Drop
-			mc.lastDropped = true
-			return len(p), nil
-		} else {
-			mc.lastDropped = false
-			return mc.UDPConn.WriteTo(p, addr)
-		}
-	} else {
-		if rand.Float64() < mc.P {
-			// Drop
-			mc.lastDropped = true
-			return len(p), nil
-		} else {
-			mc.lastDropped = false
-			return mc.UDPConn.WriteTo(p, addr)
-		}
+	if mc.drop() {
+		return len(p), nil
 	}
+	return mc.UDPConn.WriteTo(p, addr)
 }
 
 // Implement the interface for net.Conn
@@ -47,25 +46,10 @@ func (mc *MarkovConn) Read(p []byte) (n int, err error) {
 }
 
 func (mc *MarkovConn) Write(p []byte) (n int, err error) {
-	if mc.lastDropped {
-		if rand.Float64() < mc.Q {
-			// Drop
-			mc.lastDropped = true
-			return len(p), nil
-		} else {
-			mc.lastDropped = false
-			return mc.UDPConn.Write(p)
-		}
-	} else {
-		if rand.Float64() < mc.P {
-			// Drop
-			mc.lastDropped = true
-			return len(p), nil
-		} else {
-			mc.lastDropped = false
-			return mc.UDPConn.Write(p)
-		}
+	if mc.drop() {
+		return len(p), nil
 	}
+	return mc.UDPConn.Write(p)
 }
 
 func (mc *MarkovConn) RemoteAddr() net.Addr {
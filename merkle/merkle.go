@@ -0,0 +1,127 @@
+// Package merkle implements the Merkle tree over the chunks of a file that
+// lets a client verify every chunk on arrival. The tree is hashed like in
+// RFC 6962: a leaf is SHA-256(0x00 || chunk) and an inner node
+// SHA-256(0x01 || left || right). A node without a sibling, at the end of a
+// level, is moved up unchanged.
+//
+// The leaves are transferred in pages of a power of two leaves, so that
+// every page is a subtree and can be verified on its own with the hashes of
+// the siblings on the path to the root.
+package merkle
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// Size is the size of a hash.
+const Size = sha256.Size
+
+// LeafHash returns the leaf of a chunk.
+func LeafHash(chunk []byte) [Size]byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(chunk)
+	var sum [Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func nodeHash(left, right [Size]byte) [Size]byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left[:])
+	h.Write(right[:])
+	var sum [Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Tree is the Merkle tree over the leaves of a file.
+type Tree struct {
+	levels [][][Size]byte // levels[0] are the leaves, the last level the root
+}
+
+// New returns the tree over leaves, of which there must be at least one.
+func New(leaves [][Size]byte) *Tree {
+	t := &Tree{levels: [][][Size]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([][Size]byte, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = nodeHash(level[2*i], level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+// Root returns the root hash of the tree.
+func (t *Tree) Root() [Size]byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Len returns the number of leaves.
+func (t *Tree) Len() int {
+	return len(t.levels[0])
+}
+
+// PageSize returns the largest power of two that is at most max, and at
+// least 1, as the number of leaves per page.
+func PageSize(max int) int {
+	if max < 2 {
+		return 1
+	}
+	return 1 << (bits.Len(uint(max)) - 1)
+}
+
+// Pages returns the number of pages of size leaves of a tree of n leaves.
+func Pages(n int, size int) int {
+	return (n + size - 1) / size
+}
+
+// Page returns the leaves of page p of size leaves, a power of two, and the
+// proof of their subtree: the hashes of the siblings on the path to the
+// root, from the bottom.
+func (t *Tree) Page(p int, size int) (leaves [][Size]byte, proof [][Size]byte) {
+	n := t.Len()
+	leaves = t.levels[0][p*size : min((p+1)*size, n)]
+	i := p
+	for level := bits.TrailingZeros(uint(size)); level < len(t.levels)-1; level++ {
+		if sibling := i ^ 1; sibling < len(t.levels[level]) {
+			proof = append(proof, t.levels[level][sibling])
+		}
+		i /= 2
+	}
+	return leaves, proof
+}
+
+// VerifyPage reports whether leaves are page p of size leaves of the tree
+// with n leaves and the given root, according to proof.
+func VerifyPage(root [Size]byte, n int, p int, size int, leaves [][Size]byte, proof [][Size]byte) bool {
+	if size < 1 || size&(size-1) != 0 || p < 0 || p >= Pages(n, size) ||
+		len(leaves) != min(size, n-p*size) {
+		return false
+	}
+	h := New(leaves).Root()
+	i, width := p, Pages(n, size) // index and number of nodes on the level
+	for ; width > 1; width = (width + 1) / 2 {
+		if sibling := i ^ 1; sibling < width {
+			if len(proof) == 0 {
+				return false
+			}
+			if i%2 == 0 {
+				h = nodeHash(h, proof[0])
+			} else {
+				h = nodeHash(proof[0], h)
+			}
+			proof = proof[1:]
+		}
+		i /= 2
+	}
+	return len(proof) == 0 && h == root
+}
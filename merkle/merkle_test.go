@@ -0,0 +1,73 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfc6962Root is the Merkle Tree Hash of RFC 6962, section 2.1.
+func rfc6962Root(leaves [][Size]byte) [Size]byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := 1
+	for 2*k < len(leaves) {
+		k *= 2
+	}
+	return nodeHash(rfc6962Root(leaves[:k]), rfc6962Root(leaves[k:]))
+}
+
+func testLeaves(n int) [][Size]byte {
+	leaves := make([][Size]byte, n)
+	for i := range leaves {
+		leaves[i] = LeafHash([]byte(fmt.Sprintf("chunk %d", i)))
+	}
+	return leaves
+}
+
+func TestRoot(t *testing.T) {
+	for n := 1; n <= 33; n++ {
+		leaves := testLeaves(n)
+		assert.Equal(t, rfc6962Root(leaves), New(leaves).Root(), "%d leaves", n)
+	}
+	// RFC 6962 hashes the empty string as a leaf like this
+	assert.Equal(t, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		fmt.Sprintf("%x", LeafHash(nil)))
+}
+
+func TestPageSize(t *testing.T) {
+	assert.Equal(t, 1, PageSize(0))
+	assert.Equal(t, 1, PageSize(1))
+	assert.Equal(t, 64, PageSize(126))
+	assert.Equal(t, 128, PageSize(128))
+	assert.Equal(t, 3, Pages(9, 4))
+}
+
+func TestVerifyPage(t *testing.T) {
+	for _, n := range []int{1, 2, 5, 7, 8, 13, 64, 100} {
+		leaves := testLeaves(n)
+		tree := New(leaves)
+		root := tree.Root()
+		for _, size := range []int{1, 2, 4, 16} {
+			for p := 0; p < Pages(n, size); p++ {
+				page, proof := tree.Page(p, size)
+				assert.Equal(t, leaves[p*size:min((p+1)*size, n)], page)
+				assert.True(t, VerifyPage(root, n, p, size, page, proof), "page %d of %d leaves of %d", p, size, n)
+
+				// wrong position, contents or proof
+				if Pages(n, size) > 1 {
+					assert.False(t, VerifyPage(root, n, (p+1)%Pages(n, size), size, page, proof))
+				}
+				corrupt := append([][Size]byte(nil), page...)
+				corrupt[0][0] ^= 1
+				assert.False(t, VerifyPage(root, n, p, size, corrupt, proof))
+				if len(proof) > 0 {
+					assert.False(t, VerifyPage(root, n, p, size, page, proof[1:]))
+				}
+			}
+		}
+		assert.False(t, VerifyPage(root, n, 0, 3, leaves[:min(3, n)], nil))
+	}
+}
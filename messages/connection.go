@@ -5,12 +5,27 @@ import (
 	"net"
 )
 
+// Network returns the network to use for a socket bound or connected to ip:
+// "udp4" or "udp6" for an IPv4 or IPv6 address, and "udp" for no address or
+// the IPv6 unspecified address "::", which listens on all IPv4 and IPv6
+// addresses (dual stack). IPv4-mapped IPv6 addresses are IPv4 addresses.
+func Network(ip net.IP) string {
+	switch {
+	case ip == nil || ip.Equal(net.IPv6unspecified):
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
+
 func CreateServerSocket(ip net.IP, port int) (*net.UDPConn, error) {
 	laddr := net.UDPAddr{
 		Port: port,
 		IP:   ip,
 	}
-	conn, err := net.ListenUDP("udp", &laddr)
+	conn, err := net.ListenUDP(Network(ip), &laddr)
 	if err != nil {
 		return nil, fmt.Errorf("error creating ListenUDP: %w", err)
 	}
@@ -24,7 +39,7 @@ func CreateClientSocket(ip net.IP, port int) (*net.UDPConn, error) {
 	}
 
 	// this automatically takes local laddr
-	conn, err := net.DialUDP("udp", nil, raddr)
+	conn, err := net.DialUDP(Network(ip), nil, raddr)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing to server: %w", err)
 	}
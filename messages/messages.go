@@ -13,12 +13,16 @@ const (
 	NTM_t  uint8 = 0
 	MDRR_t uint8 = 2
 	CRR_t        = 4
+	LSRR_t uint8 = 6
+	HSRR_t uint8 = 8
 )
 
 // client message types
 const (
 	MDR_t uint8 = 1
 	ACR_t uint8 = 3
+	LSR_t uint8 = 5
+	HSR_t uint8 = 7
 )
 
 // error codes
@@ -30,6 +34,9 @@ const (
 	TooManyChunks      uint8 = 3
 	ChunkOutOfBounds   uint8 = 4
 	ZeroLengthCR       uint8 = 5
+	PageOutOfBounds    uint8 = 6
+	TreeTooLarge       uint8 = 7
+	TreeNotReady       uint8 = 8
 )
 
 func Int2uint8_6_arr(a uint64) *[6]uint8 {
@@ -159,3 +166,102 @@ func GetCRR(number uint8, err uint8, chunknumber [6]uint8, data *[]uint8) *CRR {
 	crr.Data = *data
 	return crr
 }
+
+// List Request: asks for a page of the listing of a directory
+type LSR struct {
+	Header ClientHeader
+	Page   uint32
+	URI    string /* this must be handled manualy when sending, empty for the root */
+}
+
+func GetLSR(number uint8, token *[32]uint8, page uint32, uri string) *LSR {
+	lsr := new(LSR)
+	lsr.Header = ClientHeader{Version: VERS, Type: LSR_t, Number: number, Token: *token}
+	lsr.Page = page
+	lsr.URI = uri
+	return lsr
+}
+
+// entry flags
+const (
+	EntryDir uint8 = 1
+)
+
+// Entry of a directory listing
+type ListEntry struct {
+	Flags   uint8
+	Size    uint64 // in bytes
+	ModTime int64  // unix time in seconds
+	Name    string /* preceded by its uint16 length when sent */
+}
+
+// encoded size of the fixed fields of a ListEntry
+const ListEntryHeaderSize = 1 + 8 + 8 + 2
+
+// encoded size of the fixed fields of an LSRR
+const LSRRHeaderSize = 4 + 4 + 4 + 4
+
+// List Request Response: a page of the listing, sorted by name
+type LSRR struct {
+	Header  ServerHeader
+	Page    uint32
+	Pages   uint32 // number of pages of the listing
+	Listing uint32 // version of the listing, changes with the entries
+	Entries []ListEntry
+}
+
+func GetLSRR(number uint8, err uint8, page uint32, pages uint32, listing uint32, entries []ListEntry) *LSRR {
+	lsrr := new(LSRR)
+	lsrr.Header = ServerHeader{Version: VERS, Type: LSRR_t, Number: number, Error: err}
+	lsrr.Page = page
+	lsrr.Pages = pages
+	lsrr.Listing = listing
+	lsrr.Entries = entries
+	return lsrr
+}
+
+// Hash Request: asks for a page of the leaves of the Merkle tree over the
+// chunks of a file
+type HSR struct {
+	Header ClientHeader
+	FileID uint32
+	Page   uint32
+}
+
+func GetHSR(number uint8, token *[32]uint8, fileid uint32, page uint32) *HSR {
+	hsr := new(HSR)
+	hsr.Header = ClientHeader{Version: VERS, Type: HSR_t, Number: number, Token: *token}
+	hsr.FileID = fileid
+	hsr.Page = page
+	return hsr
+}
+
+// encoded size of the fixed fields of an HSRR
+const HSRRHeaderSize = 4 + 4*4 + 32 + 1
+
+// Hash Request Response: a page of leaves, the subtree of the page is
+// verified with the proof against the root
+type HSRR struct {
+	Header   ServerHeader
+	FileID   uint32
+	Page     uint32
+	Pages    uint32 // number of pages of the tree
+	PageSize uint32 // leaves per page, a power of two
+	Root     [32]uint8
+	Proof    [][32]uint8 /* preceded by its uint8 length when sent */
+	Leaves   [][32]uint8
+}
+
+func GetHSRR(number uint8, err uint8, fileid uint32, page uint32, pages uint32, page_size uint32,
+	root *[32]uint8, proof [][32]uint8, leaves [][32]uint8) *HSRR {
+	hsrr := new(HSRR)
+	hsrr.Header = ServerHeader{Version: VERS, Type: HSRR_t, Number: number, Error: err}
+	hsrr.FileID = fileid
+	hsrr.Page = page
+	hsrr.Pages = pages
+	hsrr.PageSize = page_size
+	hsrr.Root = *root
+	hsrr.Proof = proof
+	hsrr.Leaves = leaves
+	return hsrr
+}
@@ -131,6 +131,35 @@ func ParseClient(data *[]byte) (ClientMessage, error) {
 		}
 
 		parsed_data = acr
+
+	case LSR_t:
+		// assert packet length: header + 4B page, the URI may be empty
+		if len(d) < 39 {
+			return nil, &WrongPacketLengthError{s: fmt.Sprintf("packet too small, should be at least 39B is %d", len(d))}
+		}
+		var lsr LSR
+		err = binary.Read(bytes.NewBuffer(d[:35]), binary.BigEndian, &lsr.Header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read: %w", err)
+		}
+		lsr.Page = binary.BigEndian.Uint32(d[35:39])
+		lsr.URI = string(d[39:])
+		parsed_data = lsr
+
+	case HSR_t:
+		// assert packet length: header + 4B file ID + 4B page
+		if len(d) != 43 {
+			return nil, &WrongPacketLengthError{s: fmt.Sprintf("packet should be 43B is %d", len(d))}
+		}
+		var hsr HSR
+		err = binary.Read(bytes.NewBuffer(d[:35]), binary.BigEndian, &hsr.Header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read: %w", err)
+		}
+		hsr.FileID = binary.BigEndian.Uint32(d[35:39])
+		hsr.Page = binary.BigEndian.Uint32(d[39:43])
+		parsed_data = hsr
+
 	default:
 		// no valid client packet
 		return nil, &UnsupporedTypeError{s: fmt.Sprintf("unsupported client type %d", d[1])}
@@ -212,6 +241,80 @@ func ParseServer(data *[]byte) (ServerMessage, error) {
 
 		parsed_data = crr
 
+	case LSRR_t:
+		// If an error code is set, only return the header
+		if d[3] != NoError {
+			var header ServerHeader
+			err = binary.Read(r, binary.BigEndian, &header)
+			parsed_data = header
+			break
+		}
+		// assert packet length: header + 3*4
+		if len(d) < LSRRHeaderSize {
+			return nil, &WrongPacketLengthError{s: fmt.Sprintf("packet too small, should be at least %dB is %d", LSRRHeaderSize, len(d))}
+		}
+		var lsrr LSRR
+		err = binary.Read(bytes.NewBuffer(d[:4]), binary.BigEndian, &lsrr.Header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		lsrr.Page = binary.BigEndian.Uint32(d[4:8])
+		lsrr.Pages = binary.BigEndian.Uint32(d[8:12])
+		lsrr.Listing = binary.BigEndian.Uint32(d[12:16])
+		for rest := d[LSRRHeaderSize:]; len(rest) > 0; {
+			if len(rest) < ListEntryHeaderSize {
+				return nil, &WrongPacketLengthError{s: fmt.Sprintf("truncated list entry of %dB", len(rest))}
+			}
+			e := ListEntry{
+				Flags:   rest[0],
+				Size:    binary.BigEndian.Uint64(rest[1:9]),
+				ModTime: int64(binary.BigEndian.Uint64(rest[9:17])),
+			}
+			l := int(binary.BigEndian.Uint16(rest[17:19]))
+			rest = rest[ListEntryHeaderSize:]
+			if len(rest) < l {
+				return nil, &WrongPacketLengthError{s: fmt.Sprintf("truncated list entry name of %dB, should be %dB", len(rest), l)}
+			}
+			e.Name = string(rest[:l])
+			rest = rest[l:]
+			lsrr.Entries = append(lsrr.Entries, e)
+		}
+		parsed_data = lsrr
+
+	case HSRR_t:
+		// If an error code is set, only return the header
+		if d[3] != NoError {
+			var header ServerHeader
+			err = binary.Read(r, binary.BigEndian, &header)
+			parsed_data = header
+			break
+		}
+		// assert packet length: header + 4*4 + 32 + 1, then whole hashes
+		if len(d) < HSRRHeaderSize || (len(d)-HSRRHeaderSize)%32 != 0 {
+			return nil, &WrongPacketLengthError{s: fmt.Sprintf("packet should be %dB and whole hashes is %d", HSRRHeaderSize, len(d))}
+		}
+		var hsrr HSRR
+		err = binary.Read(bytes.NewBuffer(d[:4]), binary.BigEndian, &hsrr.Header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		hsrr.FileID = binary.BigEndian.Uint32(d[4:8])
+		hsrr.Page = binary.BigEndian.Uint32(d[8:12])
+		hsrr.Pages = binary.BigEndian.Uint32(d[12:16])
+		hsrr.PageSize = binary.BigEndian.Uint32(d[16:20])
+		copy(hsrr.Root[:], d[20:52])
+		hashes := make([][32]uint8, (len(d)-HSRRHeaderSize)/32)
+		for i := range hashes {
+			copy(hashes[i][:], d[HSRRHeaderSize+32*i:])
+		}
+		proof := int(d[52])
+		if proof > len(hashes) {
+			return nil, &WrongPacketLengthError{s: fmt.Sprintf("truncated proof of %d hashes, should be %d", len(hashes), proof)}
+		}
+		hsrr.Proof = hashes[:proof:proof]
+		hsrr.Leaves = hashes[proof:]
+		parsed_data = hsrr
+
 	default:
 		// no valid server packet
 		return nil, &UnsupporedTypeError{s: fmt.Sprintf("unsupported server type %d", d[1])}
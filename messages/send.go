@@ -119,3 +119,101 @@ func (m CRR) Send(conn net.PacketConn, addr net.Addr) error {
 	}
 	return nil
 }
+
+func (m LSR) Send(conn net.Conn) error {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, m.Header)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	err = binary.Write(buf, binary.BigEndian, m.Page)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	/* variable length field of type string must be handled separately */
+	_, err = buf.WriteString(m.URI)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return nil
+}
+
+func (m HSR) Send(conn net.Conn) error {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, m.Header)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	err = binary.Write(buf, binary.BigEndian, [2]uint32{m.FileID, m.Page})
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return nil
+}
+
+func (m HSRR) Send(conn net.PacketConn, addr net.Addr) error {
+	if len(m.Proof) > 0xff {
+		return fmt.Errorf("error encoding message: proof too long: %d", len(m.Proof))
+	}
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, m.Header)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	err = binary.Write(buf, binary.BigEndian, struct {
+		FileID, Page, Pages, PageSize uint32
+		Root                          [32]uint8
+		ProofLength                   uint8
+	}{m.FileID, m.Page, m.Pages, m.PageSize, m.Root, uint8(len(m.Proof))})
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	for _, h := range append(m.Proof, m.Leaves...) {
+		buf.Write(h[:])
+	}
+	_, err = conn.WriteTo(buf.Bytes(), addr)
+	if err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return nil
+}
+
+func (m LSRR) Send(conn net.PacketConn, addr net.Addr) error {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, m.Header)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	err = binary.Write(buf, binary.BigEndian, [3]uint32{m.Page, m.Pages, m.Listing})
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+	for _, e := range m.Entries {
+		if len(e.Name) > 0xffff {
+			return fmt.Errorf("error encoding message: name too long: %d", len(e.Name))
+		}
+		err = binary.Write(buf, binary.BigEndian, struct {
+			Flags      uint8
+			Size       uint64
+			ModTime    int64
+			NameLength uint16
+		}{e.Flags, e.Size, e.ModTime, uint16(len(e.Name))})
+		if err != nil {
+			return fmt.Errorf("error encoding message: %w", err)
+		}
+		buf.WriteString(e.Name)
+	}
+	_, err = conn.WriteTo(buf.Bytes(), addr)
+	if err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return nil
+}
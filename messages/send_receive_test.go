@@ -230,6 +230,175 @@ func TestCRR(t *testing.T) {
 	assert.Equal(t, crr.Data, msg.Data, "data missmatch")
 }
 
+func TestLSR(t *testing.T) {
+	conn_server, conn_client, _ := createTestServerAndClient(t)
+	defer conn_client.Close()
+	defer conn_server.Close()
+
+	for _, uri := range []string{"", "some/dir"} {
+		msg := GetLSR(3, createRandomToken(), 7, uri)
+		err := msg.Send(conn_client)
+		if err != nil {
+			t.Fatalf(`Error while sending message to server: %v`, err)
+		}
+		_, data, err := ServerReceive(conn_server, 10000)
+		if err != nil {
+			t.Fatalf(`Error while receiving on server: %v`, err)
+		}
+		// parse message
+		msgr, err := ParseClient(&data)
+		if err != nil {
+			t.Fatalf(`Error while parsing client message: %v`, err)
+		}
+		// type assertion
+		var lsr LSR = msgr.(LSR)
+		// sanity check received data
+		assert.Equal(t, lsr.Header, msg.Header, "Header missmatch")
+		assert.Equal(t, lsr.Page, msg.Page, "page missmatch")
+		assert.Equal(t, lsr.URI, msg.URI, "URI missmatch")
+	}
+}
+
+func TestLSRR(t *testing.T) {
+	conn_server, conn_client, addr := createTestServerAndClient(t)
+	defer conn_client.Close()
+	defer conn_server.Close()
+
+	entries := []ListEntry{
+		{Flags: EntryDir, Size: 0, ModTime: 1656000000, Name: "dir"},
+		{Flags: 0, Size: 1 << 40, ModTime: -1, Name: "file with spaces.txt"},
+		{Flags: 0, Size: 0, ModTime: 0, Name: ""},
+	}
+	for _, e := range [][]ListEntry{nil, entries} {
+		msg := GetLSRR(4, NoError, 1, 3, 0xdeadbeef, e)
+		err := msg.Send(conn_server, addr)
+		if err != nil {
+			t.Fatalf(`Error while sending message to client: %v`, err)
+		}
+		data, err := ClientReceive(conn_client, 10000)
+		if err != nil {
+			t.Fatalf(`Error while receiving on client: %v`, err)
+		}
+		// parse message
+		msgr, err := ParseServer(&data)
+		if err != nil {
+			t.Fatalf(`Error while parsing server message: %v`, err)
+		}
+		// type assertion
+		var lsrr LSRR = msgr.(LSRR)
+		// sanity check received data
+		assert.Equal(t, lsrr.Header, msg.Header, "Header missmatch")
+		assert.Equal(t, lsrr.Page, msg.Page, "page missmatch")
+		assert.Equal(t, lsrr.Pages, msg.Pages, "pages missmatch")
+		assert.Equal(t, lsrr.Listing, msg.Listing, "listing missmatch")
+		assert.Equal(t, lsrr.Entries, msg.Entries, "entries missmatch")
+
+		// truncated entries are rejected
+		if len(data) > LSRRHeaderSize {
+			var e *WrongPacketLengthError
+			truncated := data[:len(data)-1]
+			_, err = ParseServer(&truncated)
+			assert.True(t, errors.As(err, &e), "truncated entry accepted: %v", err)
+		}
+	}
+}
+
+func TestHSR(t *testing.T) {
+	conn_server, conn_client, _ := createTestServerAndClient(t)
+	defer conn_client.Close()
+	defer conn_server.Close()
+
+	msg := GetHSR(5, createRandomToken(), 0xdeadbeef, 42)
+	err := msg.Send(conn_client)
+	if err != nil {
+		t.Fatalf(`Error while sending message to server: %v`, err)
+	}
+	_, data, err := ServerReceive(conn_server, 10000)
+	if err != nil {
+		t.Fatalf(`Error while receiving on server: %v`, err)
+	}
+	// parse message
+	msgr, err := ParseClient(&data)
+	if err != nil {
+		t.Fatalf(`Error while parsing client message: %v`, err)
+	}
+	// type assertion
+	var hsr HSR = msgr.(HSR)
+	// sanity check received data
+	assert.Equal(t, hsr.Header, msg.Header, "Header missmatch")
+	assert.Equal(t, hsr.FileID, msg.FileID, "file ID missmatch")
+	assert.Equal(t, hsr.Page, msg.Page, "page missmatch")
+
+	// trailing bytes are rejected
+	var e *WrongPacketLengthError
+	longer := append(data, 0)
+	_, err = ParseClient(&longer)
+	assert.True(t, errors.As(err, &e), "too long HSR accepted: %v", err)
+}
+
+func TestHSRR(t *testing.T) {
+	conn_server, conn_client, addr := createTestServerAndClient(t)
+	defer conn_client.Close()
+	defer conn_server.Close()
+
+	hashes := make([][32]uint8, 5)
+	for i := range hashes {
+		hashes[i] = *createRandomToken()
+	}
+	for _, proof := range [][][32]uint8{nil, hashes[:2]} {
+		msg := GetHSRR(6, NoError, 0xdeadbeef, 1, 4, 2, createRandomToken(), proof, hashes[2:])
+		err := msg.Send(conn_server, addr)
+		if err != nil {
+			t.Fatalf(`Error while sending message to client: %v`, err)
+		}
+		data, err := ClientReceive(conn_client, 10000)
+		if err != nil {
+			t.Fatalf(`Error while receiving on client: %v`, err)
+		}
+		// parse message
+		msgr, err := ParseServer(&data)
+		if err != nil {
+			t.Fatalf(`Error while parsing server message: %v`, err)
+		}
+		// type assertion
+		var hsrr HSRR = msgr.(HSRR)
+		// sanity check received data
+		assert.Equal(t, hsrr.Header, msg.Header, "Header missmatch")
+		assert.Equal(t, hsrr.FileID, msg.FileID, "file ID missmatch")
+		assert.Equal(t, hsrr.Page, msg.Page, "page missmatch")
+		assert.Equal(t, hsrr.Pages, msg.Pages, "pages missmatch")
+		assert.Equal(t, hsrr.PageSize, msg.PageSize, "page size missmatch")
+		assert.Equal(t, hsrr.Root, msg.Root, "root missmatch")
+		assert.Equal(t, len(hsrr.Proof), len(msg.Proof), "proof missmatch")
+		if len(msg.Proof) > 0 {
+			assert.Equal(t, hsrr.Proof, msg.Proof, "proof missmatch")
+		}
+		assert.Equal(t, hsrr.Leaves, msg.Leaves, "leaves missmatch")
+
+		// truncated hashes are rejected
+		var e *WrongPacketLengthError
+		truncated := data[:len(data)-1]
+		_, err = ParseServer(&truncated)
+		assert.True(t, errors.As(err, &e), "truncated hash accepted: %v", err)
+	}
+
+	// an error only has the header
+	msg := ServerHeader{Version: VERS, Type: HSRR_t, Number: 6, Error: InvalidFileID}
+	err := msg.Send(conn_server, addr)
+	if err != nil {
+		t.Fatalf(`Error while sending message to client: %v`, err)
+	}
+	data, err := ClientReceive(conn_client, 10000)
+	if err != nil {
+		t.Fatalf(`Error while receiving on client: %v`, err)
+	}
+	msgr, err := ParseServer(&data)
+	if err != nil {
+		t.Fatalf(`Error while parsing server message: %v`, err)
+	}
+	assert.Equal(t, msg, msgr.(ServerHeader), "Header missmatch")
+}
+
 // test further stuff
 
 func TestTimeout(t *testing.T) {
@@ -329,9 +498,9 @@ func TestWrongPacketType(t *testing.T) {
 		t.Fatalf(`Error should be WrongPacketLengthError but is: %v`, err)
 	}
 
-	// client header on server side
+	// client header on server side (5 is LSR_t, 7 is HSR_t)
 	data = make([]uint8, 35)
-	data[1] = 5
+	data[1] = 9
 
 	_, err = conn_client.Write(data)
 	if err != nil {
@@ -0,0 +1,391 @@
+// Package metrics collects counters, gauges and histograms and exposes them
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// Registry holds metrics by name. Registering a name again returns the
+// metric registered first, so that several servers or clients may share a
+// registry; registering it with another type or other labels panics.
+//
+// A Registry is an http.Handler serving its metrics, e.g. on /metrics.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// family is a metric with all of its label values.
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64      // upper bounds of histograms
+	fn      func() float64 // of gauge functions
+	mu      sync.Mutex
+	series  map[string]metric // by label values joined with labelSep
+}
+
+const labelSep = "\xff"
+
+type metric interface {
+	write(w *bufio.Writer, name string, labels string)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.families[f.name]; ok {
+		if old.kind != f.kind || strings.Join(old.labels, ",") != strings.Join(f.labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered as another %s", f.name, old.kind))
+		}
+		return old
+	}
+	f.series = make(map[string]metric)
+	r.families[f.name] = f
+	return f
+}
+
+// get returns the series of the label values, creating it with create.
+func (f *family) get(values []string, create func() metric) metric {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, labelSep)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.series[key]
+	if !ok {
+		m = create()
+		f.series[key] = m
+	}
+	return m
+}
+
+// Counter registers a counter.
+func (r *Registry) Counter(name string, help string) *Counter {
+	return r.CounterVec(name, help).With()
+}
+
+// CounterVec registers a counter with labels.
+func (r *Registry) CounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(&family{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+// Gauge registers a gauge.
+func (r *Registry) Gauge(name string, help string) *Gauge {
+	return r.GaugeVec(name, help).With()
+}
+
+// GaugeVec registers a gauge with labels.
+func (r *Registry) GaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(&family{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+// GaugeFunc registers a gauge whose value is returned by fn when the metrics
+// are written. fn must be safe for concurrent use.
+func (r *Registry) GaugeFunc(name string, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: kindGauge, fn: fn})
+}
+
+// Histogram registers a histogram with the given upper bounds of its
+// buckets, in increasing order.
+func (r *Registry) Histogram(name string, help string, buckets []float64) *Histogram {
+	return r.HistogramVec(name, help, buckets).With()
+}
+
+// HistogramVec registers a histogram with labels.
+func (r *Registry) HistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.register(&family{name: name, help: help, kind: kindHistogram, labels: labels,
+		buckets: buckets})}
+}
+
+// ExponentialBuckets returns count bucket bounds, the first one being start
+// and each further one factor times the previous one.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// value is a float64 that may be changed concurrently.
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (v *value) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter is a value that only increases.
+type Counter struct {
+	v value
+}
+
+// Add increases the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.v.add(delta)
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	return c.v.load()
+}
+
+func (c *Counter) write(w *bufio.Writer, name string, labels string) {
+	writeSample(w, name, labels, c.Value())
+}
+
+// CounterVec is a counter for each combination of label values.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter of the label values, in the order of the labels.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.get(values, func() metric { return new(Counter) }).(*Counter)
+}
+
+// Gauge is a value that may increase and decrease.
+type Gauge struct {
+	v value
+}
+
+func (g *Gauge) Set(x float64) {
+	atomic.StoreUint64(&g.v.bits, math.Float64bits(x))
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return g.v.load()
+}
+
+func (g *Gauge) write(w *bufio.Writer, name string, labels string) {
+	writeSample(w, name, labels, g.Value())
+}
+
+// GaugeVec is a gauge for each combination of label values.
+type GaugeVec struct {
+	f *family
+}
+
+// With returns the gauge of the label values, in the order of the labels.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.get(values, func() metric { return new(Gauge) }).(*Gauge)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+// Observe adds x to the histogram.
+func (h *Histogram) Observe(x float64) {
+	i := sort.SearchFloat64s(h.buckets, x)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += x
+	h.count++
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, labels string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	var cumulative uint64
+	for i, n := range counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = formatFloat(h.buckets[i])
+		}
+		bucketLabels := `le="` + le + `"`
+		if labels != "" {
+			bucketLabels = labels + "," + bucketLabels
+		}
+		writeSample(w, name+"_bucket", bucketLabels, float64(cumulative))
+	}
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+// HistogramVec is a histogram for each combination of label values.
+type HistogramVec struct {
+	f *family
+}
+
+// With returns the histogram of the label values, in the order of the
+// labels.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.get(values, func() metric { return newHistogram(v.f.buckets) }).(*Histogram)
+}
+
+// WriteTo writes all metrics in the text exposition format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (f *family) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	if f.fn != nil {
+		writeSample(w, f.name, "", f.fn())
+		return
+	}
+
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	series := make([]metric, len(keys))
+	sort.Strings(keys)
+	for i, key := range keys {
+		series[i] = f.series[key]
+	}
+	f.mu.Unlock()
+
+	for i, key := range keys {
+		var labels []string
+		if len(f.labels) > 0 {
+			for j, v := range strings.Split(key, labelSep) {
+				labels = append(labels, f.labels[j]+`="`+escapeLabel(v)+`"`)
+			}
+		}
+		series[i].write(w, f.name, strings.Join(labels, ","))
+	}
+}
+
+// ServeHTTP writes the metrics in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+func writeSample(w *bufio.Writer, name string, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.CounterVec("test_requests_total", "Requests received.", "type")
+	requests.With("MDR").Inc()
+	requests.With("ACR").Add(2)
+	// registering again returns the same metric
+	r.CounterVec("test_requests_total", "Requests received.", "type").With("ACR").Inc()
+	r.Gauge("test_active", "Active transfers.").Set(3)
+	r.GaugeFunc("test_files", "Files with \\ and\nnewline.", func() float64 { return 7 })
+	r.CounterVec("test_quoted_total", "Label escaping.", "uri").With("a\"b\\c").Inc()
+	h := r.Histogram("test_rate", "Packet rate.", ExponentialBuckets(1, 10, 2))
+	h.Observe(0.5)
+	h.Observe(5)
+	h.Observe(100)
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, `# HELP test_active Active transfers.
+# TYPE test_active gauge
+test_active 3
+# HELP test_files Files with \\ and\nnewline.
+# TYPE test_files gauge
+test_files 7
+# HELP test_quoted_total Label escaping.
+# TYPE test_quoted_total counter
+test_quoted_total{uri="a\"b\\c"} 1
+# HELP test_rate Packet rate.
+# TYPE test_rate histogram
+test_rate_bucket{le="1"} 1
+test_rate_bucket{le="10"} 2
+test_rate_bucket{le="+Inf"} 3
+test_rate_sum 105.5
+test_rate_count 3
+# HELP test_requests_total Requests received.
+# TYPE test_requests_total counter
+test_requests_total{type="ACR"} 3
+test_requests_total{type="MDR"} 1
+`, buf.String())
+
+	assert.Panics(t, func() { r.Gauge("test_requests_total", "") })
+	assert.Panics(t, func() { requests.With("MDR", "extra") })
+	assert.Panics(t, func() { requests.With("MDR").Add(-1) })
+}
+
+func TestHistogramLabels(t *testing.T) {
+	r := NewRegistry()
+	r.HistogramVec("test_size", "Sizes.", []float64{10}, "dir").With("in").Observe(10)
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `test_size_bucket{dir="in",le="10"} 1`)
+	assert.Contains(t, buf.String(), `test_size_bucket{dir="in",le="+Inf"} 1`)
+	assert.Contains(t, buf.String(), `test_size_count{dir="in"} 1`)
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_total", "Test.").Inc()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "test_total 1\n")
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+)
+
+// maxIdleInflaters is the number of decompressors kept per archive so that
+// consecutive ACRs for a deflated member continue where the last one stopped
+// instead of decompressing the member from the start.
+const maxIdleInflaters = 8
+
+// ArchiveStorage serves the files of another Storage and, in addition, the
+// members of the tar and zip archives in it as "archive.tar/path/inside".
+// Members of uncompressed tar archives and stored zip entries are read
+// directly from the archive; deflated zip entries are decompressed
+// sequentially, which is slow if chunks are requested out of order.
+//
+// The member index of an archive is built when it is first accessed and
+// rebuilt when the archive changes.
+type ArchiveStorage struct {
+	Storage Storage
+
+	mu      sync.Mutex
+	indexes map[string]*indexCall // by name of the archive
+}
+
+func NewArchiveStorage(st Storage) *ArchiveStorage {
+	return &ArchiveStorage{Storage: st, indexes: make(map[string]*indexCall)}
+}
+
+// indexCall builds the index of a version of an archive, shared between
+// concurrent requests for its members.
+type indexCall struct {
+	info FileInfo
+	done chan struct{} // closed when idx and err are set
+	idx  *archiveIndex
+	err  error
+}
+
+// archiveIndex lists the members of a version of an archive.
+type archiveIndex struct {
+	info    FileInfo
+	members map[string]member
+
+	mu    sync.Mutex
+	idle  []*inflateFile
+	stale bool // the archive has changed
+}
+
+type member struct {
+	offset     int64 // of the data in the archive
+	size       int64
+	compressed int64 // size in the archive if deflated
+	deflated   bool
+}
+
+func isArchive(name string) bool {
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".zip")
+}
+
+func (a *ArchiveStorage) Stat(name string) (FileInfo, error) {
+	info, err := a.Storage.Stat(name)
+	if err == nil {
+		return info, nil
+	}
+	idx, _, m, rerr := a.resolve(name)
+	if rerr != nil {
+		if errors.Is(err, errNotRegular) {
+			return FileInfo{}, err
+		}
+		return FileInfo{}, rerr
+	}
+	// members change with their archive
+	return FileInfo{Size: m.size, ModTime: idx.info.ModTime, Version: idx.info.Version, Inode: idx.info.Inode}, nil
+}
+
+func (a *ArchiveStorage) Open(name string) (File, error) {
+	if _, err := a.Storage.Stat(name); err == nil {
+		return a.Storage.Open(name)
+	}
+	idx, archive, m, err := a.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if m.deflated {
+		if f := idx.takeInflater(m); f != nil {
+			return f, nil
+		}
+	}
+	f, err := a.Storage.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	if m.deflated {
+		return &inflateFile{idx: idx, f: f, m: m}, nil
+	}
+	return sectionFile{io.NewSectionReader(f, m.offset, m.size), f}, nil
+}
+
+// resolve finds the archive member name refers to.
+func (a *ArchiveStorage) resolve(name string) (*archiveIndex, string, member, error) {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '/' || !isArchive(name[:i]) {
+			continue
+		}
+		archive := name[:i]
+		info, err := a.Storage.Stat(archive)
+		if err != nil {
+			// e.g. a directory named like an archive
+			continue
+		}
+		idx, err := a.index(archive, info)
+		if err != nil {
+			return nil, "", member{}, err
+		}
+		m, ok := idx.members[cleanMember(name[i+1:])]
+		if !ok {
+			break
+		}
+		return idx, archive, m, nil
+	}
+	return nil, "", member{}, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// index returns the member index of a version of an archive, building it if
+// necessary. Archives are indexed one request at a time each, but different
+// archives at the same time.
+func (a *ArchiveStorage) index(archive string, info FileInfo) (*archiveIndex, error) {
+	a.mu.Lock()
+	call, ok := a.indexes[archive]
+	if ok && !(call.info.Size == info.Size && call.info.ModTime.Equal(info.ModTime) && call.info.Version == info.Version && call.info.Inode == info.Inode) {
+		select {
+		case <-call.done:
+			if call.idx != nil {
+				call.idx.closeIdle()
+			}
+		default:
+			// outdated by the request building it once it is done
+		}
+		ok = false
+	}
+	if !ok {
+		call = &indexCall{info: info, done: make(chan struct{})}
+		a.indexes[archive] = call
+	}
+	a.mu.Unlock()
+
+	if !ok {
+		idx, err := a.build(archive, info)
+		a.mu.Lock()
+		call.idx, call.err = idx, err
+		if a.indexes[archive] != call {
+			// the archive changed while it was indexed
+			if idx != nil {
+				idx.closeIdle()
+			}
+		} else if err != nil {
+			// a later request starts over
+			delete(a.indexes, archive)
+		}
+		close(call.done)
+		a.mu.Unlock()
+	}
+	<-call.done
+	return call.idx, call.err
+}
+
+// build indexes the members of archive.
+func (a *ArchiveStorage) build(archive string, info FileInfo) (*archiveIndex, error) {
+	f, err := a.Storage.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var members map[string]member
+	if strings.HasSuffix(archive, ".zip") {
+		members, err = indexZip(f, info.Size)
+	} else {
+		members, err = indexTar(f, info.Size)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while indexing %v: %w", archive, err)
+	}
+	return &archiveIndex{info: info, members: members}, nil
+}
+
+func cleanMember(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+func indexTar(f io.ReaderAt, size int64) (map[string]member, error) {
+	members := make(map[string]member)
+	// tar reads the headers block by block, so after Next the section is
+	// positioned at the data of the member
+	sr := io.NewSectionReader(f, 0, size)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() || isSparse(hdr) {
+			continue
+		}
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		members[cleanMember(hdr.Name)] = member{offset: offset, size: hdr.Size}
+	}
+}
+
+// isSparse reports whether the data of a member is not stored contiguously.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func indexZip(f io.ReaderAt, size int64) (map[string]member, error) {
+	members := make(map[string]member)
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, zf := range zr.File {
+		// skip directories and encrypted entries
+		if !zf.Mode().IsRegular() || zf.Flags&0x1 != 0 {
+			continue
+		}
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		m := member{offset: offset, size: int64(zf.UncompressedSize64)}
+		switch zf.Method {
+		case zip.Store:
+		case zip.Deflate:
+			m.deflated = true
+			m.compressed = int64(zf.CompressedSize64)
+		default:
+			continue
+		}
+		members[cleanMember(zf.Name)] = m
+	}
+	return members, nil
+}
+
+// sectionFile is a member stored uncompressed in an archive.
+type sectionFile struct {
+	*io.SectionReader
+	archive File
+}
+
+func (s sectionFile) Close() error {
+	return s.archive.Close()
+}
+
+// inflateFile is a deflated member. Reading from it decompresses the member
+// up to the requested offset, restarting from the beginning when reading
+// backwards.
+type inflateFile struct {
+	idx *archiveIndex
+	f   File // the archive
+	m   member
+
+	mu  sync.Mutex
+	r   io.ReadCloser
+	pos int64 // of r in the decompressed member
+}
+
+func (z *inflateFile) ReadAt(p []byte, off int64) (int, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if off >= z.m.size {
+		return 0, io.EOF
+	}
+	if z.r == nil || off < z.pos {
+		if z.r != nil {
+			z.r.Close()
+		}
+		z.r = flate.NewReader(io.NewSectionReader(z.f, z.m.offset, z.m.compressed))
+		z.pos = 0
+	}
+	if off > z.pos {
+		n, err := io.CopyN(io.Discard, z.r, off-z.pos)
+		z.pos += n
+		if err != nil {
+			z.r = nil
+			return 0, fmt.Errorf("error while decompressing: %w", err)
+		}
+	}
+	n, err := io.ReadFull(z.r, p)
+	z.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	} else if err != nil && err != io.EOF {
+		z.r = nil
+	}
+	return n, err
+}
+
+// Close keeps the decompressor for the next Open of the member.
+func (z *inflateFile) Close() error {
+	return z.idx.releaseInflater(z)
+}
+
+// takeInflater returns an idle decompressor of m, if there is one.
+func (idx *archiveIndex) takeInflater(m member) *inflateFile {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for i, z := range idx.idle {
+		if z.m == m {
+			idx.idle = append(idx.idle[:i], idx.idle[i+1:]...)
+			return z
+		}
+	}
+	return nil
+}
+
+func (idx *archiveIndex) releaseInflater(z *inflateFile) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.stale {
+		return z.close()
+	}
+	if len(idx.idle) == maxIdleInflaters {
+		// drop the oldest
+		idx.idle[0].close()
+		idx.idle = idx.idle[1:]
+	}
+	idx.idle = append(idx.idle, z)
+	return nil
+}
+
+// closeIdle closes the idle decompressors of an outdated index.
+func (idx *archiveIndex) closeIdle() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, z := range idx.idle {
+		z.close()
+	}
+	idx.idle = nil
+	idx.stale = true
+}
+
+func (z *inflateFile) close() error {
+	if z.r != nil {
+		z.r.Close()
+	}
+	return z.f.Close()
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/logging"
+)
+
+// Config holds all parameters of a server. It can be read from a JSON file
+// whose keys are named like the long command line flags, except markov-p and
+// markov-q for -p and -q, e.g.
+//
+//	{"host": "127.0.0.1", "port": 1337, "file-dir": "/srv/", "log-level": "debug"}
+//
+// Keys missing from the file keep their default value.
+type Config struct {
+	Host           string  `json:"host"`
+	Port           int     `json:"port"`
+	RootDir        string  `json:"file-dir"`
+	ChunkSize      uint16  `json:"chunk-size"`
+	MaxChunksInACR uint16  `json:"max-chunks-in-acr"`
+	RateIncrease   float64 `json:"rate-increase"`
+	MarkovP        float64 `json:"markov-p"`
+	MarkovQ        float64 `json:"markov-q"`
+	// Further IP addresses to listen on, see Server.Listen. An empty Host or
+	// "::" listens on all IPv4 and IPv6 addresses.
+	Listen []string `json:"listen"`
+	// Serve the members of tar and zip archives
+	Archives bool `json:"archives"`
+	// see Resolver
+	Hidden bool     `json:"hidden"`
+	Allow  []string `json:"allow"`
+	Deny   []string `json:"deny"`
+	// One of SymlinkPolicies
+	Symlinks string `json:"symlinks"`
+	// see Server.IndexFile
+	Index string `json:"index"`
+	// see Server.Prehash and Server.RescanInterval, e.g. "10m"; empty or
+	// "0" to never rescan
+	Prehash        bool   `json:"prehash"`
+	RescanInterval string `json:"rescan-interval"`
+	// Number of files hashed at the same time
+	HashWorkers int `json:"hash-workers"`
+	// Largest number of chunks of a file whose Merkle tree is sent in HSRRs
+	MaxTreeChunks int64 `json:"max-tree-chunks"`
+	// see Limits
+	RateLimit       float64 `json:"rate-limit"`
+	ClientRateLimit float64 `json:"client-rate-limit"`
+	MaxACRs         int     `json:"max-acrs"`
+	DropWhenBusy    bool    `json:"drop-when-busy"`
+	// Address to serve Server.Metrics on over HTTP, e.g. "localhost:9090";
+	// empty to not serve them
+	MetricsAddr string `json:"metrics-addr"`
+	// One of logging.Levels and logging.Formats
+	LogLevel  string `json:"log-level"`
+	LogFormat string `json:"log-format"`
+	// File the access log is appended to, "-" for stderr; empty for no
+	// access log
+	AccessLog string `json:"access-log"`
+	// see Server.UseKeyFile; empty to create a random key on start
+	KeyFile string `json:"key-file"`
+	// see Server.KeyOverlap, e.g. "10m"; empty or "0" to reject tokens of
+	// the previous key right after a rotation
+	KeyOverlap string `json:"key-overlap"`
+}
+
+var DefaultConfig = Config{
+	Port:           1337,
+	RootDir:        "./",
+	ChunkSize:      4048,
+	MaxChunksInACR: 128,
+	RateIncrease:   256,
+	Symlinks:       "inside",
+	HashWorkers:    DefaultHashWorkers,
+	MaxTreeChunks:  DefaultMaxTreeChunks,
+	LogLevel:       "info",
+	LogFormat:      "text",
+	KeyOverlap:     DefaultKeyOverlap.String(),
+}
+
+// LoadConfig reads a config file, using DefaultConfig for missing keys.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening config file: %w", err)
+	}
+	defer f.Close()
+	return ReadConfig(f)
+}
+
+// ReadConfig parses a JSON config, using DefaultConfig for missing keys.
+func ReadConfig(r io.Reader) (*Config, error) {
+	conf := DefaultConfig
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("error while parsing config: %w", err)
+	}
+	if err := conf.check(); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// check validates the values that Init does not check.
+func (conf *Config) check() error {
+	if conf.Host != "" && net.ParseIP(conf.Host) == nil {
+		return fmt.Errorf("invalid host IP: %v", conf.Host)
+	}
+	for _, host := range conf.Listen {
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid listen IP: %v", host)
+		}
+	}
+	if conf.RootDir == "" {
+		return fmt.Errorf("file-dir cannot be empty")
+	}
+	if conf.RateIncrease < 0 {
+		return fmt.Errorf("rate-increase cannot be negative")
+	}
+	if err := CheckPatterns(conf.Allow); err != nil {
+		return err
+	}
+	if err := CheckPatterns(conf.Deny); err != nil {
+		return err
+	}
+	if _, err := ParseSymlinkPolicy(conf.Symlinks); err != nil {
+		return err
+	}
+	if _, err := conf.rescanInterval(); err != nil {
+		return err
+	}
+	if _, err := conf.keyOverlap(); err != nil {
+		return err
+	}
+	if conf.HashWorkers < 1 {
+		return fmt.Errorf("hash-workers must be at least 1")
+	}
+	if conf.MaxTreeChunks < 1 {
+		return fmt.Errorf("max-tree-chunks must be at least 1")
+	}
+	if conf.RateLimit < 0 || conf.ClientRateLimit < 0 || conf.MaxACRs < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	if !contains(logging.Formats, conf.LogFormat) {
+		return fmt.Errorf("invalid log format %q, must be one of %v", conf.LogFormat, strings.Join(logging.Formats, ", "))
+	}
+	if !contains(logging.Levels, conf.LogLevel) {
+		return fmt.Errorf("invalid log level %q, must be one of %v", conf.LogLevel, strings.Join(logging.Levels, ", "))
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// New creates a server from conf. A missing trailing slash is added to
+// conf.RootDir.
+func New(conf *Config) (*Server, error) {
+	if err := conf.check(); err != nil {
+		return nil, err
+	}
+	s, err := initServer(net.ParseIP(conf.Host), conf.Port, withSlash(conf.RootDir), conf.ChunkSize,
+		conf.MaxChunksInACR, conf.MarkovP, conf.MarkovQ, conf.RateIncrease, conf.HashWorkers)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range conf.Listen {
+		if err := s.Listen(net.ParseIP(host), conf.Port); err != nil {
+			s.Conn.Close()
+			return nil, err
+		}
+	}
+	s.conf = *conf
+	s.Archives = conf.Archives
+	s.Resolver = conf.resolver()
+	s.Symlinks, _ = ParseSymlinkPolicy(conf.Symlinks)
+	s.Logger = logging.New(os.Stderr, conf.LogFormat, &s.logLevel)
+	s.SetLogLevel(conf.LogLevel)
+	if conf.AccessLog != "" {
+		if err := s.openAccessLog(conf.AccessLog, conf.LogFormat); err != nil {
+			s.Conn.Close()
+			return nil, err
+		}
+	}
+	s.KeyOverlap, _ = conf.keyOverlap()
+	if conf.KeyFile != "" {
+		if err := s.UseKeyFile(conf.KeyFile); err != nil {
+			s.Conn.Close()
+			return nil, err
+		}
+	}
+	s.IndexFile = conf.Index
+	s.Prehash = conf.Prehash
+	s.RescanInterval, _ = conf.rescanInterval()
+	s.trees = newTreeCache(conf.MaxTreeChunks)
+	s.SetLimits(conf.limits())
+	if err := s.LoadIndex(); err != nil {
+		// the files are hashed again when requested
+		s.Logger.Warn("Ignoring index", "err", err)
+	}
+	return s, nil
+}
+
+// Reload applies the parameters of conf which can be changed while serving:
+// the served directory, which files in it are served, the rate increase, the
+// maximum number of chunks in an ACR, the limits and the log level. Requests in progress
+// are not affected. Changes to other parameters only take effect after a
+// restart and are reported as a warning.
+func (s *Server) Reload(conf *Config) error {
+	if err := conf.check(); err != nil {
+		return err
+	}
+	rootDir := withSlash(conf.RootDir)
+	if _, err := os.Stat(rootDir); err != nil {
+		return fmt.Errorf("root_dir does not exist: %w", err)
+	}
+	if conf.MaxChunksInACR == 0 {
+		return fmt.Errorf("max_chunks_in_acr cannot be 0")
+	}
+
+	s.mu.Lock()
+	old := s.conf
+	s.RootDir = rootDir
+	s.MaxChunksInACR = conf.MaxChunksInACR
+	s.RateIncrease = conf.RateIncrease
+	s.Archives = conf.Archives
+	s.Resolver = conf.resolver()
+	s.Symlinks, _ = ParseSymlinkPolicy(conf.Symlinks)
+	s.conf = *conf
+	s.mu.Unlock()
+	s.SetLogLevel(conf.LogLevel)
+	s.SetLimits(conf.limits())
+
+	if conf.Host != old.Host || conf.Port != old.Port || strings.Join(conf.Listen, ",") != strings.Join(old.Listen, ",") {
+		s.Logger.Warn("Changing the address requires a restart")
+	}
+	if conf.ChunkSize != old.ChunkSize {
+		s.Logger.Warn("Changing the chunk size requires a restart")
+	}
+	if conf.MetricsAddr != old.MetricsAddr {
+		s.Logger.Warn("Changing the metrics address requires a restart")
+	}
+	if conf.LogFormat != old.LogFormat || conf.AccessLog != old.AccessLog {
+		s.Logger.Warn("Changing the log format or the access log requires a restart")
+	}
+	if conf.KeyFile != old.KeyFile || conf.KeyOverlap != old.KeyOverlap {
+		s.Logger.Warn("Changing the token keys requires a restart")
+	}
+	if conf.Index != old.Index {
+		s.Logger.Warn("Changing the index file requires a restart")
+	}
+	if conf.Prehash != old.Prehash || conf.RescanInterval != old.RescanInterval || conf.HashWorkers != old.HashWorkers ||
+		conf.MaxTreeChunks != old.MaxTreeChunks {
+		s.Logger.Warn("Changing the hashing of files requires a restart")
+	}
+	if conf.MarkovP != old.MarkovP || conf.MarkovQ != old.MarkovQ {
+		s.Logger.Warn("Changing the markov chain requires a restart")
+	}
+	s.Logger.Info("Configuration reloaded", "dir", rootDir)
+	return nil
+}
+
+// SetLogLevel makes the default logger log messages of level and above.
+// Unknown levels are treated as "info".
+func (s *Server) SetLogLevel(level string) {
+	s.logLevel.Set(logging.ParseLevel(level))
+}
+
+// openAccessLog makes the server append its access log to the file path, or
+// write it to stderr if path is "-". The file is closed by Shutdown.
+func (s *Server) openAccessLog(path string, format string) error {
+	if path == "-" {
+		s.AccessLog = logging.New(os.Stderr, format, slog.LevelInfo)
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error while opening access log: %w", err)
+	}
+	s.AccessLog = logging.New(f, format, slog.LevelInfo)
+	s.accessLogFile = f
+	return nil
+}
+
+func (conf *Config) rescanInterval() (time.Duration, error) {
+	if conf.RescanInterval == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(conf.RescanInterval)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid rescan-interval %q", conf.RescanInterval)
+	}
+	return d, nil
+}
+
+func (conf *Config) keyOverlap() (time.Duration, error) {
+	if conf.KeyOverlap == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(conf.KeyOverlap)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid key-overlap %q", conf.KeyOverlap)
+	}
+	return d, nil
+}
+
+func (conf *Config) limits() Limits {
+	return Limits{Rate: conf.RateLimit, ClientRate: conf.ClientRateLimit, MaxACRs: conf.MaxACRs,
+		DropWhenBusy: conf.DropWhenBusy}
+}
+
+func (conf *Config) resolver() Resolver {
+	return Resolver{Hidden: conf.Hidden, Allow: conf.Allow, Deny: conf.Deny}
+}
+
+func withSlash(dir string) string {
+	if !strings.HasSuffix(dir, "/") {
+		return dir + "/"
+	}
+	return dir
+}
+
+// the parameters that may be changed by Reload
+
+func (s *Server) rootDir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.RootDir
+}
+
+func (s *Server) maxChunksInACR() uint16 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.MaxChunksInACR
+}
+
+func (s *Server) rateIncrease() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.RateIncrease
+}
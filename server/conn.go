@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxRoutes is the number of client addresses multiConn remembers the
+// socket of. The routes are cleared when there are more.
+const maxRoutes = 1 << 16
+
+// multiConn receives the datagrams of several sockets, e.g. an IPv4 and an
+// IPv6 one, as a single net.PacketConn. Responses to a client are sent from
+// the socket its last request was received on, so that they come from the
+// address the client sent to.
+type multiConn struct {
+	packets chan packet
+	closed  chan struct{}
+	once    sync.Once
+
+	mu     sync.Mutex
+	conns  []net.PacketConn
+	routes map[string]net.PacketConn // by client address
+
+	deadlineMu      sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{} // Closed when deadline is modified
+}
+
+// packet is a datagram, or an error, received on conn.
+type packet struct {
+	data []byte
+	addr net.Addr
+	conn net.PacketConn
+	err  error
+}
+
+func newMultiConn(conn net.PacketConn) *multiConn {
+	m := &multiConn{
+		packets:         make(chan packet),
+		closed:          make(chan struct{}),
+		routes:          make(map[string]net.PacketConn),
+		deadlineChanged: make(chan struct{}),
+	}
+	m.add(conn)
+	return m
+}
+
+// add receives the datagrams of conn too.
+func (m *multiConn) add(conn net.PacketConn) {
+	m.mu.Lock()
+	m.conns = append(m.conns, conn)
+	m.mu.Unlock()
+	go m.receive(conn)
+}
+
+// receive passes the datagrams of conn to ReadFrom until conn is closed.
+func (m *multiConn) receive(conn net.PacketConn) {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		p := packet{addr: addr, conn: conn, err: err}
+		if err == nil {
+			p.data = make([]byte, n)
+			copy(p.data, buffer[:n])
+		}
+		select {
+		case m.packets <- p:
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+// errDeadlineChanged makes ReadFrom wait again with the new deadline.
+var errDeadlineChanged = errors.New("deadline changed")
+
+func (m *multiConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := m.readFrom(p)
+		if err != errDeadlineChanged {
+			return n, addr, err
+		}
+	}
+}
+
+func (m *multiConn) readFrom(p []byte) (int, net.Addr, error) {
+	m.deadlineMu.Lock()
+	deadline := m.deadline
+	changed := m.deadlineChanged
+	m.deadlineMu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-m.packets:
+		if pkt.err != nil {
+			return 0, pkt.addr, pkt.err
+		}
+		m.route(pkt.addr, pkt.conn)
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-changed:
+		return 0, nil, errDeadlineChanged
+	case <-m.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// route remembers that responses to addr are sent on conn.
+func (m *multiConn) route(addr net.Addr, conn net.PacketConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.conns) == 1 {
+		return
+	}
+	key := addr.String()
+	if m.routes[key] == conn {
+		return
+	}
+	if len(m.routes) >= maxRoutes {
+		m.routes = make(map[string]net.PacketConn)
+	}
+	m.routes[key] = conn
+}
+
+// connTo returns the socket to send to addr on: the one a request of addr was
+// last received on, or else the first one of the address family of addr.
+func (m *multiConn) connTo(addr net.Addr) net.PacketConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.conns) == 1 {
+		return m.conns[0]
+	}
+	if conn, ok := m.routes[addr.String()]; ok {
+		return conn
+	}
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		for _, conn := range m.conns {
+			if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && canReach(local.IP, udp.IP) {
+				return conn
+			}
+		}
+	}
+	return m.conns[0]
+}
+
+// canReach reports whether a socket bound to local can send to remote.
+func canReach(local net.IP, remote net.IP) bool {
+	if local == nil || local.Equal(net.IPv6unspecified) {
+		// dual stack
+		return true
+	}
+	return (local.To4() != nil) == (remote.To4() != nil)
+}
+
+func (m *multiConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return m.connTo(addr).WriteTo(p, addr)
+}
+
+// Close closes all sockets.
+func (m *multiConn) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.closed)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, conn := range m.conns {
+			if cerr := conn.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// LocalAddr returns the address of the first socket.
+func (m *multiConn) LocalAddr() net.Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conns[0].LocalAddr()
+}
+
+// LocalAddrs returns the addresses of all sockets.
+func (m *multiConn) LocalAddrs() []net.Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addrs := make([]net.Addr, len(m.conns))
+	for i, conn := range m.conns {
+		addrs[i] = conn.LocalAddr()
+	}
+	return addrs
+}
+
+func (m *multiConn) SetDeadline(t time.Time) error {
+	m.SetReadDeadline(t)
+	return m.SetWriteDeadline(t)
+}
+
+func (m *multiConn) SetReadDeadline(t time.Time) error {
+	m.deadlineMu.Lock()
+	m.deadline = t
+	close(m.deadlineChanged)
+	m.deadlineChanged = make(chan struct{})
+	m.deadlineMu.Unlock()
+	return nil
+}
+
+func (m *multiConn) SetWriteDeadline(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conn := range m.conns {
+		if err := conn.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
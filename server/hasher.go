@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+// DefaultHashWorkers is the number of files hashed at the same time unless
+// configured otherwise.
+const DefaultHashWorkers = 2
+
+// mdrHashWait is how long an MDR for a file that is not registered yet waits
+// for its checksum. It is shorter than the initial timeout of the client
+// (spec 4.1), so that small files are answered right away, while the MDR for
+// a large file is answered once the client retransmits it.
+var mdrHashWait = time.Second
+
+// errStillHashing is logged for MDRs not answered because the file is still
+// being hashed.
+var errStillHashing = errors.New("file is still being hashed")
+
+// maxScanDepth limits the depth of the directories scanned, as symbolic links
+// may form cycles.
+const maxScanDepth = 32
+
+// hasher computes the checksums of files with a bounded number of workers.
+// Concurrent requests for the same version of a file share one computation.
+type hasher struct {
+	workers chan struct{} // one token per running worker
+
+	mu         sync.Mutex
+	inflight   map[hashKey]*hashCall
+	background map[hashKey]*registerCall // see Server.registerBackground
+}
+
+// hashKey identifies a version of a file.
+type hashKey struct {
+	path    string
+	modTime int64
+	size    int64
+	inode   uint64
+	version string
+}
+
+type hashCall struct {
+	done     chan struct{} // closed when sum and err are set
+	sum      *[32]uint8
+	err      error
+	refs     int // number of waiting callers
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+type registerCall struct {
+	done   chan struct{} // closed when fileid, filem and err are set
+	fileid uint32
+	filem  FileM
+	err    error
+}
+
+func newHasher(workers int) *hasher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &hasher{workers: make(chan struct{}, workers), inflight: make(map[hashKey]*hashCall),
+		background: make(map[hashKey]*registerCall)}
+}
+
+func newHashKey(path string, info FileInfo) hashKey {
+	return hashKey{path: path, modTime: info.ModTime.UnixNano(), size: info.Size, inode: info.Inode, version: info.Version}
+}
+
+// checksum returns the checksum of the version info of the file name in st,
+// which is registered as path. It waits for a free worker unless the same
+// file is already being hashed. The computation is only aborted once the
+// contexts of all callers waiting for it are done.
+func (h *hasher) checksum(ctx context.Context, st Storage, name string, path string, info FileInfo) (*[32]uint8, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := newHashKey(path, info)
+	h.mu.Lock()
+	call, ok := h.inflight[key]
+	if !ok {
+		hashCtx, cancel := context.WithCancel(context.Background())
+		call = &hashCall{done: make(chan struct{}), cancel: cancel}
+		h.inflight[key] = call
+		go h.run(hashCtx, key, call, st, name, info.Size)
+	}
+	call.refs++
+	h.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.sum, call.err
+	case <-ctx.Done():
+		h.mu.Lock()
+		call.refs--
+		if call.refs == 0 && !call.canceled {
+			call.canceled = true
+			call.cancel()
+			// a later request starts over
+			delete(h.inflight, key)
+		}
+		h.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (h *hasher) run(ctx context.Context, key hashKey, call *hashCall, st Storage, name string, size int64) {
+	defer call.cancel()
+	select {
+	case h.workers <- struct{}{}:
+		call.sum, call.err = storageChecksum(ctx, st, name, size)
+		<-h.workers
+	case <-ctx.Done():
+		call.err = ctx.Err()
+	}
+	h.mu.Lock()
+	if h.inflight[key] == call {
+		delete(h.inflight, key)
+	}
+	h.mu.Unlock()
+	close(call.done)
+}
+
+// register returns the file ID of the version info of the file name in st,
+// hashing and registering it if it is new.
+func (s *Server) register(ctx context.Context, st Storage, name string, path string, info FileInfo) (uint32, FileM, error) {
+	if fileid, filem, ok := s.Files.Lookup(path, info); ok {
+		s.metrics.checksumHits.Inc()
+		return fileid, filem, nil
+	}
+	s.metrics.checksumMisses.Inc()
+	// compute the checksum without holding the registry
+	checksum, err := s.hashes.checksum(ctx, st, name, path, info)
+	if err != nil {
+		return 0, FileM{}, err
+	}
+	fileid, filem := s.Files.Register(FileM{Path: path, T: info.ModTime, Version: info.Version,
+		Size: info.Size, Inode: info.Inode, Storage: st, Name: name, Checksum: checksum})
+	s.indexChanged()
+	return fileid, filem, nil
+}
+
+// registerBackground is like register, but waits at most wait for the
+// checksum of a new file and returns errStillHashing if it is not ready by
+// then. The file is still hashed and registered until Shutdown, once no
+// matter how often it is requested, so that the retransmitted request finds
+// it registered.
+func (s *Server) registerBackground(st Storage, name string, path string, info FileInfo, wait time.Duration) (uint32, FileM, error) {
+	if fileid, filem, ok := s.Files.Lookup(path, info); ok {
+		s.metrics.checksumHits.Inc()
+		return fileid, filem, nil
+	}
+	key := newHashKey(path, info)
+	s.hashes.mu.Lock()
+	call, ok := s.hashes.background[key]
+	if !ok {
+		call = &registerCall{done: make(chan struct{})}
+		s.hashes.background[key] = call
+		s.lifecycle.handlers.Add(1)
+		go func() {
+			defer s.lifecycle.handlers.Done()
+			ctx, cancel := s.lifecycle.context(context.Background())
+			defer cancel()
+			call.fileid, call.filem, call.err = s.register(ctx, st, name, path, info)
+			s.hashes.mu.Lock()
+			delete(s.hashes.background, key)
+			s.hashes.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	s.hashes.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		return call.fileid, call.filem, call.err
+	case <-timer.C:
+		return 0, FileM{}, errStillHashing
+	}
+}
+
+// watch scans the served files until ctx is done: once if RescanInterval is
+// 0, otherwise every RescanInterval.
+func (s *Server) watch(ctx context.Context) {
+	defer s.lifecycle.handlers.Done()
+	for {
+		start := time.Now()
+		hashed, err := s.scan(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.Logger.Warn("Error while scanning", "err", err)
+		}
+		s.Logger.Info("Scan finished", "duration", time.Since(start).Round(time.Millisecond), "hashed", hashed)
+		if s.RescanInterval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.RescanInterval):
+		}
+	}
+}
+
+// scan hashes and registers the served files that are not registered yet and
+// removes registered files that changed or no longer exist. It returns the
+// number of files hashed.
+func (s *Server) scan(ctx context.Context) (int, error) {
+	st, prefix, resolver := s.storageRoot()
+	l, ok := st.(Lister)
+	if !ok {
+		return 0, errNotLister
+	}
+
+	// forget outdated files so that the index does not grow forever
+	files, _ := s.Files.snapshot()
+	for id, f := range files {
+		if f.Storage == nil || f.Path != prefix+f.Name {
+			continue
+		}
+		if info, err := f.Storage.Stat(f.Name); err != nil || !f.matches(info) {
+			s.Files.Delete(id, f)
+		}
+	}
+
+	hashed := 0
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		if depth > maxScanDepth {
+			return fmt.Errorf("directories nested deeper than %d in %q", maxScanDepth, dir)
+		}
+		entries, err := l.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			name := path.Join(dir, e.Name)
+			if !resolver.Serves(name, e.Dir) {
+				continue
+			}
+			if e.Dir {
+				if err := walk(name, depth+1); err != nil {
+					s.Logger.Debug("Cannot scan directory", "name", name, "err", err)
+				}
+				continue
+			}
+			info, err := st.Stat(name)
+			if err != nil {
+				continue
+			}
+			if _, _, ok := s.Files.Lookup(prefix+name, info); ok {
+				continue
+			}
+			if _, _, err := s.register(ctx, st, name, prefix+name, info); err != nil {
+				s.Logger.Debug("Cannot hash file", "name", name, "err", err)
+				continue
+			}
+			hashed++
+		}
+		return nil
+	}
+	err := walk("", 0)
+	s.indexChanged()
+	return hashed, err
+}
+
+// ctxReader stops reading once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// storageChecksum computes the SHA-256 checksum of a file in st.
+func storageChecksum(ctx context.Context, st Storage, name string, size int64) (*[32]uint8, error) {
+	f, err := st.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening file: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, ctxReader{ctx, io.NewSectionReader(f, 0, size)}); err != nil {
+		return nil, fmt.Errorf("error while copying from file: %w", err)
+	}
+	checksum := h.Sum(nil)
+	return (*[32]uint8)(checksum), nil
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/logging"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/merkle"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
+)
+
+// DefaultMaxTreeChunks is the largest number of chunks of a file whose Merkle
+// tree is built unless configured otherwise, like the default limit of the
+// client.
+const DefaultMaxTreeChunks = 1 << 22
+
+// treeCacheFactor is the number of trees of the largest size that fit into
+// the cache at the same time. The leaves of all cached trees, including those
+// being built, are bounded by treeCacheFactor times the largest size; the
+// least recently used trees are dropped to make room for a new one.
+const treeCacheFactor = 4
+
+// hsrTreeWait is how long an HSR waits for the Merkle tree of a file that is
+// being built before it is answered with a Not Ready error. It is far shorter
+// than the minimum timeout of the client, which requests the page again.
+var hsrTreeWait = 100 * time.Millisecond
+
+// errTreeTooLarge and errTreeNotReady are logged for HSRs answered with the
+// corresponding errors.
+var (
+	errTreeTooLarge = errors.New("file has too many chunks for a Merkle tree")
+	errTreeNotReady = errors.New("Merkle tree is still being built")
+)
+
+// treeCache builds the Merkle trees over the chunks of files, sharing one
+// build between concurrent requests for the same version of a file.
+type treeCache struct {
+	maxChunks int64 // of a single tree
+
+	mu        sync.Mutex
+	trees     map[hashKey]*treeCall
+	leaves    int64 // of all trees in trees
+	maxLeaves int64
+}
+
+type treeCall struct {
+	done   chan struct{} // closed when tree and err are set
+	tree   *merkle.Tree  // nil for an empty file
+	err    error
+	leaves int64
+	used   time.Time
+}
+
+func newTreeCache(maxChunks int64) *treeCache {
+	return &treeCache{maxChunks: maxChunks, maxLeaves: treeCacheFactor * maxChunks,
+		trees: make(map[hashKey]*treeCall)}
+}
+
+// merkleTree returns the Merkle tree over the chunks of the file registered
+// as filem. If it is not cached, it is built with one of the hash workers in
+// the background. errTreeNotReady is returned if the tree is not built within
+// wait, or the cache is full of trees being built, errTreeTooLarge if the
+// file has more chunks than a tree is built for.
+func (s *Server) merkleTree(ctx context.Context, filem FileM, wait time.Duration) (*merkle.Tree, error) {
+	c := s.trees
+	leaves := Ceil(filem.Size, int64(s.ChunkSize))
+	if leaves > c.maxChunks {
+		return nil, errTreeTooLarge
+	}
+	key := hashKey{path: filem.Path, modTime: filem.T.UnixNano(), size: filem.Size, inode: filem.Inode, version: filem.Version}
+	c.mu.Lock()
+	call, ok := c.trees[key]
+	if !ok {
+		for c.leaves+leaves > c.maxLeaves && c.evict() {
+		}
+		if c.leaves+leaves > c.maxLeaves {
+			c.mu.Unlock()
+			return nil, errTreeNotReady
+		}
+		call = &treeCall{done: make(chan struct{}), leaves: leaves}
+		c.trees[key] = call
+		c.leaves += leaves
+		go s.buildTree(key, call, filem)
+	}
+	call.used = time.Now()
+	c.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		return call.tree, call.err
+	case <-timer.C:
+		return nil, errTreeNotReady
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// evict drops the least recently used tree that has been built and reports
+// whether there was one. c.mu must be held.
+func (c *treeCache) evict() bool {
+	var oldest hashKey
+	var used time.Time
+	for key, call := range c.trees {
+		select {
+		case <-call.done:
+		default:
+			continue
+		}
+		if used.IsZero() || call.used.Before(used) {
+			oldest, used = key, call.used
+		}
+	}
+	if used.IsZero() {
+		return false
+	}
+	c.remove(oldest, c.trees[oldest])
+	return true
+}
+
+// remove drops call from the cache unless it has been replaced. c.mu must be
+// held.
+func (c *treeCache) remove(key hashKey, call *treeCall) {
+	if c.trees[key] == call {
+		delete(c.trees, key)
+		c.leaves -= call.leaves
+	}
+}
+
+func (s *Server) buildTree(key hashKey, call *treeCall, filem FileM) {
+	ctx, cancel := s.lifecycle.context(context.Background())
+	defer cancel()
+	select {
+	case s.hashes.workers <- struct{}{}:
+		call.tree, call.err = storageTree(ctx, filem.Storage, filem.Name, filem.Size, int64(s.ChunkSize))
+		<-s.hashes.workers
+	case <-ctx.Done():
+		call.err = ctx.Err()
+	}
+	if call.err != nil {
+		// a later request starts over
+		s.trees.mu.Lock()
+		s.trees.remove(key, call)
+		s.trees.mu.Unlock()
+	}
+	close(call.done)
+}
+
+// storageTree computes the Merkle tree over the chunks of a file in st, nil
+// if the file is empty.
+func storageTree(ctx context.Context, st Storage, name string, size int64, chunkSize int64) (*merkle.Tree, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	f, err := st.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening file: %w", err)
+	}
+	defer f.Close()
+	leaves := make([][merkle.Size]byte, Ceil(size, chunkSize))
+	r := ctxReader{ctx, io.NewSectionReader(f, 0, size)}
+	buf := make([]byte, chunkSize)
+	for i := range leaves {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !(err == io.ErrUnexpectedEOF && i == len(leaves)-1) {
+			return nil, fmt.Errorf("error while reading from file: %w", err)
+		}
+		leaves[i] = merkle.LeafHash(buf[:n])
+	}
+	return merkle.New(leaves), nil
+}
+
+// hashPageSize returns the number of leaves per HSRR, so that the leaves
+// take no more space than a chunk.
+func (s *Server) hashPageSize() int {
+	return merkle.PageSize(int(s.ChunkSize) / merkle.Size)
+}
+
+func (s *Server) handleHSR(msg messages.HSR, addr net.Addr) {
+	// - HSR: check token, check file id, send the requested page of the Merkle tree
+	s.Logger.Info("HSR", "client", addr.String(), "file_id", logging.FileID(msg.FileID), "page", msg.Page)
+	a := s.access("HSR", addr)
+	a.fileID = &msg.FileID
+	defer s.logAccess(a)
+	if !s.checkToken(addr, &msg.Header.Token) {
+		s.Logger.Debug("Invalid token in HSR, sending new token", "client", addr.String())
+		a.status = statusInvalidToken
+		s.sendNTM(msg.Header.Number, messages.NoError, addr)
+		return
+	}
+	sendError := func(code uint8) {
+		msg := messages.ServerHeader{Version: messages.VERS, Type: messages.HSRR_t,
+			Number: msg.Header.Number, Error: code}
+		msg.Send(s.Conn, addr)
+	}
+
+	filem, ok := s.Files.Get(msg.FileID)
+	if !ok {
+		s.Logger.Debug("File ID does not exist", "file_id", logging.FileID(msg.FileID))
+		a.status = statusInvalidFileID
+		sendError(messages.InvalidFileID)
+		return
+	}
+	a.file = filem.Name
+	if file, err := filem.Storage.Stat(filem.Name); err != nil || !filem.matches(file) {
+		s.Logger.Debug("File ID does no longer exist", "file_id", logging.FileID(msg.FileID))
+		a.status = statusInvalidFileID
+		s.Files.Delete(msg.FileID, filem)
+		sendError(messages.InvalidFileID)
+		return
+	}
+
+	size := s.hashPageSize()
+	pages := merkle.Pages(int(Ceil(filem.Size, int64(s.ChunkSize))), size)
+	if int64(msg.Page) >= int64(pages) {
+		s.Logger.Debug("Page out of bounds", "client", addr.String(), "page", msg.Page)
+		a.status = statusPageOutOfBounds
+		sendError(messages.PageOutOfBounds)
+		return
+	}
+
+	ctx, cancel := s.lifecycle.context(context.Background())
+	defer cancel()
+	tree, err := s.merkleTree(ctx, filem, hsrTreeWait)
+	switch {
+	case errors.Is(err, errTreeTooLarge):
+		s.Logger.Debug("Refusing to build Merkle tree", "file_id", logging.FileID(msg.FileID), "err", err)
+		a.status = statusTreeTooLarge
+		sendError(messages.TreeTooLarge)
+		return
+	case errors.Is(err, errTreeNotReady):
+		s.Logger.Debug("Merkle tree not ready", "file_id", logging.FileID(msg.FileID))
+		a.status = statusTreeNotReady
+		sendError(messages.TreeNotReady)
+		return
+	case err != nil:
+		s.Logger.Debug("Cannot build Merkle tree", "file_id", logging.FileID(msg.FileID), "err", err)
+		a.err = err
+		return
+	}
+	root := tree.Root()
+	leaves, proof := tree.Page(int(msg.Page), size)
+	hsrr := messages.GetHSRR(msg.Header.Number, messages.NoError, msg.FileID, msg.Page, uint32(pages),
+		uint32(size), &root, proof, leaves)
+	if err = hsrr.Send(s.Conn, addr); err != nil {
+		s.Logger.Warn("Cannot send HSRR", "client", addr.String(), "err", err)
+		a.err = err
+	}
+}
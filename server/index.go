@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// indexSaveDelay is the time between the registration of a file and saving
+// the index, so that a burst of new files is saved at once.
+const indexSaveDelay = 5 * time.Second
+
+const indexVersion = 1
+
+// indexFile is the on-disk format of the file registry.
+type indexFile struct {
+	Version int          `json:"version"`
+	Files   []indexEntry `json:"files"`
+}
+
+type indexEntry struct {
+	ID       uint32 `json:"id"`
+	Try      int    `json:"try"`
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime"` // in nanoseconds since the epoch
+	Inode    uint64 `json:"inode,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Checksum string `json:"checksum"` // hex encoded SHA-256
+}
+
+// fileIndex holds the state of the persistent copy of the file registry.
+type fileIndex struct {
+	mu    sync.Mutex
+	saved uint64 // generation of the registry last saved
+	timer *time.Timer
+}
+
+// LoadIndex registers the files in IndexFile, so that files which have not
+// changed since they were saved keep their file ID and are not hashed again.
+// Files registered under another root directory are ignored. A missing index
+// file is not an error.
+func (s *Server) LoadIndex() error {
+	if s.IndexFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.IndexFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while reading index: %w", err)
+	}
+	var index indexFile
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("error while parsing index %v: %w", s.IndexFile, err)
+	}
+	if index.Version != indexVersion {
+		return fmt.Errorf("unsupported index version %d", index.Version)
+	}
+
+	st, prefix, _ := s.storageRoot()
+	loaded := 0
+	for _, e := range index.Files {
+		if e.Path != prefix+e.Name {
+			continue
+		}
+		sum, err := hex.DecodeString(e.Checksum)
+		if err != nil || len(sum) != 32 {
+			s.Logger.Warn("Ignoring index entry with invalid checksum", "path", e.Path)
+			continue
+		}
+		s.Files.Store(e.ID, FileM{Path: e.Path, T: time.Unix(0, e.ModTime), Version: e.Version,
+			Size: e.Size, Inode: e.Inode, Try: e.Try, Storage: st, Name: e.Name, Checksum: (*[32]uint8)(sum)})
+		loaded++
+	}
+	_, gen := s.Files.snapshot()
+	s.index.mu.Lock()
+	s.index.saved = gen
+	s.index.mu.Unlock()
+	s.Logger.Info("Loaded index", "path", s.IndexFile, "files", loaded)
+	return nil
+}
+
+// SaveIndex writes the file registry to IndexFile if it changed since it was
+// last loaded or saved. The file is replaced atomically.
+func (s *Server) SaveIndex() error {
+	if s.IndexFile == "" {
+		return nil
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	files, gen := s.Files.snapshot()
+	if gen == s.index.saved {
+		return nil
+	}
+
+	index := indexFile{Version: indexVersion, Files: make([]indexEntry, 0, len(files))}
+	for id, f := range files {
+		if f.Checksum == nil {
+			continue
+		}
+		index.Files = append(index.Files, indexEntry{ID: id, Try: f.Try, Path: f.Path, Name: f.Name,
+			Size: f.Size, ModTime: f.T.UnixNano(), Inode: f.Inode, Version: f.Version,
+			Checksum: hex.EncodeToString(f.Checksum[:])})
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("error while encoding index: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.IndexFile), filepath.Base(s.IndexFile)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error while saving index: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.IndexFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error while saving index: %w", err)
+	}
+	s.index.saved = gen
+	return nil
+}
+
+// indexChanged schedules saving the index.
+func (s *Server) indexChanged() {
+	if s.IndexFile == "" {
+		return
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	if s.index.timer != nil {
+		return
+	}
+	s.index.timer = time.AfterFunc(indexSaveDelay, func() {
+		s.index.mu.Lock()
+		s.index.timer = nil
+		s.index.mu.Unlock()
+		if err := s.SaveIndex(); err != nil {
+			s.Logger.Warn("Cannot save index", "err", err)
+		}
+	})
+}
+
+// stopIndex cancels a scheduled save and saves the index immediately.
+func (s *Server) stopIndex() error {
+	s.index.mu.Lock()
+	if s.index.timer != nil {
+		s.index.timer.Stop()
+		s.index.timer = nil
+	}
+	s.index.mu.Unlock()
+	return s.SaveIndex()
+}
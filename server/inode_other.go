@@ -0,0 +1,10 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package server
+
+import "io/fs"
+
+// inode returns 0 as inode numbers are not available on this system.
+func inode(info fs.FileInfo) uint64 {
+	return 0
+}
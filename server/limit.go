@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// limitBurst is the time for which a token bucket accumulates tokens while
+// idle, so that short bursts are sent without delay.
+const limitBurst = 100 * time.Millisecond
+
+// clientIdle is the time after which the bucket of a client that sent no
+// request is forgotten.
+const clientIdle = time.Minute
+
+// Limits restrict the resources used by a server. Zero values mean no limit.
+type Limits struct {
+	// Packets per second sent by the server to all clients together
+	Rate float64
+	// Packets per second sent to a single client IP address
+	ClientRate float64
+	// ACRs answered at the same time
+	MaxACRs int
+	// Drop ACRs that arrive while MaxACRs ACRs are being answered instead of
+	// waiting for one of them to finish. Whole requests are dropped, the
+	// client retransmits them (spec 6.2). Without it, at most MaxACRs ACRs
+	// wait and further ones are dropped as well.
+	DropWhenBusy bool
+}
+
+// limiter enforces Limits on the handlers of a server.
+type limiter struct {
+	mu        sync.Mutex
+	limits    Limits
+	global    *tokenBucket
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+
+	active  int           // ACRs being answered
+	waiting int           // ACRs waiting for a slot
+	freed   chan struct{} // closed and replaced when an ACR finishes
+}
+
+// SetLimits changes the limits of the server. ACRs in progress are subject
+// to the new rates immediately.
+func (s *Server) SetLimits(limits Limits) {
+	s.limits.set(limits)
+}
+
+func (l *limiter) set(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limits.Rate != l.limits.Rate {
+		l.global = newTokenBucket(limits.Rate)
+	}
+	if limits.ClientRate != l.limits.ClientRate {
+		l.clients = nil
+	}
+	l.limits = limits
+	if l.freed != nil {
+		// waiting ACRs may be admitted now
+		close(l.freed)
+		l.freed = nil
+	}
+}
+
+// admit reserves a slot for answering an ACR. If none is free, it either
+// waits for one or, with DropWhenBusy or when MaxACRs ACRs are waiting
+// already, returns false at once. It also returns false when ctx or quit are
+// done while waiting. It is called by the handler of the ACR, so that
+// waiting does not keep the server from receiving other requests.
+func (l *limiter) admit(ctx context.Context, quit <-chan struct{}) bool {
+	l.mu.Lock()
+	for l.limits.MaxACRs > 0 && l.active >= l.limits.MaxACRs {
+		if l.limits.DropWhenBusy || l.waiting >= l.limits.MaxACRs {
+			l.mu.Unlock()
+			return false
+		}
+		if l.freed == nil {
+			l.freed = make(chan struct{})
+		}
+		freed := l.freed
+		l.waiting++
+		l.mu.Unlock()
+		admitted := true
+		select {
+		case <-freed:
+		case <-quit:
+			admitted = false
+		case <-ctx.Done():
+			admitted = false
+		}
+		l.mu.Lock()
+		l.waiting--
+		if !admitted {
+			l.mu.Unlock()
+			return false
+		}
+	}
+	l.active++
+	l.mu.Unlock()
+	return true
+}
+
+// release frees the slot of an ACR.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.freed != nil {
+		close(l.freed)
+		l.freed = nil
+	}
+}
+
+// globalDelay returns the time until the server may send a packet.
+func (l *limiter) globalDelay(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global == nil {
+		return 0
+	}
+	return l.global.delay(now)
+}
+
+// clientDelay returns the time until a packet may be sent to addr as far as
+// the limit of the client is concerned.
+func (l *limiter) clientDelay(addr net.Addr, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.clients[clientIP(addr)]; ok && l.limits.ClientRate > 0 {
+		return b.delay(now)
+	}
+	return 0
+}
+
+// reserve takes a token from the global bucket and the bucket of the client
+// at addr and returns the time until both are available.
+func (l *limiter) reserve(addr net.Addr, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var d time.Duration
+	if l.global != nil {
+		d = l.global.reserve(now)
+	}
+	if l.limits.ClientRate <= 0 {
+		return d
+	}
+
+	if l.clients == nil {
+		l.clients = make(map[string]*tokenBucket)
+	}
+	if now.Sub(l.lastSweep) > clientIdle {
+		for ip, b := range l.clients {
+			if now.Sub(b.last) > clientIdle {
+				delete(l.clients, ip)
+			}
+		}
+		l.lastSweep = now
+	}
+	ip := clientIP(addr)
+	b, ok := l.clients[ip]
+	if !ok {
+		b = newTokenBucket(l.limits.ClientRate)
+		l.clients[ip] = b
+	}
+	if cd := b.reserve(now); cd > d {
+		d = cd
+	}
+	return d
+}
+
+// clientIP returns the IP address of addr, so that a client cannot avoid
+// its limit by using several ports.
+func clientIP(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	return addr.String()
+}
+
+// tokenBucket allows rate events per second on average, and bursts of the
+// events of limitBurst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64 // negative if events are waiting
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil if rate is not positive.
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, rate*limitBurst.Seconds())
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns the time until it is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// delay returns the time until a token is available.
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path"
+	"sort"
+	"time"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
+)
+
+// Lister is implemented by storages whose directories can be listed.
+type Lister interface {
+	// List returns the regular files and directories in dir, which is "" for
+	// the root.
+	List(dir string) ([]DirEntry, error)
+}
+
+// DirEntry is an entry of a directory listing.
+type DirEntry struct {
+	Name    string // without the directory
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+}
+
+var errNotLister = errors.New("storage cannot be listed")
+
+func (d DirStorage) List(dir string) ([]DirEntry, error) {
+	f, err := d.open(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.ReadDir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	var list []DirEntry
+	for _, e := range entries {
+		var info fs.FileInfo
+		if e.Type()&fs.ModeSymlink != 0 {
+			info, err = d.statLink(path.Join(dir, e.Name()))
+		} else {
+			info, err = e.Info()
+		}
+		if err != nil {
+			// e.g. removed in the meantime
+			continue
+		}
+		if entry, ok := dirEntry(info); ok {
+			list = append(list, entry)
+		}
+	}
+	return list, nil
+}
+
+// statLink returns information about the target of the link name, or an
+// error if the symlink policy of d does not follow it.
+func (d DirStorage) statLink(name string) (fs.FileInfo, error) {
+	f, err := d.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (s FSStorage) List(dir string) ([]DirEntry, error) {
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := fs.ReadDir(s.FS, dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []DirEntry
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if entry, ok := dirEntry(info); ok {
+			list = append(list, entry)
+		}
+	}
+	return list, nil
+}
+
+// List lists the underlying storage; archives are listed as files.
+func (a *ArchiveStorage) List(dir string) ([]DirEntry, error) {
+	l, ok := a.Storage.(Lister)
+	if !ok {
+		return nil, errNotLister
+	}
+	return l.List(dir)
+}
+
+func dirEntry(info fs.FileInfo) (DirEntry, bool) {
+	switch {
+	case info.IsDir():
+		return DirEntry{Name: info.Name(), Dir: true, ModTime: info.ModTime()}, true
+	case info.Mode().IsRegular():
+		return DirEntry{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()}, true
+	}
+	return DirEntry{}, false
+}
+
+// maxUDPPayload is the largest payload of a UDP datagram over IPv4.
+const maxUDPPayload = 65507
+
+// listPages splits a listing into pages of at most size bytes of entries.
+// Every page holds at least one entry, and there is always at least one
+// page.
+func listPages(entries []messages.ListEntry, size int) [][]messages.ListEntry {
+	pages := [][]messages.ListEntry{nil}
+	used := 0
+	for _, e := range entries {
+		l := messages.ListEntryHeaderSize + len(e.Name)
+		last := len(pages) - 1
+		if used+l > size && len(pages[last]) > 0 {
+			pages = append(pages, nil)
+			last++
+			used = 0
+		}
+		pages[last] = append(pages[last], e)
+		used += l
+	}
+	return pages
+}
+
+// listingVersion identifies a listing, so that a client notices when the
+// directory changes between the pages it requests. Only the names and kinds
+// of the entries are hashed, as they alone decide which page an entry is on.
+func listingVersion(entries []messages.ListEntry) uint32 {
+	h := sha256.New()
+	for _, e := range entries {
+		h.Write([]byte{e.Flags, byte(len(e.Name) >> 8), byte(len(e.Name))})
+		h.Write([]byte(e.Name))
+	}
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+func (s *Server) handleLSR(msg messages.LSR, addr net.Addr) {
+	// - LSR: check token, list directory, send the requested page
+	s.Logger.Info("LSR", "client", addr.String(), "uri", msg.URI, "page", msg.Page)
+
+	// check token, so that a listing is only sent to the address it was
+	// requested from
+	if !s.checkToken(addr, &msg.Header.Token) {
+		s.Logger.Debug("Invalid token in LSR, sending new token", "client", addr.String())
+		s.sendNTM(msg.Header.Number, messages.NoError, addr)
+		return
+	}
+
+	entries, err := s.list(msg.URI)
+	if err != nil {
+		s.Logger.Debug("Cannot list directory", "uri", msg.URI, "err", err)
+		msg := messages.ServerHeader{Version: messages.VERS, Type: messages.LSRR_t,
+			Number: msg.Header.Number, Error: messages.FileNotFound}
+		msg.Send(s.Conn, addr)
+		return
+	}
+
+	// a page of entries is no larger than a chunk, and the LSRR fits into
+	// a datagram
+	pages := listPages(entries, min(int(s.ChunkSize), maxUDPPayload-messages.LSRRHeaderSize))
+	if msg.Page >= uint32(len(pages)) {
+		msg := messages.ServerHeader{Version: messages.VERS, Type: messages.LSRR_t,
+			Number: msg.Header.Number, Error: messages.PageOutOfBounds}
+		msg.Send(s.Conn, addr)
+		return
+	}
+	lsrr := messages.GetLSRR(msg.Header.Number, messages.NoError, msg.Page, uint32(len(pages)),
+		listingVersion(entries), pages[msg.Page])
+	if err = lsrr.Send(s.Conn, addr); err != nil {
+		s.Logger.Warn("Cannot send LSRR", "client", addr.String(), "err", err)
+	}
+}
+
+// list returns the served entries of the directory uri refers to, sorted by
+// name.
+func (s *Server) list(uri string) ([]messages.ListEntry, error) {
+	st, _, resolver := s.storageRoot()
+	dir, err := resolver.ResolveDir(uri)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := st.(Lister)
+	if !ok {
+		return nil, errNotLister
+	}
+	entries, err := l.List(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error while listing: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	var list []messages.ListEntry
+	for _, e := range entries {
+		if !resolver.Serves(path.Join(dir, e.Name), e.Dir) {
+			continue
+		}
+		entry := messages.ListEntry{Size: uint64(e.Size), ModTime: e.ModTime.Unix(), Name: e.Name}
+		if e.Dir {
+			entry.Flags |= messages.EntryDir
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/logging"
+)
+
+// the outcomes of requests in the access log, besides errors while answering
+// them
+const (
+	statusOK               = "ok"
+	statusInvalidToken     = "invalid token"
+	statusFileNotFound     = "file not found"
+	statusInvalidFileID    = "invalid file ID"
+	statusTooManyChunks    = "too many chunks"
+	statusChunkOutOfBounds = "chunk out of bounds"
+	statusZeroLengthCR     = "zero length CR"
+	statusPageOutOfBounds  = "page out of bounds"
+	statusTreeTooLarge     = "tree too large"
+	statusTreeNotReady     = "tree not ready"
+)
+
+// access is the access log record of a request.
+type access struct {
+	typ    string
+	client net.Addr
+	start  time.Time
+	uri    string  // requested by an MDR
+	file   string  // name of the file in its storage
+	fileID *uint32 // nil if not known
+	chunks int     // sent without error
+	status string  // the error sent to the client, if any
+	err    error   // that prevented answering the request
+}
+
+func (s *Server) access(typ string, client net.Addr) *access {
+	return &access{typ: typ, client: client, start: time.Now(), status: statusOK}
+}
+
+// logAccess writes a to the access log, if any.
+func (s *Server) logAccess(a *access) {
+	if s.AccessLog == nil {
+		return
+	}
+	attrs := []any{"client", a.client.String()}
+	if a.uri != "" {
+		attrs = append(attrs, "uri", a.uri)
+	}
+	if a.file != "" {
+		attrs = append(attrs, "file", a.file)
+	}
+	if a.fileID != nil {
+		attrs = append(attrs, "file_id", logging.FileID(*a.fileID))
+	}
+	if a.typ == "ACR" {
+		attrs = append(attrs, "chunks", a.chunks)
+	}
+	attrs = append(attrs, "status", a.status)
+	if a.err != nil {
+		attrs = append(attrs, "err", a.err.Error())
+	}
+	attrs = append(attrs, "duration", time.Since(a.start))
+	s.AccessLog.Info(a.typ, attrs...)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"strconv"
+
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/metrics"
+)
+
+// serverMetrics are the metrics of a server, registered in Server.Metrics.
+type serverMetrics struct {
+	requests        *metrics.CounterVec // by message type
+	invalidRequests *metrics.Counter
+	invalidTokens   *metrics.Counter
+	ntms            *metrics.Counter
+	errors          *metrics.CounterVec // by message type and error code
+	packets         *metrics.Counter
+	bytes           *metrics.Counter
+	chunks          *metrics.Counter
+	droppedACRs     *metrics.Counter
+	activeACRs      *metrics.Gauge
+	acrRate         *metrics.Histogram
+	checksumHits    *metrics.Counter
+	checksumMisses  *metrics.Counter
+}
+
+func newServerMetrics(r *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		requests:        r.CounterVec("sanft_server_requests_total", "Requests received by message type.", "type"),
+		invalidRequests: r.Counter("sanft_server_invalid_requests_total", "Requests that could not be parsed."),
+		invalidTokens:   r.Counter("sanft_server_invalid_tokens_total", "Requests with an invalid token."),
+		ntms:            r.Counter("sanft_server_ntms_total", "New token messages sent."),
+		errors:          r.CounterVec("sanft_server_errors_total", "Responses with an error code by message type and code.", "type", "code"),
+		packets:         r.Counter("sanft_server_sent_packets_total", "Packets sent."),
+		bytes:           r.Counter("sanft_server_sent_bytes_total", "Bytes sent, without UDP and IP headers."),
+		chunks:          r.Counter("sanft_server_sent_chunks_total", "Chunks sent in CRRs without error."),
+		droppedACRs:     r.Counter("sanft_server_dropped_acrs_total", "ACRs dropped because too many ACRs were being answered."),
+		activeACRs:      r.Gauge("sanft_server_active_acrs", "ACRs being answered."),
+		acrRate:         r.Histogram("sanft_server_acr_rate", "Packet rate ACRs are answered with, in packets per second.", metrics.ExponentialBuckets(16, 4, 8)),
+		checksumHits:    r.Counter("sanft_server_checksum_cache_hits_total", "Checksum lookups answered from the file registry."),
+		checksumMisses:  r.Counter("sanft_server_checksum_cache_misses_total", "Checksum lookups that required hashing the file."),
+	}
+}
+
+// typeNames are the names of the message types in metrics.
+var typeNames = map[uint8]string{
+	messages.NTM_t:  "NTM",
+	messages.MDR_t:  "MDR",
+	messages.MDRR_t: "MDRR",
+	messages.ACR_t:  "ACR",
+	messages.CRR_t:  "CRR",
+	messages.LSR_t:  "LSR",
+	messages.LSRR_t: "LSRR",
+	messages.HSR_t:  "HSR",
+	messages.HSRR_t: "HSRR",
+}
+
+func typeName(t uint8) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// serverHeaderSize is the size of the header of server messages, followed by
+// the chunk number in CRRs.
+const serverHeaderSize = 4
+
+// metricsConn counts the packets sent by a server.
+type metricsConn struct {
+	net.PacketConn
+	m *serverMetrics
+}
+
+func (c metricsConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err != nil {
+		return n, err
+	}
+	c.m.packets.Inc()
+	c.m.bytes.Add(float64(n))
+	if len(p) >= serverHeaderSize {
+		typ, code := p[1], p[3]
+		switch {
+		case code != messages.NoError:
+			c.m.errors.With(typeName(typ), strconv.Itoa(int(code))).Inc()
+		case typ == messages.CRR_t:
+			c.m.chunks.Inc()
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"sync"
+)
+
+// maxFileIDTries is the number of file IDs tried for a file before the
+// registry is considered full of outdated files and cleared.
+const maxFileIDTries = 10
+
+// FileRegistry maps file IDs to the files they identify. It is safe for
+// concurrent use by the request handlers.
+type FileRegistry struct {
+	mu    sync.RWMutex
+	files map[uint32]FileM
+	gen   uint64 // incremented on every change
+}
+
+func NewFileRegistry() *FileRegistry {
+	return &FileRegistry{files: make(map[uint32]FileM)}
+}
+
+// Get returns the file registered under id.
+func (r *FileRegistry) Get(id uint32) (FileM, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.files[id]
+	return f, ok
+}
+
+// Store registers f under id, replacing any previous entry.
+func (r *FileRegistry) Store(id uint32, f FileM) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[id] = f
+	r.gen++
+}
+
+// Delete removes id from the registry if it still refers to the same version
+// of the file as f. This avoids removing an entry that was replaced
+// concurrently.
+func (r *FileRegistry) Delete(id uint32, f FileM) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok := r.files[id]; ok && g.is(f.Path, f.info()) {
+		delete(r.files, id)
+		r.gen++
+	}
+}
+
+// Len returns the number of registered files.
+func (r *FileRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.files)
+}
+
+// snapshot returns a copy of the registered files and the generation of the
+// registry it was taken at.
+func (r *FileRegistry) snapshot() (map[uint32]FileM, uint64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	files := make(map[uint32]FileM, len(r.files))
+	for id, f := range r.files {
+		files[id] = f
+	}
+	return files, r.gen
+}
+
+// Lookup returns the ID of the given version of the file at path if it has
+// already been registered.
+func (r *FileRegistry) Lookup(path string, info FileInfo) (uint32, FileM, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := 0; i < maxFileIDTries; i++ {
+		fileid, _ := GetFileID(path, info.ModTime, i)
+		if f, ok := r.files[fileid]; ok && f.is(path, info) {
+			return fileid, f, true
+		}
+	}
+	return 0, FileM{}, false
+}
+
+// Register assigns a file ID to the version of a file described by f. If it is
+// already registered, its existing entry is returned and f is ignored.
+// Otherwise, the first of maxFileIDTries candidate IDs that is not
+// taken by another file is used; if most of them are taken, the registry is
+// assumed to be full of outdated files and is cleared.
+func (r *FileRegistry) Register(f FileM) (uint32, FileM) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < maxFileIDTries; i++ {
+		if i == maxFileIDTries-2 {
+			// many tries, space must be almost full e.g. many outdate files
+			// delete old map and recreate
+			r.files = make(map[uint32]FileM)
+			// run loop one more time, now we should find a valid id
+			continue
+		}
+		fileid, _ := GetFileID(f.Path, f.T, i)
+		g, ok := r.files[fileid]
+		if ok {
+			if g.is(f.Path, f.info()) {
+				// same file: use this file id
+				return fileid, g
+			}
+			// id exists in map -> try to find new id
+			continue
+		}
+		f.Try = i
+		r.files[fileid] = f
+		r.gen++
+		return fileid, f
+	}
+	// Unreachable: the map was cleared, so the last try is always free
+	panic("no free file ID after clearing the registry")
+}
+
+// is reports whether f is the given version of the file at path.
+func (f FileM) is(path string, info FileInfo) bool {
+	return f.Path == path && f.matches(info)
+}
+
+// matches reports whether info describes the version of the file registered
+// as f.
+func (f FileM) matches(info FileInfo) bool {
+	return f.T.Equal(info.ModTime) && f.Version == info.Version && f.Size == info.Size && f.Inode == info.Inode
+}
+
+func (f FileM) info() FileInfo {
+	return FileInfo{Size: f.Size, ModTime: f.T, Version: f.Version, Inode: f.Inode}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrInvalidURI is returned for URIs which are no valid RFC 3986 paths.
+	ErrInvalidURI = errors.New("invalid URI")
+	// ErrOutsideRoot is returned for URIs which would escape the root.
+	ErrOutsideRoot = errors.New("outside of the served directory")
+	// ErrNotServed is returned for files excluded by the rules of a Resolver.
+	ErrNotServed = errors.New("not served")
+)
+
+// Resolver turns the URIs of MDRs into names in a Storage.
+//
+// Allow and Deny are path.Match patterns. Patterns containing a slash are
+// matched against the whole name, others against a single element of it.
+// A name is served if no Deny pattern matches it or one of its directories,
+// and, if Allow is not empty and it is a file, an Allow pattern matches it.
+type Resolver struct {
+	// Serve files and directories whose name starts with a dot
+	Hidden bool
+	Allow  []string
+	Deny   []string
+}
+
+// Resolve returns the name in the storage a URI refers to. URIs are percent
+// decoded element by element, so an encoded slash is part of a name and not
+// a separator, may have a "sanft" scheme without an authority and are
+// relative to the root whether or not they start with a slash. "." and ".."
+// elements are resolved, but may not escape the root.
+func (r *Resolver) Resolve(uri string) (string, error) {
+	elems, err := parseURI(uri)
+	if err != nil {
+		return "", err
+	}
+	if len(elems) == 0 {
+		return "", fmt.Errorf("%w: %q has no file name", ErrInvalidURI, uri)
+	}
+	return strings.Join(elems, "/"), r.check(elems, false)
+}
+
+// ResolveDir is like Resolve for a directory, which is "" for the root.
+func (r *Resolver) ResolveDir(uri string) (string, error) {
+	elems, err := parseURI(uri)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(elems, "/"), r.check(elems, true)
+}
+
+// Serves reports whether the file or directory name is served.
+func (r *Resolver) Serves(name string, dir bool) bool {
+	return r.check(strings.Split(name, "/"), dir) == nil
+}
+
+// parseURI returns the elements of the path of uri.
+func parseURI(uri string) ([]string, error) {
+	ref := uri
+	if !strings.HasPrefix(uri, "sanft:") {
+		// a path, even if it looks like it starts with a scheme or authority
+		ref = "./" + uri
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+	}
+	if u.Opaque != "" || u.User != nil || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return nil, fmt.Errorf("%w: %q is not a path", ErrInvalidURI, uri)
+	}
+	if u.Host != "" {
+		// the server cannot tell whether the host is one of its names
+		return nil, fmt.Errorf("%w: %q has an authority", ErrInvalidURI, uri)
+	}
+
+	var elems []string
+	for _, raw := range strings.Split(u.EscapedPath(), "/") {
+		elem, err := url.PathUnescape(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+		}
+		if strings.ContainsAny(elem, "/\x00") {
+			return nil, fmt.Errorf("%w: %q contains a slash or NUL in a name", ErrInvalidURI, uri)
+		}
+		switch elem {
+		case "", ".":
+		case "..":
+			if len(elems) == 0 {
+				return nil, fmt.Errorf("%w: %q", ErrOutsideRoot, uri)
+			}
+			elems = elems[:len(elems)-1]
+		default:
+			elems = append(elems, elem)
+		}
+	}
+	return elems, nil
+}
+
+// check applies the rules of r to the name made of elems.
+func (r *Resolver) check(elems []string, dir bool) error {
+	name := strings.Join(elems, "/")
+	for i, elem := range elems {
+		if !r.Hidden && strings.HasPrefix(elem, ".") {
+			return fmt.Errorf("%w: %q is hidden", ErrNotServed, name)
+		}
+		if matchAny(r.Deny, strings.Join(elems[:i+1], "/"), elem) {
+			return fmt.Errorf("%w: %q is denied", ErrNotServed, name)
+		}
+	}
+	if !dir && len(r.Allow) > 0 && !matchAny(r.Allow, name, elems[len(elems)-1]) {
+		return fmt.Errorf("%w: %q is not allowed", ErrNotServed, name)
+	}
+	return nil
+}
+
+// CheckPatterns returns an error if one of patterns is malformed.
+func CheckPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, name string, elem string) bool {
+	for _, p := range patterns {
+		subject := elem
+		if strings.Contains(p, "/") {
+			subject = name
+		}
+		if ok, _ := path.Match(p, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SymlinkPolicy controls which symbolic links a DirStorage follows.
+type SymlinkPolicy uint8
+
+const (
+	// Follow links whose target is inside the root
+	SymlinksInside SymlinkPolicy = iota
+	// Follow all links
+	SymlinksFollow
+	// Follow no links below the root
+	SymlinksDeny
+)
+
+// SymlinkPolicies are the names of the policies accepted by
+// ParseSymlinkPolicy.
+var SymlinkPolicies = []string{"inside", "follow", "deny"}
+
+func ParseSymlinkPolicy(s string) (SymlinkPolicy, error) {
+	for i, name := range SymlinkPolicies {
+		if s == name {
+			return SymlinkPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid symlink policy %q, must be one of %v", s, strings.Join(SymlinkPolicies, ", "))
+}
+
+func (p SymlinkPolicy) String() string {
+	if int(p) < len(SymlinkPolicies) {
+		return SymlinkPolicies[p]
+	}
+	return fmt.Sprintf("SymlinkPolicy(%d)", uint8(p))
+}
+
+var errSymlink = errors.New("symbolic link not followed")
+
+// maxSymlinks is the number of symbolic links followed while opening a
+// name, like the limit of the kernel, so that loops end.
+const maxSymlinks = 40
+
+// open opens the file or directory name, which is "" for the root,
+// according to the symlink policy of d. Unless all links are followed, the
+// name is walked element by element below the root: each element is checked
+// with Lstat and must be the same file once opened, so that a link swapped
+// in between the check and the open is not followed. Links are either
+// refused or resolved here and may not leave the root, even if their target
+// is absolute.
+func (d DirStorage) open(name string) (*os.File, error) {
+	if d.Symlinks == SymlinksFollow {
+		return os.Open(d.Root + name)
+	}
+	root, err := os.OpenRoot(d.Root)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []*os.Root{root} // the directories walked so far
+	defer func() {
+		for _, dir := range dirs {
+			dir.Close()
+		}
+	}()
+	refuse := &fs.PathError{Op: "open", Path: name, Err: errSymlink}
+
+	elems := strings.Split(name, "/")
+	links := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		dir := dirs[len(dirs)-1]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			// only in the targets of links, names are resolved already
+			if len(dirs) == 1 {
+				return nil, refuse
+			}
+			dir.Close()
+			dirs = dirs[:len(dirs)-1]
+			continue
+		}
+		info, err := dir.Lstat(elem)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if links++; d.Symlinks == SymlinksDeny || links > maxSymlinks {
+				return nil, refuse
+			}
+			target, err := dir.Readlink(elem)
+			if err != nil {
+				return nil, err
+			}
+			if filepath.IsAbs(target) {
+				if target, err = d.relative(target); err != nil {
+					return nil, refuse
+				}
+				for _, dir := range dirs[1:] {
+					dir.Close()
+				}
+				dirs = dirs[:1]
+			}
+			elems = append(strings.Split(filepath.ToSlash(target), "/"), elems...)
+			continue
+		}
+
+		var opened fs.FileInfo
+		if len(elems) == 0 {
+			if !info.Mode().IsRegular() && !info.IsDir() {
+				// e.g. a FIFO, whose open blocks
+				return nil, &fs.PathError{Op: "open", Path: name, Err: errNotRegular}
+			}
+			f, err := dir.Open(elem)
+			if err != nil {
+				return nil, err
+			}
+			if opened, err = f.Stat(); err != nil || !os.SameFile(info, opened) {
+				f.Close()
+				return nil, refuse
+			}
+			return f, nil
+		}
+		next, err := dir.OpenRoot(elem)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, next)
+		if opened, err = next.Stat("."); err != nil || !os.SameFile(info, opened) {
+			return nil, refuse
+		}
+	}
+	return dirs[len(dirs)-1].Open(".")
+}
+
+// relative returns the name of the absolute path target below the root, or
+// an error if it is outside.
+func (d DirStorage) relative(target string) (string, error) {
+	roots := []string{d.Root}
+	if real, err := filepath.EvalSymlinks(d.Root); err == nil {
+		roots = append(roots, real)
+	}
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, target)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return rel, nil
+		}
+	}
+	return "", errSymlink
+}
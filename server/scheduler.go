@@ -0,0 +1,341 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// flowQueueSize is the number of packets an ACR handler may read ahead
+	// of the scheduler.
+	flowQueueSize = 4
+	// wheelTick is the resolution of the timer wheel and wheelSlots the
+	// number of its slots, so that deadlines up to about a second ahead are
+	// found without going around the wheel.
+	wheelTick  = 250 * time.Microsecond
+	wheelSlots = 4096
+	// pacingSlack is how far a flow may fall behind its schedule, e.g. after
+	// the scheduler overslept, and catch up by sending back to back.
+	pacingSlack = 2 * time.Millisecond
+	// quantumOverhead is added to the chunk size for the quantum of a flow,
+	// so that a CRR with a full chunk fits.
+	quantumOverhead = 64
+	// minFlowRate is the lowest rate in packets per second a flow is paced
+	// at, as the client may request any rate, even 0.
+	minFlowRate = 1
+)
+
+// scheduler sends the CRRs of all ACRs being answered. Each ACR is a flow
+// that sends its packets in order at the rate requested by the client. The
+// flows whose next packet is due share the socket and the global limit by
+// deficit round robin; the others wait in a timer wheel until they are due.
+//
+// Pacing is based on the time a packet was due rather than the time it was
+// sent, so that timer granularity does not add up to a lower rate.
+type scheduler struct {
+	conn    net.PacketConn
+	limits  *limiter
+	quantum int // bytes a flow may send per round
+
+	mu      sync.Mutex
+	running bool
+	flows   int     // open flows
+	ring    []*flow // flows due, in round robin order
+	wheel   timerWheel
+	wake    chan struct{}
+}
+
+// flow is an ACR being answered. It implements net.PacketConn so that the
+// messages of an ACR are sent through the scheduler like through a socket.
+type flow struct {
+	net.PacketConn
+	s        *scheduler
+	addr     net.Addr
+	interval time.Duration // between two packets
+
+	// guarded by s.mu
+	queue   [][]byte
+	next    time.Time // when the next packet is due
+	deficit int
+	granted bool  // the deficit of the current round has been added
+	waiting bool  // in the ring or the wheel
+	due     int64 // tick of the wheel the flow waits for
+	closed  bool
+	sending bool       // a packet taken from the queue is being sent
+	err     error      // of the socket, returned by further writes
+	changed *sync.Cond // signaled when packets have been sent
+}
+
+func newScheduler(conn net.PacketConn, limits *limiter, quantum int) *scheduler {
+	return &scheduler{conn: conn, limits: limits, quantum: quantum, wake: make(chan struct{}, 1),
+		wheel: newTimerWheel(time.Now())}
+}
+
+// open returns a flow to addr sending rate packets per second, but at least
+// minFlowRate.
+func (s *scheduler) open(addr net.Addr, rate float64) *flow {
+	if !(rate >= minFlowRate) {
+		// also NaN
+		rate = minFlowRate
+	}
+	f := &flow{PacketConn: s.conn, s: s, addr: addr, interval: time.Duration(float64(time.Second) / rate)}
+	f.changed = sync.NewCond(&s.mu)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.next = time.Now()
+	s.flows++
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	return f
+}
+
+// WriteTo queues a packet of the flow. It blocks while the queue is full.
+func (f *flow) WriteTo(p []byte, addr net.Addr) (int, error) {
+	s := f.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(f.queue) >= flowQueueSize && f.err == nil {
+		f.changed.Wait()
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.closed {
+		return 0, net.ErrClosed
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	f.queue = append(f.queue, data)
+	if !f.waiting {
+		f.waiting = true
+		now := time.Now()
+		if f.next.Before(now.Add(-pacingSlack)) {
+			// idle for a while, do not send a burst
+			f.next = now
+		}
+		s.schedule(f, f.next, now)
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Close waits until the queued packets have been sent. The socket stays
+// open.
+func (f *flow) Close() error {
+	s := f.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	for (len(f.queue) > 0 || f.sending) && f.err == nil {
+		f.changed.Wait()
+	}
+	f.closed = true
+	s.flows--
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return f.err
+}
+
+// schedule puts f into the ring if it is due at now, otherwise into the
+// wheel.
+func (s *scheduler) schedule(f *flow, at time.Time, now time.Time) {
+	if at.After(now) {
+		s.wheel.add(f, at)
+	} else {
+		s.ring = append(s.ring, f)
+	}
+}
+
+// run sends packets until no flows are left. The lock is held except while
+// sleeping or sending.
+func (s *scheduler) run() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		now := time.Now()
+		s.ring = append(s.ring, s.wheel.advance(now)...)
+		if len(s.ring) == 0 {
+			if s.flows == 0 {
+				s.running = false
+				return
+			}
+			s.sleep(s.wheel.next(now))
+			continue
+		}
+		if d := s.limits.globalDelay(now); d > 0 {
+			s.sleep(d)
+			continue
+		}
+
+		f := s.ring[0]
+		s.ring = s.ring[1:]
+		if !f.granted {
+			f.deficit += s.quantum
+			f.granted = true
+		}
+		var limited, clientLimited time.Duration
+		for len(f.queue) > 0 && !f.next.After(now) && f.deficit >= len(f.queue[0]) {
+			if limited = s.limits.globalDelay(now); limited > 0 {
+				break
+			}
+			if clientLimited = s.limits.clientDelay(f.addr, now); clientLimited > 0 {
+				break
+			}
+			p := f.queue[0]
+			f.queue = f.queue[1:]
+			f.deficit -= len(p)
+			s.limits.reserve(f.addr, now)
+			// The flow is neither in the ring nor in the wheel, so it stays
+			// ours while the lock is released for sending, and a slow send
+			// does not block the handlers queueing packets.
+			f.sending = true
+			s.mu.Unlock()
+			_, err := s.conn.WriteTo(p, f.addr)
+			s.mu.Lock()
+			f.sending = false
+			if err != nil {
+				f.err = err
+				f.queue = nil
+			}
+			f.next = f.next.Add(f.interval)
+			if f.next.Before(now.Add(-pacingSlack)) {
+				f.next = now.Add(-pacingSlack)
+			}
+			f.changed.Broadcast()
+		}
+
+		switch {
+		case len(f.queue) == 0:
+			// idle until the handler queues the next packet
+			f.waiting = false
+			f.deficit, f.granted = 0, false
+		case limited > 0:
+			// keep the turn until the server may send again
+			s.ring = append([]*flow{f}, s.ring...)
+		case clientLimited > 0 || f.next.After(now):
+			f.deficit, f.granted = 0, false
+			wait := f.next
+			if now.Add(clientLimited).After(wait) {
+				wait = now.Add(clientLimited)
+			}
+			s.wheel.add(f, wait)
+		default:
+			// out of deficit, next round
+			f.granted = false
+			s.ring = append(s.ring, f)
+		}
+	}
+}
+
+// sleep releases the lock for at most d, or until woken up. A negative d
+// sleeps until woken up.
+func (s *scheduler) sleep(d time.Duration) {
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	if d < 0 {
+		<-s.wake
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.wake:
+	}
+}
+
+// timerWheel holds the flows waiting for a deadline. Slot i holds the flows
+// due at a tick t with t % wheelSlots == i.
+type timerWheel struct {
+	start  time.Time // of tick 0
+	cursor int64     // first tick not yet advanced past
+	count  int
+	slots  [wheelSlots][]*flow
+}
+
+func newTimerWheel(start time.Time) timerWheel {
+	return timerWheel{start: start}
+}
+
+func (w *timerWheel) tick(t time.Time) int64 {
+	return int64(t.Sub(w.start) / wheelTick)
+}
+
+// add puts f into the slot of at, rounded up to the next tick.
+func (w *timerWheel) add(f *flow, at time.Time) {
+	due := w.tick(at.Add(wheelTick - 1))
+	if due < w.cursor {
+		due = w.cursor
+	}
+	f.due = due
+	i := due % wheelSlots
+	w.slots[i] = append(w.slots[i], f)
+	w.count++
+}
+
+// advance removes and returns the flows due at now.
+func (w *timerWheel) advance(now time.Time) []*flow {
+	end := w.tick(now) + 1
+	if w.count == 0 {
+		w.cursor = end
+		return nil
+	}
+	var due []*flow
+	steps := end - w.cursor
+	if steps > wheelSlots {
+		// check every slot once
+		steps = wheelSlots
+	}
+	for i := int64(0); i < steps; i++ {
+		slot := (w.cursor + i) % wheelSlots
+		flows := w.slots[slot][:0]
+		for _, f := range w.slots[slot] {
+			if f.due < end {
+				due = append(due, f)
+				w.count--
+			} else {
+				flows = append(flows, f)
+			}
+		}
+		w.slots[slot] = flows
+	}
+	if end > w.cursor {
+		w.cursor = end
+	}
+	return due
+}
+
+// next returns the time until the next flow is due, or -1 if the wheel is
+// empty.
+func (w *timerWheel) next(now time.Time) time.Duration {
+	if w.count == 0 {
+		return -1
+	}
+	first := int64(-1)
+	for i := int64(0); i < wheelSlots; i++ {
+		for _, f := range w.slots[(w.cursor+i)%wheelSlots] {
+			if first < 0 || f.due < first {
+				first = f.due
+			}
+		}
+		if first >= 0 && first < w.cursor+i+1 {
+			// no earlier deadline in the following slots
+			break
+		}
+	}
+	d := w.start.Add(time.Duration(first) * wheelTick).Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
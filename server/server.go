@@ -2,62 +2,111 @@ package server
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"math"
 	"net"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/logging"
 	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/markov"
 	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/metrics"
 )
 
 const KEY_VALIDITY = 12 * time.Hour
 
 type FileM struct {
-	Path string
-	T    time.Time
-	Try  int
+	// identifies the file on the server; the path in RootDir unless a
+	// Storage is used
+	Path    string
+	T       time.Time
+	Version string
+	Size    int64
+	Inode   uint64
+	Try     int
+	// where to read the file from
+	Storage Storage
+	Name    string
 	// cache checksum to avoid calculating it again if the file has not been modified
 	Checksum *[32]uint8
 }
 
 type Server struct {
 	// read out from some config:
+	// RootDir, MaxChunksInACR and RateIncrease may only be changed by Reload
+	// once the server is serving
 	ChunkSize      uint16
 	MaxChunksInACR uint16
 	Conn           net.PacketConn
+	listeners      *multiConn // the sockets received from, see Listen
 	RootDir        string
 	MarkovP        float64
 	MarkovQ        float64
 
-	FileIDMap map[uint32]FileM
-
-	// keying material
-	key         []uint8
-	valid_until time.Time
+	Files *FileRegistry
+	// File the registry is saved to so that file IDs and checksums survive
+	// restarts, see LoadIndex. Empty to keep the registry in memory only.
+	IndexFile string
+	index     fileIndex
+	// Hash all served files when Serve is called, and again every
+	// RescanInterval if it is not 0, so that MDRs do not wait for a checksum
+	Prehash        bool
+	RescanInterval time.Duration
+	hashes         *hasher
+	trees          *treeCache // Merkle trees for HSRs
+
+	// Storage the files are served from. If nil, the files in RootDir are
+	// served. Must not be changed while serving.
+	Storage Storage
+	// Serve the members of archives in RootDir as "archive.tar/path/inside"
+	// too. May only be changed by Reload once the server is serving, like
+	// Resolver and Symlinks.
+	Archives bool
+	// which URIs are served
+	Resolver Resolver
+	// which symbolic links in RootDir are followed
+	Symlinks SymlinkPolicy
+	archives *ArchiveStorage // for RootDir
+
+	// keying material; tokens of the previous key are accepted for
+	// KeyOverlap after a rotation. KeyOverlap must not be changed while
+	// serving.
+	keys       keyHolder
+	KeyOverlap time.Duration
+
+	// see SetLimits
+	limits limiter
+	// sends the CRRs
+	sched *scheduler
+
+	lifecycle lifecycle
+
+	// Metrics of the server, to be exposed e.g. over HTTP
+	Metrics *metrics.Registry
+	metrics *serverMetrics
+
+	// guards the parameters changed by Reload
+	mu   sync.RWMutex
+	conf Config // as last loaded
 
 	// constant packet rate increase
 	RateIncrease float64
 
-	// Debugging
-	DebugLogger *log.Logger
-	InfoLogger  *log.Logger
-	WarnLogger  *log.Logger
-}
-
-func createRandomKey() []uint8 {
-	key := make([]uint8, 256)
-	rand.Read(key)
-	return key
+	// Logger gets the messages of the server. The default logger writes
+	// text to stderr at the level set by SetLogLevel.
+	Logger   *slog.Logger
+	logLevel slog.LevelVar
+	// AccessLog, if not nil, gets a record of every MDR, ACR and HSR answered
+	AccessLog     *slog.Logger
+	accessLogFile io.Closer // opened by New
 }
 
 // Initialize: chunksize, root folder, max chunks in acr
@@ -66,6 +115,11 @@ func createRandomKey() []uint8 {
 // - ACR: check token, read file chunk
 // to check whether the current file id is the latest -> map[fileid] -> path -> lookup and calc fileid
 func Init(ip net.IP, port int, root_dir string, chunk_size uint16, max_chunks_in_acr uint16, markovP float64, markovQ float64, rate_increase float64) (*Server, error) {
+	return initServer(ip, port, root_dir, chunk_size, max_chunks_in_acr, markovP, markovQ, rate_increase, DefaultHashWorkers)
+}
+
+// initServer is Init with hashWorkers files hashed at the same time.
+func initServer(ip net.IP, port int, root_dir string, chunk_size uint16, max_chunks_in_acr uint16, markovP float64, markovQ float64, rate_increase float64, hashWorkers int) (*Server, error) {
 	// check if root dir exists
 	if _, err := os.Stat(root_dir); os.IsNotExist(err) {
 		// root_dir does not exist does not exist
@@ -94,121 +148,346 @@ func Init(ip net.IP, port int, root_dir string, chunk_size uint16, max_chunks_in
 	}
 
 	s := new(Server)
+	s.Metrics = metrics.NewRegistry()
+	s.metrics = newServerMetrics(s.Metrics)
+	s.listeners = newMultiConn(conn)
+	// count everything sent, including the CRRs of the scheduler
+	conn = metricsConn{s.listeners, s.metrics}
 	s.ChunkSize = chunk_size
 	s.MaxChunksInACR = max_chunks_in_acr
 	s.Conn = conn
 	s.MarkovP = markovP
 	s.MarkovQ = markovQ
 	s.RootDir = root_dir
-	// empty file ID map
-	s.FileIDMap = make(map[uint32]FileM)
+	// empty file registry
+	s.Files = NewFileRegistry()
+	s.hashes = newHasher(hashWorkers)
+	s.trees = newTreeCache(DefaultMaxTreeChunks)
+	s.sched = newScheduler(conn, &s.limits, int(chunk_size)+quantumOverhead)
+	s.Metrics.GaugeFunc("sanft_server_files", "Files in the registry.", func() float64 {
+		files, _ := s.Files.snapshot()
+		return float64(len(files))
+	})
+
+	// logger
+	s.Logger = logging.New(os.Stderr, "text", &s.logLevel)
 
+	s.KeyOverlap = DefaultKeyOverlap
 	s.NewKey()
 	s.RateIncrease = rate_increase
-
-	// logger
-	s.DebugLogger = log.New(ioutil.Discard, "DEBUG: ", log.LstdFlags)
-	s.InfoLogger = log.New(os.Stderr, "INFO: ", log.LstdFlags)
-	s.WarnLogger = log.New(os.Stderr, "WARN: ", log.LstdFlags)
+	s.conf = Config{Host: ip.String(), Port: port, RootDir: root_dir, ChunkSize: chunk_size,
+		MaxChunksInACR: max_chunks_in_acr, RateIncrease: rate_increase, MarkovP: markovP,
+		MarkovQ: markovQ, LogLevel: "info"}
 
 	return s, nil
 }
 
-func (s *Server) NewKey() {
-	s.key = createRandomKey()
-	s.valid_until = time.Now().Add(KEY_VALIDITY)
-}
+// server methods
 
-func (s *Server) RefreshKey() {
-	if time.Now().After(s.valid_until) {
-		s.NewKey()
+// Listen makes the server also receive requests on ip:port, e.g. on an IPv6
+// address in addition to the IPv4 address given to Init. Responses are sent
+// from the address a request was received on. It must not be called after
+// Serve.
+func (s *Server) Listen(ip net.IP, port int) error {
+	conn, err := markov.CreateServerSocket(ip, port, s.MarkovP, s.MarkovQ)
+	if err != nil {
+		return fmt.Errorf("error while creating the socket: %w", err)
 	}
+	s.listeners.add(conn)
+	return nil
 }
 
-// server methods
+// Addrs returns the addresses the server receives requests on.
+func (s *Server) Addrs() []net.Addr {
+	return s.listeners.LocalAddrs()
+}
 
-// the only purpose of the channel is to tell the function
-// when to stop listening
-func (s *Server) Listen(close chan bool) {
+// ErrServerClosed is returned by Serve after Shutdown has been called.
+var ErrServerClosed = errors.New("server closed")
 
-	for cont(close) {
-		// refreshing key every 12 hours
-		s.RefreshKey()
+// maxDatagramSize is the size of the receive buffer, large enough for any
+// UDP payload.
+const maxDatagramSize = 0x10000
 
-		// short timeout to be responsive
-		addr, data, err := messages.ServerReceive(s.Conn, 100)
-		if os.IsTimeout(err) {
-			// next iteration when timeout
-			continue
+// Serve receives requests and answers each of them in its own goroutine
+// until ctx is done or Shutdown is called. It does not close the socket;
+// call Shutdown to let in-flight requests finish and release it.
+func (s *Server) Serve(ctx context.Context) error {
+	s.lifecycle.serving.Add(1)
+	defer s.lifecycle.serving.Done()
+	quit := s.lifecycle.quitChan()
+	select {
+	case <-quit:
+		return ErrServerClosed
+	default:
+	}
+
+	// hash the served files in the background
+	if s.Prehash || s.RescanInterval > 0 {
+		scanCtx, cancel := s.lifecycle.context(ctx)
+		defer cancel()
+		s.lifecycle.handlers.Add(1)
+		go s.watch(scanCtx)
+	}
+
+	// clear a deadline left by a previous call
+	s.Conn.SetReadDeadline(time.Time{})
+	// unblock the read when we should stop
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-quit:
+		case <-stopped:
+			return
 		}
-		if err != nil {
-			s.WarnLogger.Printf("error while receiving form UDP socket: %v\n", err)
-			continue
+		s.Conn.SetReadDeadline(time.Now())
+	}()
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.Conn.ReadFrom(buffer)
+		select {
+		case <-quit:
+			return ErrServerClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
 		}
-		msgr, err := messages.ParseClient(&data)
-
-		// check for parsing specific errors
-		var e1 *messages.WrongPacketLengthError
-		var e2 *messages.UnsupporedTypeError
-		var e3 *messages.UnsupporedVersionError
-		if errors.As(err, &e1) && errors.As(err, &e2) {
-			// Invalid request, drop request
-			s.DebugLogger.Println("Invalid request, dropped...")
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.Logger.Warn("Cannot receive from UDP socket", "err", err)
 			continue
 		}
+		// refreshing key every 12 hours
+		s.RefreshKey()
 
-		if errors.As(err, &e3) {
-			// wrong version
-			msgr := messages.ServerHeader{Version: messages.VERS, Type: data[1], Number: data[2], Error: messages.UnsupportedVersion}
-			msgr.Send(s.Conn, addr)
-			continue
-		}
+		// the handlers outlive the buffer
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		s.handle(ctx, data, addr)
+	}
+}
 
-		if err != nil {
-			s.DebugLogger.Printf("error while parsing client message: %v\n", err)
-			continue
-		}
+// handle parses a request and starts its handler. It blocks while no more
+// ACRs may be answered, unless they are dropped.
+func (s *Server) handle(ctx context.Context, data []byte, addr net.Addr) {
+	msgr, err := messages.ParseClient(&data)
+
+	// check for parsing specific errors
+	var e1 *messages.WrongPacketLengthError
+	var e2 *messages.UnsupporedTypeError
+	var e3 *messages.UnsupporedVersionError
+	if errors.As(err, &e1) && errors.As(err, &e2) {
+		// Invalid request, drop request
+		s.metrics.invalidRequests.Inc()
+		s.Logger.Debug("Invalid request, dropped", "client", addr.String())
+		return
+	}
+
+	if errors.As(err, &e3) {
+		// wrong version
+		s.metrics.invalidRequests.Inc()
+		msgr := messages.ServerHeader{Version: messages.VERS, Type: data[1], Number: data[2], Error: messages.UnsupportedVersion}
+		msgr.Send(s.Conn, addr)
+		return
+	}
+
+	if err != nil {
+		s.metrics.invalidRequests.Inc()
+		s.Logger.Debug("Cannot parse request", "client", addr.String(), "err", err)
+		return
+	}
+	s.metrics.requests.With(typeName(data[1])).Inc()
+
+	switch msg := msgr.(type) {
+	case messages.MDR:
+		s.lifecycle.handlers.Add(1)
+		go func() {
+			defer s.lifecycle.handlers.Done()
+			s.handleMDR(msg, addr)
+		}()
+	case messages.ACR:
+		s.lifecycle.handlers.Add(1)
+		go func() {
+			defer s.lifecycle.handlers.Done()
+			if !s.limits.admit(ctx, s.lifecycle.quitChan()) {
+				s.metrics.droppedACRs.Inc()
+				s.Logger.Debug("Too many ACRs, dropped ACR", "client", addr.String())
+				return
+			}
+			defer s.limits.release()
+			s.metrics.activeACRs.Inc()
+			defer s.metrics.activeACRs.Dec()
+			s.handleACR(msg, addr)
+		}()
+	case messages.LSR:
+		s.lifecycle.handlers.Add(1)
+		go func() {
+			defer s.lifecycle.handlers.Done()
+			s.handleLSR(msg, addr)
+		}()
+	case messages.HSR:
+		s.lifecycle.handlers.Add(1)
+		go func() {
+			defer s.lifecycle.handlers.Done()
+			s.handleHSR(msg, addr)
+		}()
+	}
+}
+
+// Shutdown stops Serve from accepting new requests and waits for the
+// requests in progress to be answered, as an ACR that has been started must
+// be answered completely (spec 6.2). The socket is closed once they are done
+// or ctx is done, whatever happens first; in the latter case the remaining
+// handlers give up on their next send and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycle.quitOnce.Do(func() {
+		close(s.lifecycle.quitChan())
+	})
+	err := waitContext(ctx, &s.lifecycle.serving)
+	if err == nil {
+		// Serve has returned, so no new handlers can be started
+		err = waitContext(ctx, &s.lifecycle.handlers)
+	}
+	if ierr := s.stopIndex(); ierr != nil && err == nil {
+		err = ierr
+	}
+	if cerr := s.Conn.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) && err == nil {
+		err = cerr
+	}
+	if s.accessLogFile != nil {
+		s.accessLogFile.Close()
+	}
+	return err
+}
 
-		switch msg := msgr.(type) {
-		case messages.MDR:
-			go s.handleMDR(msg, addr)
-		case messages.ACR:
-			go s.handleACR(msg, addr)
+// lifecycle tracks the goroutines of a running server.
+type lifecycle struct {
+	mu       sync.Mutex
+	quit     chan struct{} // Closed by Shutdown
+	quitOnce sync.Once
+	serving  sync.WaitGroup // Running Serve calls
+	handlers sync.WaitGroup // Running request handlers
+}
+
+// context returns a context derived from parent that is also canceled by
+// Shutdown.
+func (l *lifecycle) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	quit := l.quitChan()
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+	return ctx, cancel
+}
+
+func (l *lifecycle) quitChan() chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.quit == nil {
+		l.quit = make(chan struct{})
+	}
+	return l.quit
+}
+
+// waitContext waits for wg or until ctx is done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetPath returns the path of the file in RootDir an URI refers to.
+func (s *Server) GetPath(uri string) (string, error) {
+	s.mu.RLock()
+	root, resolver := s.RootDir, s.Resolver
+	s.mu.RUnlock()
+	name, err := resolver.Resolve(uri)
+	if err != nil {
+		return "", err
+	}
+	return root + name, nil
+}
 
+// storage returns the storage to serve uri from, the name of the file in it
+// and the path identifying it in the file registry.
+func (s *Server) storage(uri string) (Storage, string, string, error) {
+	st, prefix, resolver := s.storageRoot()
+	name, err := resolver.Resolve(uri)
+	if err != nil {
+		return nil, "", "", err
 	}
+	return st, name, prefix + name, nil
 }
 
-func (s *Server) GetPath(path string) string {
-	if path[0] == '/' {
-		// remove trailing "/"
-		path = path[1:]
-	}
-	path = s.RootDir + path
-	// remove ..
-	path = strings.ReplaceAll(path, "..", "")
-	// remove //
-	path = strings.ReplaceAll(path, "//", "/")
-	return path
+// storageRoot returns the storage to serve from, the prefix of the paths in
+// the file registry and the resolver for URIs.
+func (s *Server) storageRoot() (Storage, string, Resolver) {
+	s.mu.RLock()
+	root, archives, resolver, symlinks := s.RootDir, s.Archives, s.Resolver, s.Symlinks
+	s.mu.RUnlock()
+	if s.Storage != nil {
+		return s.Storage, "", resolver
+	}
+	dir := DirStorage{Root: root, Symlinks: symlinks}
+	if archives {
+		return s.archiveStorage(dir), root, resolver
+	}
+	return dir, root, resolver
+}
+
+// archiveStorage returns the archive storage of dir, keeping the member
+// indexes as long as dir does not change.
+func (s *Server) archiveStorage(dir DirStorage) *ArchiveStorage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.archives == nil || s.archives.Storage != dir {
+		s.archives = NewArchiveStorage(dir)
+	}
+	return s.archives
 }
 
 func (s *Server) handleMDR(msg messages.MDR, addr net.Addr) {
 	// - MDR: check token, (check if file exists) lookup file id (= hash out of path + last modified), filesize, checksum
-	s.InfoLogger.Printf("MDR from %v for path %v\n", addr, string(msg.URI))
+	s.Logger.Info("MDR", "client", addr.String(), "uri", msg.URI)
+	a := s.access("MDR", addr)
+	a.uri = msg.URI
+	defer s.logAccess(a)
 
 	// check token
 	if !s.checkToken(addr, &msg.Header.Token) {
-		s.DebugLogger.Printf("Invalid token in MDR of %v, sending new token...\n", addr)
+		s.Logger.Debug("Invalid token in MDR, sending new token", "client", addr.String())
+		a.status = statusInvalidToken
 		s.sendNTM(msg.Header.Number, messages.NoError, addr)
 		return
 	}
 
 	// check if file exists
-	filepath := s.GetPath(msg.URI)
-	file, err := os.Stat(filepath)
-	if errors.Is(err, os.ErrNotExist) {
+	st, name, filepath, err := s.storage(msg.URI)
+	var file FileInfo
+	if err == nil {
+		file, err = st.Stat(name)
+	}
+	if err != nil {
 		// URI does not exist
-		s.DebugLogger.Printf("URI does not exits: %v\n", string(msg.URI))
+		s.Logger.Debug("URI does not exist", "uri", msg.URI, "err", err)
+		a.status = statusFileNotFound
 		msg := messages.ServerHeader{Version: messages.VERS, Type: messages.MDRR_t,
 			Number: msg.Header.Number, Error: messages.FileNotFound}
 		msg.Send(s.Conn, addr)
@@ -216,93 +495,70 @@ func (s *Server) handleMDR(msg messages.MDR, addr net.Addr) {
 	}
 
 	// filesize
-	filesize := file.Size()
+	filesize := file.Size
 	// round up
 	filesize_in_chunks := Ceil(filesize, int64(s.ChunkSize))
 	if filesize_in_chunks > (2<<48)-1 {
 		// file too large, cant serve -> return file not found: Implementation specific
-		s.WarnLogger.Printf("File is too large, cant serve: %v\n", string(msg.URI))
+		s.Logger.Warn("File is too large, cannot serve it", "uri", msg.URI)
+		a.status = statusFileNotFound
 		msg := messages.ServerHeader{Version: messages.VERS, Type: messages.MDRR_t,
 			Number: msg.Header.Number, Error: messages.FileNotFound}
 		msg.Send(s.Conn, addr)
 		return
 	}
 
-	var fileid uint32
-	var checksum *[32]uint8
-	for i := 0; i < 10; i++ {
-		if i == 8 {
-			// many tries, space must be almost full e.g. many outdate files
-			// delete old map and recreate
-			s.FileIDMap = make(map[uint32]FileM)
-			// run loop one more time, now we should find a valid id
-			continue
-		}
-		// lookup last modified
-		lastChanged := file.ModTime()
-		fileid, err = GetFileID(filepath, lastChanged, i)
-		if err != nil {
-			s.DebugLogger.Printf("error while getting file id: %v\n", err)
-			return
-		}
-		// check if file id is dict, if yes check if the same file, if no
-		// try to change the file twice, if they dont succeed, empty hash map
-
-		filem, ok := s.FileIDMap[fileid]
-		if ok {
-			if filem.Path == filepath && filem.T == lastChanged {
-				// same file: use this file id
-				checksum = filem.Checksum
-				break
-
-			} else {
-				// id exists in map -> try to find new id
-				continue
-			}
-		} else {
-			checksum, err = GetFileChecksum(filepath)
-			if err != nil {
-				s.DebugLogger.Printf("error while getting file checksum: %v\n", err)
-				return
-			}
-			s.FileIDMap[fileid] = FileM{Path: filepath, T: lastChanged, Try: i, Checksum: checksum}
-			break
-		}
-
+	// lookup last modified, or hash the new file (or new version of it); a
+	// large file is answered when the client retransmits the MDR
+	fileid, filem, err := s.registerBackground(st, name, filepath, file, mdrHashWait)
+	if err != nil {
+		s.Logger.Debug("Cannot get file checksum", "uri", msg.URI, "err", err)
+		a.err = err
+		return
 	}
+	a.fileID = &fileid
+	checksum := filem.Checksum
 
-	msgs := messages.GetMDRR(msg.Header.Number, messages.NoError, s.ChunkSize, s.MaxChunksInACR, fileid, *messages.Int2uint8_6_arr(uint64(filesize_in_chunks)), (*[32]uint8)(checksum))
+	msgs := messages.GetMDRR(msg.Header.Number, messages.NoError, s.ChunkSize, s.maxChunksInACR(), fileid, *messages.Int2uint8_6_arr(uint64(filesize_in_chunks)), (*[32]uint8)(checksum))
 	if err = msgs.Send(s.Conn, addr); err != nil {
-		s.WarnLogger.Printf("error while sending: %v\n", err)
+		s.Logger.Warn("Cannot send MDRR", "client", addr.String(), "err", err)
+		a.err = err
 	}
 
 }
 
 func (s *Server) handleACR(msg messages.ACR, addr net.Addr) {
 	// - ACR: check token, check file id in dict (what happens if mdr hasnt been send before?), read file chunk and return
-	s.InfoLogger.Printf("ACR from %v for id: 0x%x, with rate: %v and %v CRs \n", addr, msg.FileID, msg.PacketRate, len(msg.CRs))
+	s.Logger.Info("ACR", "client", addr.String(), "file_id", logging.FileID(msg.FileID), "rate", msg.PacketRate, "crs", len(msg.CRs))
+	a := s.access("ACR", addr)
+	a.fileID = &msg.FileID
+	defer s.logAccess(a)
 	if !s.checkToken(addr, &msg.Header.Token) {
-		s.DebugLogger.Printf("Invalid token in ACR of %v, sending new token\n", addr)
+		s.Logger.Debug("Invalid token in ACR, sending new token", "client", addr.String())
+		a.status = statusInvalidToken
 		s.sendNTM(msg.Header.Number, messages.NoError, addr)
 		return
 	}
 	// check if file id in dict otherwise invalid file id
-	filem, ok := s.FileIDMap[msg.FileID]
+	filem, ok := s.Files.Get(msg.FileID)
 	if !ok {
 		// fileid does not exist (yet)
-		s.DebugLogger.Printf("FileID 0x%x does not exist\n", msg.FileID)
+		s.Logger.Debug("File ID does not exist", "file_id", logging.FileID(msg.FileID))
+		a.status = statusInvalidFileID
 		msg := messages.ServerHeader{Version: messages.VERS, Type: messages.CRR_t,
 			Number: msg.Header.Number, Error: messages.InvalidFileID}
 		msg.Send(s.Conn, addr)
 		return
 	}
+	a.file = filem.Name
 	// check file exists with the save timestamp
-	file, err := os.Stat(filem.Path)
-	if errors.Is(err, os.ErrNotExist) || file.ModTime() != filem.T {
+	file, err := filem.Storage.Stat(filem.Name)
+	if err != nil || !filem.matches(file) {
 		// file does no longer exist or has been modified
-		s.DebugLogger.Printf("FileID %x does no longer exist\n", msg.FileID)
-		// delete from dict
-		delete(s.FileIDMap, msg.FileID)
+		s.Logger.Debug("File ID does no longer exist", "file_id", logging.FileID(msg.FileID))
+		a.status = statusInvalidFileID
+		// delete from registry
+		s.Files.Delete(msg.FileID, filem)
 		// send error message
 		msg := messages.ServerHeader{Version: messages.VERS, Type: messages.CRR_t,
 			Number: msg.Header.Number, Error: messages.InvalidFileID}
@@ -310,14 +566,19 @@ func (s *Server) handleACR(msg messages.ACR, addr net.Addr) {
 		return
 	}
 
-	// wait with specify rate: 1/rate
-	delta_t := 1.0 / (float64(msg.PacketRate) + s.RateIncrease) * float64(time.Second)
+	// the CRRs are sent by the scheduler with the requested rate
+	rate := float64(msg.PacketRate) + s.rateIncrease()
+	s.metrics.acrRate.Observe(rate)
+	conn := s.sched.open(addr, rate)
+	defer conn.Close()
 
 	amount_chunks := 0
+	max_chunks := s.maxChunksInACR()
 
-	f, err := os.Open(filem.Path)
+	f, err := filem.Storage.Open(filem.Name)
 	if err != nil {
-		s.DebugLogger.Printf("error while opening file: %v\n", err)
+		s.Logger.Debug("Cannot open file", "name", filem.Name, "err", err)
+		a.err = err
 		return
 	}
 	defer f.Close()
@@ -325,7 +586,6 @@ func (s *Server) handleACR(msg messages.ACR, addr net.Addr) {
 	// open chunk after each other and send with given rate + add some constant (todo: define constant in server struct)
 	for _, i := range msg.CRs {
 		offset := messages.Uint8_6_arr2Int(i.ChunkOffset)
-		f.Seek(int64(offset*uint64(s.ChunkSize)), 0)
 
 		// for stupid "zero length has the last priority reasons":
 		var l int
@@ -339,45 +599,53 @@ func (s *Server) handleACR(msg messages.ACR, addr net.Addr) {
 			chunk_number := offset + uint64(j)
 			amount_chunks++
 			// check too many chunks
-			if amount_chunks > int(s.MaxChunksInACR) {
-				s.DebugLogger.Printf("Too many chunks requested by %v\n", addr)
+			if amount_chunks > int(max_chunks) {
+				s.Logger.Debug("Too many chunks requested", "client", addr.String())
+				a.status = statusTooManyChunks
 				msg := messages.ServerHeader{Version: messages.VERS, Type: messages.CRR_t,
 					Number: msg.Header.Number, Error: messages.TooManyChunks}
-				msg.Send(s.Conn, addr)
+				msg.Send(conn, addr)
 				return
 			}
 
 			// check chunk out of bounds
-			if (offset+uint64(j))*uint64(s.ChunkSize) > uint64(file.Size()) {
-				s.DebugLogger.Printf("CR %v out of bounds from %v\n", j, addr)
+			if (offset+uint64(j))*uint64(s.ChunkSize) > uint64(file.Size) {
+				s.Logger.Debug("Chunk out of bounds", "client", addr.String(), "chunk", chunk_number)
+				a.status = statusChunkOutOfBounds
 				zero_data := make([]uint8, 0)
 				msg := messages.GetCRR(msg.Header.Number, messages.ChunkOutOfBounds, *messages.Int2uint8_6_arr(chunk_number), &zero_data)
-				msg.Send(s.Conn, addr)
+				msg.Send(conn, addr)
 				break
 			}
 
 			// check zero length
 			if i.Length == 0 {
-				s.DebugLogger.Printf("CR %v has zero length from %v\n", j, addr)
+				s.Logger.Debug("CR has zero length", "client", addr.String(), "chunk", chunk_number)
+				a.status = statusZeroLengthCR
 				msg := messages.ServerHeader{Version: messages.VERS, Type: messages.CRR_t,
 					Number: msg.Header.Number, Error: messages.ZeroLengthCR}
-				msg.Send(s.Conn, addr)
+				msg.Send(conn, addr)
 				break
 			}
 
 			// read up to chunk size bytes
 			buf := make([]uint8, s.ChunkSize)
-			n, err := f.Read(buf)
-			if err != nil {
-				s.WarnLogger.Printf("error while reading from the file: %v\n", err)
+			n, err := f.ReadAt(buf, int64(chunk_number*uint64(s.ChunkSize)))
+			if n == 0 && err != nil {
+				s.Logger.Warn("Cannot read from file", "name", filem.Name, "err", err)
+				a.err = err
 				continue
 			}
 			// send the read bytes
 			chunk := buf[:n]
 			msg := messages.GetCRR(msg.Header.Number, messages.NoError, *messages.Int2uint8_6_arr(chunk_number), &chunk)
-			msg.Send(s.Conn, addr)
-
-			time.Sleep(time.Duration(delta_t))
+			if err := msg.Send(conn, addr); errors.Is(err, net.ErrClosed) {
+				// the server has been shut down before the ACR was answered
+				s.Logger.Warn("Socket closed, aborting ACR", "client", addr.String())
+				a.err = err
+				return
+			}
+			a.chunks++
 
 		}
 
@@ -389,44 +657,23 @@ func (s *Server) sendNTM(number uint8, err uint8, addr net.Addr) {
 	token := s.createToken(addr)
 	ntm := messages.GetNTM(number, err, &token)
 	ntm.Send(s.Conn, addr)
+	s.metrics.ntms.Inc()
 }
 
-func (s *Server) createToken(addr net.Addr) [32]uint8 {
-	ip_port_bytes := getPortIPBytes(addr)
-
-	data := make([]byte, len(ip_port_bytes)+len(s.key))
-	copy(data[:len(ip_port_bytes)], ip_port_bytes)
-	copy(data[len(ip_port_bytes):], s.key)
-	return sha256.Sum256(data)
-}
-
-func (s *Server) checkToken(addr net.Addr, Token *[32]uint8) bool {
-	return s.createToken(addr) == *Token
-}
-
-func (s *Server) StopListening(cl chan bool) {
-	cl <- false
-}
-
-// false if something is send to the close channel, else otherwise
-// whether to continue the loop in the Listen method
-func cont(cl chan bool) bool {
-	select {
-	case <-cl:
-		return false
-	default:
-		return true
-	}
-}
-
-// returns IP + Port bytes slice
+// returns IP + Port bytes slice. IPv4 addresses are 4 bytes long, whether
+// they were received on an IPv4 or, IPv4-mapped, on a dual stack socket.
 func getPortIPBytes(addr net.Addr) []byte {
-	// cast to net.UDPAddr
-	udpaddr := addr.(*net.UDPAddr)
-	ip_bytes := []byte(udpaddr.IP)
+	udpaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return []byte(addr.String())
+	}
+	ip_bytes := []byte(udpaddr.IP.To16())
+	if ip4 := udpaddr.IP.To4(); ip4 != nil {
+		ip_bytes = []byte(ip4)
+	}
 	port_bytes := make([]byte, 2)
 	binary.LittleEndian.PutUint16(port_bytes, uint16(udpaddr.Port))
-	return append(ip_bytes, port_bytes...)
+	return append(append([]byte(nil), ip_bytes...), port_bytes...)
 }
 
 func Max(x, y uint64) uint64 {
@@ -1,13 +1,30 @@
 package server
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/logging"
+	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/merkle"
 	"gitlab.lrz.de/protocol-design-sose-2022-team-0/sanft/messages"
 )
 
@@ -16,11 +33,169 @@ func TestGetPath(t *testing.T) {
 	if err != nil {
 		t.Fatalf(`Error creating server: %v`, err)
 	}
+	defer s.Conn.Close()
 	s.RootDir = "srv/"
-	assert.Equal(t, s.GetPath("asdf.txt"), "srv/asdf.txt", "wrong path")
-	assert.Equal(t, s.GetPath("../asdf.txt"), "srv/asdf.txt", "wrong path")
-	assert.Equal(t, s.GetPath("//asdf.txt"), "srv/asdf.txt", "wrong path")
-	assert.Equal(t, s.GetPath("/asdf.txt"), "srv/asdf.txt", "wrong path")
+	for uri, want := range map[string]string{
+		"asdf.txt":          "srv/asdf.txt",
+		"//asdf.txt":        "srv/asdf.txt",
+		"/asdf.txt":         "srv/asdf.txt",
+		"a..b":              "srv/a..b",
+		"dir/../asdf.txt":   "srv/asdf.txt",
+		"a%20b.txt":         "srv/a b.txt",
+		"sanft:///x":        "srv/x",
+		"a:b.txt":           "srv/a:b.txt",
+		"what%3F.txt":       "srv/what?.txt",
+		"./dir//./asdf.txt": "srv/dir/asdf.txt",
+	} {
+		path, err := s.GetPath(uri)
+		assert.Nil(t, err, "%v rejected", uri)
+		assert.Equal(t, want, path, "wrong path for %v", uri)
+	}
+}
+
+// Traversal attacks and other URIs which must not be served.
+func TestResolveRejects(t *testing.T) {
+	r := Resolver{Deny: []string{"*.key", "private/*", "secret"}}
+	for _, c := range []struct {
+		uri string
+		err error
+	}{
+		{"../asdf.txt", ErrOutsideRoot},
+		{"/../asdf.txt", ErrOutsideRoot},
+		{"dir/../../asdf.txt", ErrOutsideRoot},
+		{"%2e%2e/asdf.txt", ErrOutsideRoot},
+		{"sanft:///../etc/passwd", ErrOutsideRoot},
+		{"..%2fasdf.txt", ErrInvalidURI},
+		{"dir%2f..%2f..%2fetc/passwd", ErrInvalidURI},
+		{"a%2Fb.txt", ErrInvalidURI},
+		{"sanft://host/x", ErrInvalidURI},
+		{"sanft://host/../etc/passwd", ErrInvalidURI},
+		{"", ErrInvalidURI},
+		{"/", ErrInvalidURI},
+		{"dir/..", ErrInvalidURI},
+		{"a%zzb", ErrInvalidURI},
+		{"a%00b", ErrInvalidURI},
+		{"a.txt?x=1", ErrInvalidURI},
+		{"a.txt#frag", ErrInvalidURI},
+		{"sanft:a.txt", ErrInvalidURI},
+		{"sanft://user@host/a.txt", ErrInvalidURI},
+		{".env", ErrNotServed},
+		{"dir/.git/config", ErrNotServed},
+		{"%2essh/id_rsa", ErrNotServed},
+		{"server.key", ErrNotServed},
+		{"dir/server.key", ErrNotServed},
+		{"private/a.txt", ErrNotServed},
+		{"secret/a.txt", ErrNotServed},
+		{"dir/secret", ErrNotServed},
+	} {
+		_, err := r.Resolve(c.uri)
+		assert.ErrorIs(t, err, c.err, "wrong error for %q", c.uri)
+	}
+
+	r = Resolver{Hidden: true, Allow: []string{"*.txt", "pub/*"}}
+	for uri, ok := range map[string]bool{
+		"a.txt":        true,
+		"dir/a.txt":    true,
+		".hidden.txt":  true,
+		"pub/data.bin": true,
+		"a.bin":        false,
+		"dir/pub/a":    false,
+	} {
+		_, err := r.Resolve(uri)
+		assert.Equal(t, ok, err == nil, "wrong result for %q: %v", uri, err)
+	}
+	assert.NotNil(t, CheckPatterns([]string{"[a-"}), "malformed pattern accepted")
+}
+
+func TestSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(outside+"/secret.txt", []byte("secret"), 0644)
+	root := t.TempDir()
+	os.Mkdir(root+"/dir", 0755)
+	os.WriteFile(root+"/dir/a.txt", []byte("a"), 0644)
+	for link, target := range map[string]string{
+		"inside.txt": root + "/dir/a.txt",
+		"insidedir":  "dir",
+		"out.txt":    outside + "/secret.txt",
+		"outdir":     outside,
+		"up":         "..",
+	} {
+		if err := os.Symlink(target, root+"/"+link); err != nil {
+			t.Skipf(`symlinks not supported: %v`, err)
+		}
+	}
+
+	for policy, served := range map[SymlinkPolicy][]string{
+		SymlinksInside: {"dir/a.txt", "inside.txt", "insidedir/a.txt"},
+		SymlinksFollow: {"dir/a.txt", "inside.txt", "insidedir/a.txt", "out.txt", "outdir/secret.txt"},
+		SymlinksDeny:   {"dir/a.txt"},
+	} {
+		d := DirStorage{Root: root + "/", Symlinks: policy}
+		for _, name := range []string{"dir/a.txt", "inside.txt", "insidedir/a.txt", "out.txt", "outdir/secret.txt"} {
+			want := false
+			for _, s := range served {
+				want = want || s == name
+			}
+			_, err := d.Stat(name)
+			assert.Equal(t, want, err == nil, "Stat %v with policy %v: %v", name, policy, err)
+			f, err := d.Open(name)
+			assert.Equal(t, want, err == nil, "Open %v with policy %v: %v", name, policy, err)
+			if err == nil {
+				f.Close()
+			}
+		}
+	}
+}
+
+
+// A link swapped while a name is opened does not get around the policy.
+func TestSymlinkSwap(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(outside+"/a.txt", []byte("secret"), 0644)
+	root := t.TempDir()
+	os.Mkdir(root+"/real", 0755)
+	os.WriteFile(root+"/real/a.txt", []byte("public"), 0644)
+	if err := os.Symlink("real", root+"/sw"); err != nil {
+		t.Skipf(`symlinks not supported: %v`, err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			target := "real"
+			if i%2 == 1 {
+				target = outside
+			}
+			os.Symlink(target, root+"/sw.tmp")
+			os.Rename(root+"/sw.tmp", root+"/sw")
+		}
+	}()
+	defer wg.Wait()
+	defer close(done)
+
+	buf := make([]byte, 6)
+	for _, policy := range []SymlinkPolicy{SymlinksInside, SymlinksDeny} {
+		d := DirStorage{Root: root + "/", Symlinks: policy}
+		for end := time.Now().Add(100 * time.Millisecond); time.Now().Before(end); {
+			f, err := d.Open("sw/a.txt")
+			if err != nil {
+				continue
+			}
+			f.ReadAt(buf, 0)
+			f.Close()
+			if string(buf) == "secret" {
+				t.Fatalf(`file outside the root served with policy %v`, policy)
+			}
+		}
+	}
 }
 
 
@@ -29,6 +204,7 @@ func TestToken(t *testing.T) {
 	if err != nil {
 		t.Fatalf(`Error creating server: %v`, err)
 	}
+	defer s.Conn.Close()
 
 	addr := net.UDPAddr{
 		Port: 1000,
@@ -48,6 +224,172 @@ func TestToken(t *testing.T) {
 	assert.False(t, s.checkToken(&addr2, &token), "Token match but should miss match")
 }
 
+func TestTokenRotation(t *testing.T) {
+	s, err := Init(net.ParseIP("127.0.0.102"), 12355, "/", 1024, 1, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s.Conn.Close()
+
+	addr := net.UDPAddr{Port: 1000, IP: net.ParseIP("127.100.0.1")}
+	token := s.createToken(&addr)
+
+	// tokens of the previous key are accepted during the overlap
+	s.NewKey()
+	assert.NotEqual(t, token, s.createToken(&addr), "new key should create another token")
+	assert.True(t, s.checkToken(&addr, &token), "token of the previous key should be accepted")
+
+	// but not after the next rotation
+	s.NewKey()
+	assert.False(t, s.checkToken(&addr, &token), "token of an older key should be rejected")
+
+	// nor without overlap
+	s.KeyOverlap = 0
+	token = s.createToken(&addr)
+	s.NewKey()
+	assert.False(t, s.checkToken(&addr, &token), "token should be rejected without overlap")
+	token = s.createToken(&addr)
+	assert.True(t, s.checkToken(&addr, &token), "token of the current key should be accepted")
+}
+
+func TestKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	s1, err := Init(net.ParseIP("127.0.0.102"), 12355, "/", 1024, 1, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s1.Conn.Close()
+	s2, err := Init(net.ParseIP("127.0.0.102"), 12356, "/", 1024, 1, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s2.Conn.Close()
+
+	// the first server creates the file, the second one uses its key
+	assert.Nil(t, s1.UseKeyFile(path))
+	assert.FileExists(t, path)
+	assert.Nil(t, s2.UseKeyFile(path))
+	addr := net.UDPAddr{Port: 1000, IP: net.ParseIP("127.100.0.1")}
+	token := s1.createToken(&addr)
+	assert.True(t, s2.checkToken(&addr, &token), "servers sharing a key file should accept each other's tokens")
+
+	// a rotation is picked up by the other server, which keeps accepting the
+	// previous key
+	s1.NewKey()
+	newToken := s1.createToken(&addr)
+	s2.keys.lastCheck = time.Time{}
+	s2.RefreshKey()
+	assert.Equal(t, newToken, s2.createToken(&addr), "rotation should be picked up from the key file")
+	assert.True(t, s2.checkToken(&addr, &token), "token of the previous key should be accepted")
+
+	// an expired key in the file is replaced by the first server refreshing
+	keys := s1.keys.load()
+	s1.keys.store(&tokenKeys{current: &tokenKey{key: keys.current.key, created: keys.current.created,
+		validUntil: time.Now().Add(-time.Second)}})
+	s1.RefreshKey()
+	assert.NotEqual(t, newToken, s1.createToken(&addr), "expired key should be replaced")
+	s2.keys.lastCheck = time.Time{}
+	s2.RefreshKey()
+	assert.Equal(t, s1.createToken(&addr), s2.createToken(&addr), "servers should use the same key")
+
+	// keys survive a restart
+	s1.Conn.Close()
+	s3, err := Init(net.ParseIP("127.0.0.102"), 12355, "/", 1024, 1, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s3.Conn.Close()
+	assert.Nil(t, s3.UseKeyFile(path))
+	assert.Equal(t, s2.createToken(&addr), s3.createToken(&addr), "key should be loaded from the key file")
+	assert.True(t, s3.checkToken(&addr, &newToken), "previous key should be loaded from the key file")
+
+	// an invalid key file is rejected
+	assert.Nil(t, os.WriteFile(path, []byte("{}"), 0o600))
+	s4, err := Init(net.ParseIP("127.0.0.102"), 12357, "/", 1024, 1, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s4.Conn.Close()
+	assert.NotNil(t, s4.UseKeyFile(path))
+}
+
+// request sends msg on c and returns the parsed response.
+func request(t *testing.T, c *net.UDPConn, msg messages.MDR) messages.ServerMessage {
+	t.Helper()
+	if err := msg.Send(c); err != nil {
+		t.Fatalf(`Send failed: %v`, err)
+	}
+	msgr, err := messages.ClientReceive(c, 10000)
+	if err != nil {
+		t.Fatalf(`Client Receive failed: %v`, err)
+	}
+	parsed, err := messages.ParseServer(&msgr)
+	if err != nil {
+		t.Fatalf(`parse failed: %v`, err)
+	}
+	return parsed
+}
+
+func TestIPv6(t *testing.T) {
+	// an IPv6 and an IPv4 address
+	s, err := Init(net.IPv6loopback, 12355, "./", 20, 10, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s.Conn.Close()
+	s.SetLogLevel("warn")
+	if err := s.Listen(net.ParseIP("127.0.0.102"), 12355); err != nil {
+		t.Fatalf(`Listen failed: %v`, err)
+	}
+	assert.Equal(t, 2, len(s.Addrs()))
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	for _, ip := range []string{"::1", "127.0.0.102"} {
+		// connected sockets only receive responses sent from the address
+		// they sent to
+		c, err := messages.CreateClientSocket(net.ParseIP(ip), 12355)
+		if err != nil {
+			t.Fatalf(`Creating client failed: %v`, err)
+		}
+		defer c.Close()
+		ntm, ok := request(t, c, *messages.GetMDR(0, messages.EmptyToken(), "test.txt")).(messages.NTM)
+		assert.True(t, ok, "should get an NTM over %v", ip)
+		mdrr, ok := request(t, c, *messages.GetMDR(1, &ntm.Token, "test.txt")).(messages.MDRR)
+		assert.True(t, ok, "should get an MDRR over %v", ip)
+		assert.Equal(t, messages.NoError, mdrr.Header.Error)
+	}
+
+	// dual stack
+	s2, err := Init(net.IPv6unspecified, 12356, "./", 20, 10, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s2.Conn.Close()
+	s2.SetLogLevel("warn")
+	go s2.Serve(context.Background())
+	defer s2.Shutdown(context.Background())
+
+	for _, ip := range []string{"::1", "127.0.0.1"} {
+		c, err := messages.CreateClientSocket(net.ParseIP(ip), 12356)
+		if err != nil {
+			t.Fatalf(`Creating client failed: %v`, err)
+		}
+		defer c.Close()
+		ntm, ok := request(t, c, *messages.GetMDR(0, messages.EmptyToken(), "test.txt")).(messages.NTM)
+		assert.True(t, ok, "should get an NTM over %v", ip)
+		// the token of an IPv4 client does not depend on whether its
+		// address was received IPv4-mapped
+		local := c.LocalAddr().(*net.UDPAddr)
+		assert.Equal(t, s2.createToken(local), ntm.Token, "token over %v", ip)
+		mapped := &net.UDPAddr{IP: local.IP.To16(), Port: local.Port}
+		assert.Equal(t, s2.createToken(mapped), ntm.Token, "token over %v", ip)
+		mdrr, ok := request(t, c, *messages.GetMDR(1, &ntm.Token, "test.txt")).(messages.MDRR)
+		assert.True(t, ok, "should get an MDRR over %v", ip)
+		assert.Equal(t, messages.NoError, mdrr.Header.Error)
+	}
+}
+
 func TestMDR(t *testing.T) {
 	s, err := Init(net.ParseIP("127.0.0.100"), 12345, "./", 20, 10, 0, 0, 0)
 	if err != nil {
@@ -61,9 +403,8 @@ func TestMDR(t *testing.T) {
 	}
 	defer c.Close()
 
-	close := make(chan bool)
-	go s.Listen(close)
-	defer s.StopListening(close)
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
 
 	msg := messages.GetMDR(0, messages.EmptyToken(), "test.txt")
 	msg.Send(c)
@@ -135,7 +476,7 @@ func TestMDR(t *testing.T) {
 	assert.Equal(t, header.Type, messages.MDRR_t, "Should be mdrr messages")
 
 	// id already taken
-	s.FileIDMap[fileid] = FileM{}
+	s.Files.Store(fileid, FileM{})
 	msg = messages.GetMDR(1, &token, "test.txt")
 	msg.Send(c)
 	msgr, err = messages.ClientReceive(c, 10000)
@@ -152,7 +493,8 @@ func TestMDR(t *testing.T) {
 	ch, _ = hex.DecodeString("3c61b3311004a65a70fd313afb943c94ac8dfaae8a00000efe85db25d9e288f1")
 	ch2 = (*[32]uint8)(ch)
 	assert.Equal(t, mdrr.Checksum, *ch2, "wrong checksum")
-	assert.True(t, s.FileIDMap[mdrr.FileID].Try >= 1, "try should be at least 1")
+	filem, _ := s.Files.Get(mdrr.FileID)
+	assert.True(t, filem.Try >= 1, "try should be at least 1")
 
 	// map completely full -> out of ram :(
 	// for i := 0; i < 2<<32; i++ {
@@ -160,11 +502,12 @@ func TestMDR(t *testing.T) {
 	// }
 
 	// simulate by filling all "try" slots
-	mypath := s.FileIDMap[mdrr.FileID].Path
-	mytime := s.FileIDMap[mdrr.FileID].T
+	filem, _ = s.Files.Get(mdrr.FileID)
+	mypath := filem.Path
+	mytime := filem.T
 	for i := 0; i < 10; i++ {
 		fid, _ := GetFileID(mypath, mytime, i)
-		s.FileIDMap[fid] = FileM{}
+		s.Files.Store(fid, FileM{})
 	}
 
 	msg = messages.GetMDR(1, &token, "test.txt")
@@ -183,8 +526,9 @@ func TestMDR(t *testing.T) {
 	ch, _ = hex.DecodeString("3c61b3311004a65a70fd313afb943c94ac8dfaae8a00000efe85db25d9e288f1")
 	ch2 = (*[32]uint8)(ch)
 	assert.Equal(t, mdrr.Checksum, *ch2, "wrong checksum")
-	assert.True(t, s.FileIDMap[mdrr.FileID].Try >= 9, "try should be at least 1")
-	_, ok := s.FileIDMap[0]
+	filem, _ = s.Files.Get(mdrr.FileID)
+	assert.True(t, filem.Try >= 9, "try should be at least 1")
+	_, ok := s.Files.Get(0)
 	assert.False(t, ok, "map should be emptied -> zero id should not be in the map any more")
 
 }
@@ -202,9 +546,8 @@ func TestACR(t *testing.T) {
 	}
 	defer c.Close()
 
-	close := make(chan bool)
-	go s.Listen(close)
-	defer s.StopListening(close)
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
 
 	msg := messages.GetMDR(0, messages.EmptyToken(), "test.txt")
 	msg.Send(c)
@@ -461,7 +804,7 @@ func TestACR(t *testing.T) {
 	f.Close()
 
 	// fileid should still exist in server
-	_, ok := s.FileIDMap[fileid]
+	_, ok := s.Files.Get(fileid)
 	assert.True(t, ok, "file id should still be in server map")
 
 	msgacr = messages.GetACR(1, &token, fileid, 1, &crlist)
@@ -481,13 +824,15 @@ func TestACR(t *testing.T) {
 	assert.Equal(t, header.Version, messages.VERS, "Returned wrong version")
 	assert.Equal(t, header.Error, messages.InvalidFileID, "error should be invalid file id")
 
-	_, ok = s.FileIDMap[fileid]
+	_, ok = s.Files.Get(fileid)
 	assert.False(t, ok, "file id should now be deleted from server map")
 
 
 	// test key validity
 
-	s.valid_until = time.Now().Add(-time.Second)
+	// an expired key is replaced, but its tokens are accepted for the overlap
+	key := s.keys.load().current
+	s.keys.store(&tokenKeys{current: &tokenKey{key: key.key, validUntil: time.Now().Add(-time.Second)}})
 
 	crlist = make([]messages.CR, 1)
 	crlist[0] = messages.CR{ChunkOffset: *messages.Int2uint8_6_arr(0), Length: 1}
@@ -495,6 +840,25 @@ func TestACR(t *testing.T) {
 	msgacr = messages.GetACR(1, &token, fileid, 1, &crlist)
 	msgacr.Send(c)
 
+	msgr, err = messages.ClientReceive(c, 10000)
+	if err != nil {
+		t.Fatalf(`Client Receive failed: %v`, err)
+	}
+	parsed, err = messages.ParseServer(&msgr)
+	if err != nil {
+		t.Fatalf(`parse failed: %v`, err)
+	}
+	header = parsed.(messages.ServerHeader)
+	assert.Equal(t, header.Error, messages.InvalidFileID, "token of the previous key should be accepted")
+	assert.False(t, bytes.Equal(s.keys.load().current.key, key.key), "key should be replaced")
+
+	// after the overlap the token is invalid
+	keys := s.keys.load()
+	s.keys.store(&tokenKeys{current: keys.current, previous: keys.previous, previousUntil: time.Now().Add(-time.Second)})
+
+	msgacr = messages.GetACR(1, &token, fileid, 1, &crlist)
+	msgacr.Send(c)
+
 	msgr, err = messages.ClientReceive(c, 10000)
 	if err != nil {
 		t.Fatalf(`Client Receive failed: %v`, err)
@@ -511,3 +875,1420 @@ func TestACR(t *testing.T) {
 	assert.NotEqual(t, ntm.Token, token, "token should not match the previous")
 
 }
+
+// Many clients request the same file at the same time while the key is
+// rotated. Run with -race to detect unsynchronized accesses to the server
+// state.
+func TestConcurrentClients(t *testing.T) {
+	s, err := Init(net.ParseIP("127.0.0.101"), 12346, "./", 20, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s.Conn.Close()
+	s.SetLogLevel("warn")
+
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	stop := make(chan struct{})
+	var rotator sync.WaitGroup
+	rotator.Add(1)
+	go func() {
+		defer rotator.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.NewKey()
+				s.RefreshKey()
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.101"), 12346)
+			if err != nil {
+				t.Errorf(`Creating client failed: %v`, err)
+				return
+			}
+			defer c.Close()
+
+			// Get metadata, then two chunks. The key rotation can invalidate
+			// the token at any time, so retry on NTMs.
+			token := messages.EmptyToken()
+			var fileid uint32
+			gotMDRR := false
+			crlist := []messages.CR{{ChunkOffset: *messages.Int2uint8_6_arr(0), Length: 2}}
+			for try := 0; try < 100; try++ {
+				if !gotMDRR {
+					msg := messages.GetMDR(uint8(try), token, "test.txt")
+					msg.Send(c)
+				} else {
+					msg := messages.GetACR(uint8(try), token, fileid, 1000, &crlist)
+					msg.Send(c)
+				}
+				data, err := messages.ClientReceive(c, 5000)
+				if err != nil {
+					t.Errorf(`Client Receive failed: %v`, err)
+					return
+				}
+				parsed, err := messages.ParseServer(&data)
+				if err != nil {
+					t.Errorf(`parse failed: %v`, err)
+					return
+				}
+				switch m := parsed.(type) {
+				case messages.NTM:
+					token = &m.Token
+				case messages.MDRR:
+					assert.Equal(t, int64(messages.Uint8_6_arr2Int(m.FileSize)), Ceil(676, int64(s.ChunkSize)), "wrong size")
+					fileid = m.FileID
+					gotMDRR = true
+				case messages.CRR:
+					assert.Equal(t, uint64(0), messages.Uint8_6_arr2Int(m.ChunkNumber), "wrong chunk number")
+					data, err := messages.ClientReceive(c, 5000)
+					if err != nil {
+						t.Errorf(`Client Receive failed: %v`, err)
+						return
+					}
+					parsed, err := messages.ParseServer(&data)
+					if err != nil {
+						t.Errorf(`parse failed: %v`, err)
+						return
+					}
+					crr := parsed.(messages.CRR)
+					assert.Equal(t, uint64(1), messages.Uint8_6_arr2Int(crr.ChunkNumber), "wrong chunk number")
+					return
+				default:
+					t.Errorf("unexpected response %v", parsed)
+					return
+				}
+			}
+			t.Errorf("no CRR after 100 tries")
+		}()
+	}
+	wg.Wait()
+	stop <- struct{}{}
+	rotator.Wait()
+	assert.Equal(t, 1, s.Files.Len(), "all clients should share one file ID")
+}
+
+// An ACR that has been started is answered completely after Shutdown, but no
+// new requests are accepted.
+func TestShutdown(t *testing.T) {
+	s, err := Init(net.ParseIP("127.0.0.102"), 12347, "./", 20, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(context.Background()) }()
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12347)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+
+	// get token and file id
+	token := messages.EmptyToken()
+	var fileid uint32
+	gotMDRR := false
+	for !gotMDRR {
+		msg := messages.GetMDR(0, token, "test.txt")
+		msg.Send(c)
+		data, err := messages.ClientReceive(c, 5000)
+		if err != nil {
+			t.Fatalf(`Client Receive failed: %v`, err)
+		}
+		parsed, err := messages.ParseServer(&data)
+		if err != nil {
+			t.Fatalf(`parse failed: %v`, err)
+		}
+		switch m := parsed.(type) {
+		case messages.NTM:
+			token = &m.Token
+		case messages.MDRR:
+			fileid = m.FileID
+			gotMDRR = true
+		}
+	}
+
+	// 10 chunks at 50 chunks/s take about 200ms
+	crlist := []messages.CR{{ChunkOffset: *messages.Int2uint8_6_arr(0), Length: 10}}
+	acr := messages.GetACR(1, token, fileid, 50, &crlist)
+	acr.Send(c)
+	_, err = messages.ClientReceive(c, 5000)
+	if err != nil {
+		t.Fatalf(`Client Receive failed: %v`, err)
+	}
+
+	err = s.Shutdown(context.Background())
+	assert.Nil(t, err, "shutdown failed")
+	assert.ErrorIs(t, <-served, ErrServerClosed, "wrong error from Serve")
+
+	// the remaining chunks have been sent before the socket was closed
+	for i := 1; i < 10; i++ {
+		data, err := messages.ClientReceive(c, 1000)
+		if err != nil {
+			t.Fatalf(`Chunk %v missing: %v`, i, err)
+		}
+		parsed, err := messages.ParseServer(&data)
+		if err != nil {
+			t.Fatalf(`parse failed: %v`, err)
+		}
+		crr, ok := parsed.(messages.CRR)
+		if !ok {
+			t.Fatalf(`Expected CRR, got %T`, parsed)
+		}
+		assert.Equal(t, uint64(i), messages.Uint8_6_arr2Int(crr.ChunkNumber), "wrong chunk number")
+	}
+
+	// new requests are not answered anymore
+	msg := messages.GetMDR(2, token, "test.txt")
+	msg.Send(c)
+	_, err = messages.ClientReceive(c, 200)
+	assert.NotNil(t, err, "request answered after shutdown")
+	assert.ErrorIs(t, s.Serve(context.Background()), ErrServerClosed, "Serve after Shutdown")
+}
+
+// Shutdown gives up on in-flight ACRs when its context is done.
+func TestShutdownDeadline(t *testing.T) {
+	s, err := Init(net.ParseIP("127.0.0.102"), 12348, "./", 20, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.Logger = logging.New(io.Discard, "text", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx) }()
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12348)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+
+	// an ACR which would take 4s to answer
+	token := s.createToken(c.LocalAddr())
+	info, err := DirStorage{Root: "./"}.Stat("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileid, _ := s.Files.Register(FileM{Path: "./test.txt", T: info.ModTime, Size: info.Size, Inode: info.Inode,
+		Storage: DirStorage{Root: "./"}, Name: "test.txt"})
+	crlist := []messages.CR{{ChunkOffset: *messages.Int2uint8_6_arr(0), Length: 20}}
+	acr := messages.GetACR(1, &token, fileid, 5, &crlist)
+	acr.Send(c)
+	_, err = messages.ClientReceive(c, 5000)
+	if err != nil {
+		t.Fatalf(`Client Receive failed: %v`, err)
+	}
+
+	// cancelling the context only stops accepting requests
+	cancel()
+	assert.ErrorIs(t, <-served, context.Canceled, "wrong error from Serve")
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelShutdown()
+	start := time.Now()
+	err = s.Shutdown(shutdownCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "shutdown should time out")
+	assert.Less(t, time.Since(start), time.Second, "shutdown took too long")
+}
+
+func getPath(t *testing.T, s *Server, uri string) string {
+	path, err := s.GetPath(uri)
+	if err != nil {
+		t.Fatalf(`GetPath failed: %v`, err)
+	}
+	return path
+}
+
+func fileModTime(t *testing.T, path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf(`stat failed: %v`, err)
+	}
+	return info.ModTime()
+}
+
+func TestReadConfig(t *testing.T) {
+	conf, err := ReadConfig(strings.NewReader(`{"host": "127.0.0.1", "file-dir": "srv", "rate-increase": 10, "log-level": "debug"}`))
+	if err != nil {
+		t.Fatalf(`Reading config failed: %v`, err)
+	}
+	assert.Equal(t, "127.0.0.1", conf.Host, "wrong host")
+	assert.Equal(t, "srv", conf.RootDir, "wrong root dir")
+	assert.Equal(t, 10.0, conf.RateIncrease, "wrong rate increase")
+	assert.Equal(t, "debug", conf.LogLevel, "wrong log level")
+	// defaults
+	assert.Equal(t, DefaultConfig.Port, conf.Port, "wrong default port")
+	assert.Equal(t, DefaultConfig.ChunkSize, conf.ChunkSize, "wrong default chunk size")
+
+	for _, c := range []string{
+		`{"chunksize": 10}`,
+		`{"log-level": "verbose"}`,
+		`{"host": "localhost"}`,
+		`{"rate-increase": -1}`,
+		`{"port": "1337"}`,
+	} {
+		_, err := ReadConfig(strings.NewReader(c))
+		assert.NotNil(t, err, "invalid config accepted: %v", c)
+	}
+}
+
+// Reloading changes the served directory and rate without restarting.
+func TestReload(t *testing.T) {
+	conf := DefaultConfig
+	conf.Host = "127.0.0.102"
+	conf.Port = 12349
+	conf.LogLevel = "warn"
+	conf.HashWorkers = 3
+	s, err := New(&conf)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s.Conn.Close()
+	assert.Equal(t, "./", s.RootDir, "wrong root dir")
+	assert.Equal(t, 3, cap(s.hashes.workers), "wrong number of hash workers")
+	assert.Equal(t, "./test.txt", getPath(t, s, "test.txt"), "wrong path")
+
+	dir := t.TempDir()
+	conf.RootDir = dir
+	conf.RateIncrease = 5
+	conf.MaxChunksInACR = 7
+	err = s.Reload(&conf)
+	assert.Nil(t, err, "reload failed")
+	assert.Equal(t, dir+"/test.txt", getPath(t, s, "test.txt"), "root dir not reloaded")
+	assert.Equal(t, 5.0, s.rateIncrease(), "rate increase not reloaded")
+	assert.Equal(t, uint16(7), s.maxChunksInACR(), "max chunks not reloaded")
+
+	// an invalid config is not applied
+	bad := conf
+	bad.RootDir = dir + "/does-not-exist"
+	bad.RateIncrease = 1
+	assert.NotNil(t, s.Reload(&bad), "reload with missing root dir")
+	assert.Equal(t, dir+"/test.txt", getPath(t, s, "test.txt"), "invalid root dir applied")
+	assert.Equal(t, 5.0, s.rateIncrease(), "invalid config applied")
+}
+
+// A server can serve the files of any fs.FS.
+func TestFSStorage(t *testing.T) {
+	s, err := Init(net.ParseIP("127.0.0.102"), 12350, "./", 4, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	s.Storage = FSStorage{FS: fstest.MapFS{
+		"dir/hello.txt": &fstest.MapFile{Data: []byte("hello world"), ModTime: time.Unix(1000, 0)},
+	}}
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12350)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+	token := s.createToken(c.LocalAddr())
+
+	receive := func() interface{} {
+		data, err := messages.ClientReceive(c, 5000)
+		if err != nil {
+			t.Fatalf(`Client Receive failed: %v`, err)
+		}
+		parsed, err := messages.ParseServer(&data)
+		if err != nil {
+			t.Fatalf(`parse failed: %v`, err)
+		}
+		return parsed
+	}
+
+	// directories and missing files are not found
+	for _, uri := range []string{"dir", "missing.txt", "test.txt"} {
+		msg := messages.GetMDR(0, &token, uri)
+		msg.Send(c)
+		header, ok := receive().(messages.ServerHeader)
+		assert.True(t, ok, "expected error for %v", uri)
+		assert.Equal(t, messages.FileNotFound, header.Error, "wrong error for %v", uri)
+	}
+
+	msg := messages.GetMDR(1, &token, "/dir/hello.txt")
+	msg.Send(c)
+	mdrr, ok := receive().(messages.MDRR)
+	if !ok {
+		t.Fatalf(`Expected MDRR`)
+	}
+	assert.Equal(t, uint64(3), messages.Uint8_6_arr2Int(mdrr.FileSize), "wrong size")
+	assert.Equal(t, sha256.Sum256([]byte("hello world")), mdrr.Checksum, "wrong checksum")
+
+	crlist := []messages.CR{{ChunkOffset: *messages.Int2uint8_6_arr(1), Length: 2}}
+	acr := messages.GetACR(2, &token, mdrr.FileID, 1000, &crlist)
+	acr.Send(c)
+	for i, want := range []string{"o wo", "rld"} {
+		crr, ok := receive().(messages.CRR)
+		if !ok {
+			t.Fatalf(`Expected CRR`)
+		}
+		assert.Equal(t, uint64(i+1), messages.Uint8_6_arr2Int(crr.ChunkNumber), "wrong chunk number")
+		assert.Equal(t, want, string(crr.Data), "wrong data")
+	}
+}
+
+// Members of tar and zip archives are served as "archive/member".
+func TestArchiveStorage(t *testing.T) {
+	dir := t.TempDir()
+	small := []byte("hello world")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+
+	tf, err := os.Create(dir + "/a.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(tf)
+	tw.WriteHeader(&tar.Header{Name: "./docs/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "./docs/small.txt", Size: int64(len(small)), Mode: 0644})
+	tw.Write(small)
+	tw.WriteHeader(&tar.Header{Name: "large.bin", Size: int64(len(large)), Mode: 0644})
+	tw.Write(large)
+	tw.Close()
+	tf.Close()
+
+	zf, err := os.Create(dir + "/b.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "stored.txt", Method: zip.Store})
+	w.Write(small)
+	w, _ = zw.CreateHeader(&zip.FileHeader{Name: "dir/deflated.bin", Method: zip.Deflate})
+	w.Write(large)
+	zw.Close()
+	zf.Close()
+	os.WriteFile(dir+"/plain.txt", small, 0644)
+
+	st := NewArchiveStorage(DirStorage{Root: dir + "/"})
+	for name, want := range map[string][]byte{
+		"plain.txt":              small,
+		"a.tar/docs/small.txt":   small,
+		"a.tar/large.bin":        large,
+		"b.zip/stored.txt":       small,
+		"b.zip/dir/deflated.bin": large,
+	} {
+		info, err := st.Stat(name)
+		if err != nil {
+			t.Fatalf(`Stat of %v failed: %v`, name, err)
+		}
+		assert.Equal(t, int64(len(want)), info.Size, "wrong size of %v", name)
+
+		f, err := st.Open(name)
+		if err != nil {
+			t.Fatalf(`Open of %v failed: %v`, name, err)
+		}
+		// read chunks out of order, including past the end
+		buf := make([]byte, 7)
+		for _, off := range []int64{0, 4, 30000, 8, int64(len(want)) - 3, int64(len(want))} {
+			n, err := f.ReadAt(buf, off)
+			end := off + int64(len(buf))
+			if end > int64(len(want)) {
+				end = int64(len(want))
+				assert.Equal(t, io.EOF, err, "expected EOF for %v at %v", name, off)
+			} else {
+				assert.Nil(t, err, "read of %v at %v failed", name, off)
+			}
+			if off >= int64(len(want)) {
+				assert.Equal(t, 0, n, "read past the end of %v", name)
+				continue
+			}
+			assert.Equal(t, want[off:end], buf[:n], "wrong data of %v at %v", name, off)
+		}
+		f.Close()
+	}
+
+	// the archive itself is still a file, unlike directories and unknown members
+	_, err = st.Stat("a.tar")
+	assert.Nil(t, err, "archive not served")
+	for _, name := range []string{"a.tar/docs", "a.tar/missing", "plain.txt/x", "b.zip/", "c.zip/stored.txt"} {
+		_, err := st.Stat(name)
+		assert.ErrorIs(t, err, fs.ErrNotExist, "%v should not exist", name)
+	}
+
+	// a changed archive is indexed again
+	os.WriteFile(dir+"/b.zip", []byte("not a zip anymore"), 0644)
+	os.Chtimes(dir+"/b.zip", time.Now(), time.Now().Add(time.Hour))
+	_, err = st.Stat("b.zip/stored.txt")
+	assert.NotNil(t, err, "outdated index used")
+}
+
+// gatedStorage blocks opening the file name until gate is closed.
+type gatedStorage struct {
+	Storage
+	name  string
+	gate  chan struct{}
+	opens atomic.Int32 // of name
+}
+
+func (g *gatedStorage) Open(name string) (File, error) {
+	if name == g.name {
+		g.opens.Add(1)
+		<-g.gate
+	}
+	return g.Storage.Open(name)
+}
+
+// An archive being indexed does not hold up requests for other archives, and
+// is indexed once for concurrent requests.
+func TestArchiveIndexConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "x.txt", Size: 5, Mode: 0644})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	st := &gatedStorage{Storage: FSStorage{FS: fstest.MapFS{
+		"slow.tar": &fstest.MapFile{Data: buf.Bytes()},
+		"fast.tar": &fstest.MapFile{Data: buf.Bytes()},
+	}}, name: "slow.tar", gate: make(chan struct{})}
+	a := NewArchiveStorage(st)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := a.Stat("slow.tar/x.txt")
+			assert.Nil(t, err, "Stat failed")
+			assert.Equal(t, int64(5), info.Size, "wrong size")
+		}()
+	}
+	for st.opens.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := a.Stat("fast.tar/x.txt")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err, "Stat failed")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Indexing an archive waited for another one")
+	}
+	close(st.gate)
+	wg.Wait()
+	assert.Equal(t, int32(1), st.opens.Load(), "archive indexed more than once")
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.txt", []byte("hello"), 0644)
+	os.WriteFile(dir+"/b.txt", []byte("world!"), 0644)
+	os.WriteFile(dir+"/.hidden", nil, 0644)
+	os.WriteFile(dir+"/secret.key", nil, 0644)
+	os.Mkdir(dir+"/sub", 0755)
+
+	// a chunk holds one entry, so that every entry is on its own page
+	s, err := Init(net.ParseIP("127.0.0.102"), 12351, dir+"/", 40, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	s.Resolver.Deny = []string{"*.key"}
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12351)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+
+	receive := func() interface{} {
+		data, err := messages.ClientReceive(c, 5000)
+		if err != nil {
+			t.Fatalf(`Client Receive failed: %v`, err)
+		}
+		parsed, err := messages.ParseServer(&data)
+		if err != nil {
+			t.Fatalf(`parse failed: %v`, err)
+		}
+		return parsed
+	}
+
+	// without a valid token only a new token is sent
+	var token [32]uint8
+	msg := messages.GetLSR(0, &token, 0, "")
+	msg.Send(c)
+	ntm, ok := receive().(messages.NTM)
+	if !ok {
+		t.Fatalf(`Expected NTM`)
+	}
+	token = ntm.Token
+
+	var names []string
+	var listing uint32
+	for page := uint32(0); page < 3; page++ {
+		msg := messages.GetLSR(uint8(page+1), &token, page, "/")
+		msg.Send(c)
+		lsrr, ok := receive().(messages.LSRR)
+		if !ok {
+			t.Fatalf(`Expected LSRR`)
+		}
+		if page == 0 {
+			listing = lsrr.Listing
+		}
+		assert.Equal(t, listing, lsrr.Listing, "listing version changed")
+		assert.Equal(t, uint32(3), lsrr.Pages, "wrong number of pages")
+		assert.Equal(t, page, lsrr.Page, "wrong page")
+		assert.Equal(t, 1, len(lsrr.Entries), "wrong number of entries")
+		for _, e := range lsrr.Entries {
+			names = append(names, e.Name)
+			switch e.Name {
+			case "b.txt":
+				assert.Equal(t, uint64(6), e.Size, "wrong size")
+				assert.Equal(t, fileModTime(t, dir+"/b.txt").Unix(), e.ModTime, "wrong modification time")
+			case "sub":
+				assert.Equal(t, messages.EntryDir, e.Flags, "expected a directory")
+			}
+		}
+	}
+	assert.Equal(t, []string{"a.txt", "b.txt", "sub"}, names, "wrong entries")
+
+	// the version of the listing changes with the names, not the sizes
+	listingOf := func() uint32 {
+		messages.GetLSR(9, &token, 0, "/").Send(c)
+		lsrr, ok := receive().(messages.LSRR)
+		if !ok {
+			t.Fatalf(`Expected LSRR`)
+		}
+		return lsrr.Listing
+	}
+	os.WriteFile(dir+"/b.txt", []byte("longer content"), 0644)
+	assert.Equal(t, listing, listingOf(), "listing version changed with a size")
+	os.WriteFile(dir+"/c.txt", nil, 0644)
+	assert.NotEqual(t, listing, listingOf(), "listing version kept with a new file")
+	os.Remove(dir + "/c.txt")
+	assert.Equal(t, listing, listingOf(), "listing version not restored")
+
+	msg = messages.GetLSR(4, &token, 3, "")
+	msg.Send(c)
+	header, ok := receive().(messages.ServerHeader)
+	assert.True(t, ok, "expected error")
+	assert.Equal(t, messages.PageOutOfBounds, header.Error, "wrong error")
+
+	// an empty directory has one empty page
+	msg = messages.GetLSR(5, &token, 0, "sub")
+	msg.Send(c)
+	lsrr, ok := receive().(messages.LSRR)
+	if !ok {
+		t.Fatalf(`Expected LSRR`)
+	}
+	assert.Equal(t, uint32(1), lsrr.Pages, "wrong number of pages")
+	assert.Empty(t, lsrr.Entries, "expected no entries")
+
+	for _, uri := range []string{"missing", "a.txt", "..", ".hidden"} {
+		msg := messages.GetLSR(6, &token, 0, uri)
+		msg.Send(c)
+		header, ok := receive().(messages.ServerHeader)
+		assert.True(t, ok, "expected error for %v", uri)
+		assert.Equal(t, messages.FileNotFound, header.Error, "wrong error for %v", uri)
+	}
+}
+
+// With the largest chunk size, a page of the listing still fits into a
+// datagram.
+func TestListLargeChunks(t *testing.T) {
+	dir := t.TempDir()
+	// 366 entries of 179 bytes fill a chunk up to 3 bytes
+	for i := 0; i < 400; i++ {
+		os.WriteFile(fmt.Sprintf("%v/%03d%v", dir, i, strings.Repeat("x", 157)), nil, 0644)
+	}
+
+	s, err := Init(net.ParseIP("127.0.0.102"), 12360, dir+"/", 65517, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12360)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+
+	receive := func() ([]byte, interface{}) {
+		data, err := messages.ClientReceive(c, 5000)
+		if err != nil {
+			t.Fatalf(`Client Receive failed: %v`, err)
+		}
+		parsed, err := messages.ParseServer(&data)
+		if err != nil {
+			t.Fatalf(`parse failed: %v`, err)
+		}
+		return data, parsed
+	}
+
+	var token [32]uint8
+	messages.GetLSR(0, &token, 0, "").Send(c)
+	_, parsed := receive()
+	ntm, ok := parsed.(messages.NTM)
+	if !ok {
+		t.Fatalf(`Expected NTM`)
+	}
+	token = ntm.Token
+
+	entries := 0
+	for page, pages := uint32(0), uint32(1); page < pages; page++ {
+		messages.GetLSR(uint8(page+1), &token, page, "").Send(c)
+		data, parsed := receive()
+		lsrr, ok := parsed.(messages.LSRR)
+		if !ok {
+			t.Fatalf(`Expected LSRR for page %v`, page)
+		}
+		assert.LessOrEqual(t, len(data), maxUDPPayload, "LSRR too large")
+		pages = lsrr.Pages
+		entries += len(lsrr.Entries)
+	}
+	assert.Equal(t, 400, entries, "wrong number of entries")
+}
+
+// The Merkle tree over the chunks of a file is sent page by page.
+func TestHashTree(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 700)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	os.WriteFile(dir+"/data.bin", content, 0644)
+
+	// the leaves of a page take no more space than a chunk: 2 per page
+	s, err := Init(net.ParseIP("127.0.0.102"), 12358, dir+"/", 64, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12358)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+
+	receive := func() interface{} {
+		data, err := messages.ClientReceive(c, 5000)
+		if err != nil {
+			t.Fatalf(`Client Receive failed: %v`, err)
+		}
+		parsed, err := messages.ParseServer(&data)
+		if err != nil {
+			t.Fatalf(`parse failed: %v`, err)
+		}
+		return parsed
+	}
+
+	var token [32]uint8
+	messages.GetHSR(0, &token, 0, 0).Send(c)
+	ntm, ok := receive().(messages.NTM)
+	if !ok {
+		t.Fatalf(`Expected NTM`)
+	}
+	token = ntm.Token
+
+	messages.GetHSR(1, &token, 0, 0).Send(c)
+	header, ok := receive().(messages.ServerHeader)
+	assert.True(t, ok, "expected error")
+	assert.Equal(t, messages.InvalidFileID, header.Error, "wrong error")
+
+	messages.GetMDR(2, &token, "data.bin").Send(c)
+	mdrr, ok := receive().(messages.MDRR)
+	if !ok {
+		t.Fatalf(`Expected MDRR`)
+	}
+
+	chunks := 11
+	for page := uint32(0); page < 6; page++ {
+		messages.GetHSR(3, &token, mdrr.FileID, page).Send(c)
+		hsrr, ok := receive().(messages.HSRR)
+		if !ok {
+			t.Fatalf(`Expected HSRR`)
+		}
+		assert.Equal(t, mdrr.FileID, hsrr.FileID, "wrong file ID")
+		assert.Equal(t, page, hsrr.Page, "wrong page")
+		assert.Equal(t, uint32(6), hsrr.Pages, "wrong number of pages")
+		assert.Equal(t, uint32(2), hsrr.PageSize, "wrong page size")
+		for i, leaf := range hsrr.Leaves {
+			chunk := int(page)*2 + i
+			assert.Equal(t, merkle.LeafHash(content[chunk*64:min((chunk+1)*64, len(content))]), leaf, "wrong leaf %d", chunk)
+		}
+		assert.True(t, merkle.VerifyPage(hsrr.Root, chunks, int(page), 2, hsrr.Leaves, hsrr.Proof), "page %d does not verify", page)
+	}
+
+	messages.GetHSR(4, &token, mdrr.FileID, 6).Send(c)
+	header, ok = receive().(messages.ServerHeader)
+	assert.True(t, ok, "expected error")
+	assert.Equal(t, messages.PageOutOfBounds, header.Error, "wrong error")
+
+	// a modified file has to be requested again
+	os.WriteFile(dir+"/data.bin", content[:100], 0644)
+	messages.GetHSR(5, &token, mdrr.FileID, 0).Send(c)
+	header, ok = receive().(messages.ServerHeader)
+	assert.True(t, ok, "expected error")
+	assert.Equal(t, messages.InvalidFileID, header.Error, "wrong error")
+}
+
+// The Merkle trees are cached up to a number of leaves, and only built up to
+// a number of chunks. HSRs do not wait for trees being built.
+func TestTreeCache(t *testing.T) {
+	dir := t.TempDir()
+	st := DirStorage{Root: dir + "/"}
+	s, err := Init(net.ParseIP("127.0.0.102"), 12363, dir+"/", 4, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s.Conn.Close()
+	s.trees = newTreeCache(4)
+	filem := func(name string, size int) FileM {
+		os.WriteFile(dir+"/"+name, make([]byte, size), 0644)
+		info, err := st.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return FileM{Path: name, T: info.ModTime, Size: info.Size, Inode: info.Inode, Storage: st, Name: name}
+	}
+	ctx := context.Background()
+
+	_, err = s.merkleTree(ctx, filem("large", 17), time.Second)
+	assert.ErrorIs(t, err, errTreeTooLarge, "tree of 5 chunks built")
+
+	// while all workers are busy, the trees are not built
+	for i := 0; i < DefaultHashWorkers; i++ {
+		s.hashes.workers <- struct{}{}
+	}
+	files := []FileM{filem("a", 16), filem("b", 16), filem("c", 16), filem("d", 16), filem("e", 16)}
+	for _, f := range files[:4] {
+		_, err = s.merkleTree(ctx, f, time.Millisecond)
+		assert.ErrorIs(t, err, errTreeNotReady, "tree of %s built", f.Name)
+	}
+	// the cache is full of trees being built
+	_, err = s.merkleTree(ctx, files[4], time.Second)
+	assert.ErrorIs(t, err, errTreeNotReady, "tree built in a full cache")
+	assert.Equal(t, 4, len(s.trees.trees), "wrong number of trees")
+
+	for i := 0; i < DefaultHashWorkers; i++ {
+		<-s.hashes.workers
+	}
+	for _, f := range files[:4] {
+		tree, err := s.merkleTree(ctx, f, time.Second)
+		assert.NoError(t, err, "tree of %s", f.Name)
+		assert.Equal(t, 4, tree.Len(), "wrong number of leaves")
+	}
+	// the least recently used tree makes room for a new one
+	_, err = s.merkleTree(ctx, files[4], time.Second)
+	assert.NoError(t, err, "tree of e")
+	assert.Equal(t, 4, len(s.trees.trees), "wrong number of trees")
+	assert.Equal(t, int64(16), s.trees.leaves, "wrong number of leaves")
+	_, ok := s.trees.trees[hashKey{path: "a", modTime: files[0].T.UnixNano(), size: 16, inode: files[0].Inode}]
+	assert.False(t, ok, "least recently used tree kept")
+}
+
+// File IDs and checksums are kept in the index across restarts.
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/data.txt", []byte("hello index"), 0644)
+	indexFile := dir + "/index.json"
+
+	s, err := Init(net.ParseIP("127.0.0.102"), 12352, dir+"/", 4, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	s.IndexFile = indexFile
+	go s.Serve(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12352)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+	token := s.createToken(c.LocalAddr())
+	msg := messages.GetMDR(0, &token, "data.txt")
+	msg.Send(c)
+	data, err := messages.ClientReceive(c, 5000)
+	if err != nil {
+		t.Fatalf(`Client Receive failed: %v`, err)
+	}
+	parsed, _ := messages.ParseServer(&data)
+	mdrr, ok := parsed.(messages.MDRR)
+	if !ok {
+		t.Fatalf(`Expected MDRR`)
+	}
+	// saved on shutdown at the latest
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf(`Shutdown failed: %v`, err)
+	}
+
+	s2, err := Init(net.ParseIP("127.0.0.102"), 12352, dir+"/", 4, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s2.Conn.Close()
+	s2.SetLogLevel("warn")
+	s2.IndexFile = indexFile
+	if err := s2.LoadIndex(); err != nil {
+		t.Fatalf(`LoadIndex failed: %v`, err)
+	}
+	info, err := DirStorage{Root: dir + "/"}.Stat("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileid, filem, ok := s2.Files.Lookup(dir+"/data.txt", info)
+	assert.True(t, ok, "file not loaded from index")
+	assert.Equal(t, mdrr.FileID, fileid, "file ID changed")
+	assert.Equal(t, sha256.Sum256([]byte("hello index")), *filem.Checksum, "wrong checksum")
+	assert.NotNil(t, filem.Storage, "no storage")
+
+	// a file replaced by another one is not found
+	os.WriteFile(dir+"/other.txt", []byte("hello world"), 0644)
+	os.Chtimes(dir+"/other.txt", info.ModTime, info.ModTime)
+	os.Rename(dir+"/other.txt", dir+"/data.txt")
+	info, err = DirStorage{Root: dir + "/"}.Stat("data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ok = s2.Files.Lookup(dir+"/data.txt", info)
+	assert.False(t, ok, "replaced file found")
+
+	// files of another root are ignored
+	s2.Files = NewFileRegistry()
+	s2.RootDir = "./"
+	if err := s2.LoadIndex(); err != nil {
+		t.Fatalf(`LoadIndex failed: %v`, err)
+	}
+	assert.Equal(t, 0, s2.Files.Len(), "files of another root loaded")
+}
+
+// countingStorage counts the files opened. Open blocks until gate is closed.
+type countingStorage struct {
+	Storage
+	gate  chan struct{}
+	mu    sync.Mutex
+	opens int
+}
+
+func (c *countingStorage) Open(name string) (File, error) {
+	c.mu.Lock()
+	c.opens++
+	c.mu.Unlock()
+	<-c.gate
+	return c.Storage.Open(name)
+}
+
+// Concurrent requests for the checksum of a file hash it once.
+func TestHasher(t *testing.T) {
+	st := &countingStorage{Storage: FSStorage{FS: fstest.MapFS{
+		"big.bin": &fstest.MapFile{Data: bytes.Repeat([]byte("x"), 1<<20)},
+	}}, gate: make(chan struct{})}
+	info, err := st.Stat("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHasher(1)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sum, err := h.checksum(context.Background(), st, "big.bin", "big.bin", info)
+			assert.Nil(t, err, "checksum failed")
+			assert.Equal(t, sha256.Sum256(bytes.Repeat([]byte("x"), 1<<20)), *sum, "wrong checksum")
+		}()
+	}
+	// let the hash finish once all requests wait for it
+	for waiting := 0; waiting < 10; time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		waiting = 0
+		for _, call := range h.inflight {
+			waiting += call.refs
+		}
+		h.mu.Unlock()
+	}
+	close(st.gate)
+	wg.Wait()
+	assert.Equal(t, 1, st.opens, "file hashed for every request")
+
+	// a canceled request does not affect the next one
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = h.checksum(ctx, st, "big.bin", "big.bin", info)
+	assert.ErrorIs(t, err, context.Canceled, "wrong error")
+	_, err = h.checksum(context.Background(), st, "big.bin", "big.bin", info)
+	assert.Nil(t, err, "checksum failed")
+}
+
+// An MDR does not wait for a large file to be hashed, a retransmitted MDR
+// is answered once it is.
+func TestMDRWhileHashing(t *testing.T) {
+	defer func(wait time.Duration) { mdrHashWait = wait }(mdrHashWait)
+	mdrHashWait = 50 * time.Millisecond
+
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	st := &countingStorage{Storage: FSStorage{FS: fstest.MapFS{
+		"big.bin": &fstest.MapFile{Data: data},
+	}}, gate: make(chan struct{})}
+	s, err := Init(net.ParseIP("127.0.0.102"), 12361, "./", 1024, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	s.Storage = st
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12361)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+
+	var token [32]uint8
+	messages.GetMDR(0, &token, "big.bin").Send(c)
+	reply, err := messages.ClientReceive(c, 5000)
+	if err != nil {
+		t.Fatalf(`Client Receive failed: %v`, err)
+	}
+	parsed, err := messages.ParseServer(&reply)
+	ntm, ok := parsed.(messages.NTM)
+	if err != nil || !ok {
+		t.Fatalf(`Expected NTM`)
+	}
+	token = ntm.Token
+
+	// the handler returns without an answer while the file is hashed
+	messages.GetMDR(1, &token, "big.bin").Send(c)
+	_, err = messages.ClientReceive(c, 200)
+	assert.NotNil(t, err, "MDR answered before the file was hashed")
+
+	close(st.gate)
+	var mdrr messages.MDRR
+	for i := uint8(2); i < 10; i++ {
+		messages.GetMDR(i, &token, "big.bin").Send(c)
+		reply, err := messages.ClientReceive(c, 200)
+		if err != nil {
+			continue
+		}
+		parsed, err := messages.ParseServer(&reply)
+		if err != nil {
+			t.Fatalf(`parse failed: %v`, err)
+		}
+		mdrr, ok = parsed.(messages.MDRR)
+		if !ok {
+			t.Fatalf(`Expected MDRR`)
+		}
+		break
+	}
+	assert.Equal(t, sha256.Sum256(data), mdrr.Checksum, "wrong checksum")
+	st.mu.Lock()
+	assert.Equal(t, 1, st.opens, "file hashed for every MDR")
+	st.mu.Unlock()
+}
+
+// An ACR waiting for a free slot does not keep the server from answering
+// other requests.
+func TestACRWaitingForSlot(t *testing.T) {
+	s, err := Init(net.ParseIP("127.0.0.102"), 12362, "./", 1024, 40, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	s.SetLimits(Limits{MaxACRs: 1})
+	// the only slot is taken
+	assert.True(t, s.limits.admit(context.Background(), nil), "slot not free")
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12362)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+
+	var token [32]uint8
+	acr := messages.GetACR(0, &token, 1, 100, &[]messages.CR{{ChunkOffset: *messages.Int2uint8_6_arr(0), Length: 1}})
+	acr.Send(c)
+	_, err = messages.ClientReceive(c, 200)
+	assert.NotNil(t, err, "ACR answered while no slot was free")
+
+	messages.GetMDR(1, &token, "test.txt").Send(c)
+	reply, err := messages.ClientReceive(c, 1000)
+	if err != nil {
+		t.Fatalf(`MDR not answered while an ACR waits: %v`, err)
+	}
+	parsed, err := messages.ParseServer(&reply)
+	ntm, ok := parsed.(messages.NTM)
+	if err != nil || !ok || ntm.Header.Number != 1 {
+		t.Fatalf(`Expected NTM for the MDR, got %v`, parsed)
+	}
+
+	// the ACR is answered once the slot is free
+	s.limits.release()
+	reply, err = messages.ClientReceive(c, 1000)
+	if err != nil {
+		t.Fatalf(`ACR not answered after the slot was freed: %v`, err)
+	}
+	parsed, err = messages.ParseServer(&reply)
+	ntm, ok = parsed.(messages.NTM)
+	if err != nil || !ok || ntm.Header.Number != 0 {
+		t.Fatalf(`Expected NTM for the ACR, got %v`, parsed)
+	}
+}
+
+// A scan registers the served files and forgets removed ones.
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/sub", 0755)
+	os.WriteFile(dir+"/a.txt", []byte("a"), 0644)
+	os.WriteFile(dir+"/sub/b.txt", []byte("b"), 0644)
+	os.WriteFile(dir+"/.hidden", []byte("c"), 0644)
+
+	s, err := Init(net.ParseIP("127.0.0.1"), 10000, dir+"/", 1024, 1, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	defer s.Conn.Close()
+	hashed, err := s.scan(context.Background())
+	assert.Nil(t, err, "scan failed")
+	assert.Equal(t, 2, hashed, "wrong number of files hashed")
+	assert.Equal(t, 2, s.Files.Len(), "wrong number of files registered")
+
+	// registered files are not hashed again
+	hashed, _ = s.scan(context.Background())
+	assert.Equal(t, 0, hashed, "files hashed again")
+
+	os.Remove(dir + "/sub/b.txt")
+	os.WriteFile(dir+"/a.txt", []byte("changed"), 0644)
+	hashed, _ = s.scan(context.Background())
+	assert.Equal(t, 1, hashed, "changed file not hashed")
+	assert.Equal(t, 1, s.Files.Len(), "removed files not forgotten")
+}
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	l.set(Limits{Rate: 100, ClientRate: 10})
+	a := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	a2 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}
+	b := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1}
+	now := time.Now()
+
+	// a client may send a burst of one packet, then one every 100ms, on any
+	// port
+	assert.Equal(t, time.Duration(0), l.reserve(a, now), "first packet delayed")
+	assert.InDelta(t, 100*time.Millisecond, l.reserve(a2, now), float64(time.Millisecond), "wrong delay")
+	assert.InDelta(t, 200*time.Millisecond, l.reserve(a, now), float64(time.Millisecond), "wrong delay")
+	// other clients have their own limit
+	assert.Equal(t, time.Duration(0), l.reserve(b, now), "other client delayed")
+	for i := 0; i < 6; i++ {
+		l.reserve(&net.UDPAddr{IP: net.IPv4(127, 0, 1, byte(i))}, now)
+	}
+	// all 10 packets of the global burst are taken, the next one waits 10ms
+	d := l.reserve(&net.UDPAddr{IP: net.IPv4(127, 0, 2, 0)}, now)
+	assert.InDelta(t, 10*time.Millisecond, d, float64(time.Millisecond), "wrong global delay")
+
+	// busy: waiting or dropping
+	l.set(Limits{MaxACRs: 1, DropWhenBusy: true})
+	assert.True(t, l.admit(context.Background(), nil), "ACR not admitted")
+	assert.False(t, l.admit(context.Background(), nil), "ACR admitted while busy")
+	l.set(Limits{MaxACRs: 1})
+	admitted := make(chan bool)
+	go func() { admitted <- l.admit(context.Background(), nil) }()
+	select {
+	case <-admitted:
+		t.Fatalf(`ACR admitted while busy`)
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.False(t, l.admit(context.Background(), nil), "more ACRs waiting than answered")
+	l.release()
+	assert.True(t, <-admitted, "waiting ACR not admitted")
+
+	quit := make(chan struct{})
+	close(quit)
+	assert.False(t, l.admit(context.Background(), quit), "ACR admitted after shutdown")
+}
+
+// recordingConn records the packets written to it.
+type recordingConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	packets []string // "addr payload"
+}
+
+func (c *recordingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packets = append(c.packets, addr.String()+" "+string(p))
+	return len(p), nil
+}
+
+func TestScheduler(t *testing.T) {
+	conn := &recordingConn{}
+	var limits limiter
+	// the global limit makes the flows compete
+	limits.set(Limits{Rate: 500})
+	s := newScheduler(conn, &limits, 2) // one or two packets per round
+	a := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1}
+	// no burst, so that both flows have packets queued from the start
+	start := time.Now()
+	for limits.globalDelay(start) == 0 {
+		limits.reserve(a, start)
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range []net.Addr{a, b} {
+		f := s.open(addr, 10000)
+		wg.Add(1)
+		go func(addr net.Addr) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				f.WriteTo([]byte(fmt.Sprint(i)), addr)
+			}
+			f.Close()
+		}(addr)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	assert.InDelta(t, 400*time.Millisecond, elapsed, float64(60*time.Millisecond), "wrong rate")
+
+	// the packets of each flow are in order, and the flows take turns
+	next := map[string]int{}
+	for i, p := range conn.packets {
+		var addr string
+		var n int
+		fmt.Sscan(p, &addr, &n)
+		assert.Equal(t, next[addr], n, "packet %v out of order", p)
+		next[addr]++
+		if i < 190 {
+			assert.InDelta(t, next[a.String()], next[b.String()], 2, "unfair at packet %v", i)
+		}
+	}
+	assert.Equal(t, 100, next[a.String()], "packets lost")
+
+	// without limits a flow is paced at its rate
+	limits.set(Limits{})
+	f := s.open(a, 100)
+	start = time.Now()
+	for i := 0; i < 11; i++ {
+		f.WriteTo([]byte("x"), a)
+	}
+	f.Close()
+	assert.InDelta(t, 100*time.Millisecond, time.Since(start), float64(20*time.Millisecond), "wrong pacing")
+}
+
+// blockingConn blocks the first write until release is closed.
+type blockingConn struct {
+	recordingConn
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (c *blockingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.once.Do(func() {
+		close(c.started)
+		<-c.release
+	})
+	return c.recordingConn.WriteTo(p, addr)
+}
+
+// A blocked send does not keep the handlers from queueing packets, and a
+// flow is paced at a positive rate whatever the client requests.
+func TestSchedulerBlockedSend(t *testing.T) {
+	conn := &blockingConn{started: make(chan struct{}), release: make(chan struct{})}
+	var limits limiter
+	s := newScheduler(conn, &limits, 1024)
+	a := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1}
+
+	for _, rate := range []float64{0, -1, math.NaN()} {
+		f := s.open(a, rate)
+		assert.Equal(t, time.Second, f.interval, "wrong interval for rate %v", rate)
+		f.Close()
+	}
+
+	f := s.open(a, 1000)
+	f.WriteTo([]byte("a"), a)
+	<-conn.started
+	queued := make(chan struct{})
+	go func() {
+		g := s.open(b, 1000)
+		for i := 0; i < flowQueueSize; i++ {
+			g.WriteTo([]byte("b"), b)
+		}
+		close(queued)
+		g.Close()
+	}()
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatalf(`packets not queued while another flow is sending`)
+	}
+	closed := make(chan struct{})
+	go func() {
+		f.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatalf(`flow closed before its packet was sent`)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(conn.release)
+	<-closed
+	conn.mu.Lock()
+	assert.Equal(t, "127.0.0.1:1 a", conn.packets[0], "wrong first packet")
+	conn.mu.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.txt", []byte("0123456789"), 0644)
+	s, err := Init(net.ParseIP("127.0.0.102"), 12353, dir+"/", 4, 10, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12353)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+	receive := func() messages.ServerMessage {
+		data, err := messages.ClientReceive(c, 5000)
+		if err != nil {
+			t.Fatalf(`Client Receive failed: %v`, err)
+		}
+		parsed, _ := messages.ParseServer(&data)
+		return parsed
+	}
+
+	var token [32]uint8
+	messages.GetMDR(0, &token, "a.txt").Send(c)
+	ntm, ok := receive().(messages.NTM)
+	if !ok {
+		t.Fatalf(`Expected NTM`)
+	}
+	token = ntm.Token
+	var mdrr messages.MDRR
+	for i := uint8(1); i <= 2; i++ {
+		messages.GetMDR(i, &token, "a.txt").Send(c)
+		if mdrr, ok = receive().(messages.MDRR); !ok {
+			t.Fatalf(`Expected MDRR`)
+		}
+	}
+	messages.GetMDR(3, &token, "missing.txt").Send(c)
+	receive()
+	crs := []messages.CR{*messages.GetCR(*messages.Int2uint8_6_arr(0), 3)}
+	messages.GetACR(4, &token, mdrr.FileID, 100, &crs).Send(c)
+	for i := 0; i < 3; i++ {
+		receive()
+	}
+
+	var buf bytes.Buffer
+	s.Metrics.WriteTo(&buf)
+	text := buf.String()
+	for _, line := range []string{
+		`sanft_server_requests_total{type="MDR"} 4`,
+		`sanft_server_requests_total{type="ACR"} 1`,
+		`sanft_server_invalid_tokens_total 1`,
+		`sanft_server_ntms_total 1`,
+		`sanft_server_errors_total{type="MDRR",code="2"} 1`,
+		`sanft_server_sent_packets_total 7`,
+		`sanft_server_sent_chunks_total 3`,
+		`sanft_server_checksum_cache_hits_total 1`,
+		`sanft_server_checksum_cache_misses_total 1`,
+		`sanft_server_acr_rate_count 1`,
+		`sanft_server_files 1`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.txt", []byte("0123456789"), 0644)
+	s, err := Init(net.ParseIP("127.0.0.102"), 12354, dir+"/", 4, 10, 0, 0, 0)
+	if err != nil {
+		t.Fatalf(`Error creating server: %v`, err)
+	}
+	s.SetLogLevel("warn")
+	var buf bytes.Buffer
+	s.AccessLog = logging.New(&buf, "json", nil)
+	go s.Serve(context.Background())
+
+	c, err := messages.CreateClientSocket(net.ParseIP("127.0.0.102"), 12354)
+	if err != nil {
+		t.Fatalf(`Creating client failed: %v`, err)
+	}
+	defer c.Close()
+	receive := func() messages.ServerMessage {
+		data, err := messages.ClientReceive(c, 5000)
+		if err != nil {
+			t.Fatalf(`Client Receive failed: %v`, err)
+		}
+		parsed, _ := messages.ParseServer(&data)
+		return parsed
+	}
+
+	var token [32]uint8
+	messages.GetMDR(0, &token, "a.txt").Send(c)
+	token = receive().(messages.NTM).Token
+	messages.GetMDR(1, &token, "a.txt").Send(c)
+	mdrr := receive().(messages.MDRR)
+	// the last chunk is out of bounds
+	crs := []messages.CR{*messages.GetCR(*messages.Int2uint8_6_arr(1), 3)}
+	messages.GetACR(2, &token, mdrr.FileID, 100, &crs).Send(c)
+	for i := 0; i < 3; i++ {
+		receive()
+	}
+	// wait for the handlers to write their records
+	s.Shutdown(context.Background())
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r map[string]interface{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf(`Invalid access log: %v`, err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 3 {
+		t.Fatalf(`Expected 3 records, got %v`, records)
+	}
+	assert.Equal(t, "MDR", records[0]["msg"])
+	assert.Equal(t, "invalid token", records[0]["status"])
+	assert.Equal(t, "a.txt", records[1]["uri"])
+	assert.Equal(t, fmt.Sprintf("0x%08x", mdrr.FileID), records[1]["file_id"])
+	assert.Equal(t, "ok", records[1]["status"])
+	assert.Equal(t, "ACR", records[2]["msg"])
+	assert.Equal(t, "a.txt", records[2]["file"])
+	assert.Equal(t, 2.0, records[2]["chunks"])
+	assert.Equal(t, "chunk out of bounds", records[2]["status"])
+	assert.Contains(t, records[2]["client"], "127.0.0.1:")
+	assert.Contains(t, records[2], "duration")
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// Storage is where a server reads the files it serves from. Names are slash
+// separated paths relative to the root of the storage, without a leading
+// slash.
+//
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// Stat returns information about a regular file. It returns an error
+	// wrapping fs.ErrNotExist if there is no such file.
+	Stat(name string) (FileInfo, error)
+	// Open opens a file for reading at arbitrary offsets.
+	Open(name string) (File, error)
+}
+
+// FileInfo describes a version of a file in a Storage.
+type FileInfo struct {
+	Size    int64
+	ModTime time.Time
+	// Version identifies the content of the file together with ModTime. It
+	// may be empty if ModTime changes whenever the content does.
+	Version string
+	// Inode is the inode number of the file if known, otherwise 0. Files
+	// replaced by renaming another file over them get a new inode even if
+	// the modification time is kept.
+	Inode uint64
+}
+
+// File is an open file of a Storage.
+type File interface {
+	io.ReaderAt
+	io.Closer
+}
+
+var errNotRegular = errors.New("not a regular file")
+
+// DirStorage serves the files below a directory of the local file system.
+type DirStorage struct {
+	// Root must end with a slash
+	Root     string
+	Symlinks SymlinkPolicy
+}
+
+func (d DirStorage) Stat(name string) (FileInfo, error) {
+	f, err := d.open(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return FileInfo{}, &fs.PathError{Op: "stat", Path: name, Err: errNotRegular}
+	}
+	return FileInfo{Size: info.Size(), ModTime: info.ModTime(), Inode: inode(info)}, nil
+}
+
+func (d DirStorage) Open(name string) (File, error) {
+	f, err := d.open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = &fs.PathError{Op: "open", Path: name, Err: errNotRegular}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// FSStorage serves the files of an fs.FS, e.g. an embed.FS or fstest.MapFS.
+type FSStorage struct {
+	FS fs.FS
+}
+
+func (s FSStorage) Stat(name string) (FileInfo, error) {
+	info, err := fs.Stat(s.FS, name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return FileInfo{}, &fs.PathError{Op: "stat", Path: name, Err: errNotRegular}
+	}
+	return FileInfo{Size: info.Size(), ModTime: info.ModTime(), Inode: inode(info)}, nil
+}
+
+// Open uses the ReadAt or Seek method of the file if it has one, otherwise
+// the file is read into memory.
+func (s FSStorage) Open(name string) (File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	switch ff := f.(type) {
+	case File:
+		return ff, nil
+	case io.ReadSeeker:
+		return &seekReaderAt{f: f, rs: ff}, nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading %v: %w", name, err)
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+// seekReaderAt implements ReadAt with Seek and Read.
+type seekReaderAt struct {
+	mu sync.Mutex
+	f  fs.File
+	rs io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *seekReaderAt) Close() error {
+	return s.f.Close()
+}
+
+type nopCloser struct {
+	io.ReaderAt
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
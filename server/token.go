@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultKeyOverlap is the time for which tokens created with the previous
+// key are still accepted after a rotation, so that the clients in the middle
+// of a transfer do not all need a new token at once.
+const DefaultKeyOverlap = 10 * time.Minute
+
+// keyFileCheckInterval is the time between two checks whether another server
+// changed the key file.
+const keyFileCheckInterval = time.Second
+
+const keySize = 32
+
+func createRandomKey() []uint8 {
+	key := make([]uint8, keySize)
+	rand.Read(key)
+	return key
+}
+
+// tokenKey is the keying material used to create tokens.
+type tokenKey struct {
+	key        []uint8
+	created    time.Time
+	validUntil time.Time
+}
+
+// tokenKeys are the keys tokens are checked with.
+type tokenKeys struct {
+	current *tokenKey
+	// the key replaced by current, accepted until previousUntil; may be nil
+	previous      *tokenKey
+	previousUntil time.Time
+}
+
+// keyHolder holds the token keys. Reading the keys is lock free, so handlers
+// never wait for a rotation.
+type keyHolder struct {
+	keys atomic.Value // *tokenKeys
+	mu   sync.Mutex   // Serializes rotations
+
+	// File the keys are kept in and shared with other servers, see
+	// Server.UseKeyFile
+	file      string
+	fileData  []byte // content of the key file when last read or written
+	lastCheck time.Time
+}
+
+func (k *keyHolder) load() *tokenKeys {
+	keys, _ := k.keys.Load().(*tokenKeys)
+	return keys
+}
+
+func (k *keyHolder) store(keys *tokenKeys) {
+	k.keys.Store(keys)
+}
+
+// rotate replaces the key with a new random key valid for validity. The old
+// key is accepted for overlap.
+func (k *keyHolder) rotate(validity time.Duration, overlap time.Duration) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.rotateLocked(validity, overlap)
+}
+
+func (k *keyHolder) rotateLocked(validity time.Duration, overlap time.Duration) error {
+	now := time.Now()
+	keys := &tokenKeys{current: &tokenKey{key: createRandomKey(), created: now, validUntil: now.Add(validity)}}
+	if old := k.load(); old != nil {
+		keys.previous = old.current
+		keys.previousUntil = now.Add(overlap)
+	}
+	k.store(keys)
+	if k.file == "" {
+		return nil
+	}
+	return k.save(keys)
+}
+
+// refresh adopts the keys another server wrote to the key file and rotates
+// the key if it expired.
+func (k *keyHolder) refresh(validity time.Duration, overlap time.Duration) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var err error
+	if k.file != "" && time.Since(k.lastCheck) >= keyFileCheckInterval {
+		k.lastCheck = time.Now()
+		var keys *tokenKeys
+		keys, err = k.read(overlap)
+		if keys != nil {
+			old := k.load()
+			if !hmac.Equal(old.current.key, keys.current.key) &&
+				(keys.previous == nil || !hmac.Equal(old.current.key, keys.previous.key)) {
+				// another server rotated at the same time, keep accepting
+				// the tokens we handed out
+				keys.previous = old.current
+				keys.previousUntil = time.Now().Add(overlap)
+			}
+			k.store(keys)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			// removed, write our keys again
+			err = k.save(k.load())
+		}
+	}
+	if keys := k.load(); keys == nil || time.Now().After(keys.current.validUntil) {
+		if rerr := k.rotateLocked(validity, overlap); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// keyFile is the format of the key file.
+type keyFile struct {
+	Keys []keyFileEntry `json:"keys"` // the current key, followed by the previous one
+}
+
+type keyFileEntry struct {
+	Key        string    `json:"key"` // hex encoded
+	Created    time.Time `json:"created"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// read returns the keys in the key file, or nil if it did not change since
+// it was last read or written.
+func (k *keyHolder) read(overlap time.Duration) (*tokenKeys, error) {
+	data, err := os.ReadFile(k.file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(data, k.fileData) {
+		return nil, nil
+	}
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("error while parsing key file %v: %w", k.file, err)
+	}
+	var loaded []*tokenKey
+	for _, e := range f.Keys {
+		key, err := hex.DecodeString(e.Key)
+		if err != nil || len(key) < keySize {
+			return nil, fmt.Errorf("invalid key in key file %v", k.file)
+		}
+		loaded = append(loaded, &tokenKey{key: key, created: e.Created, validUntil: e.ValidUntil})
+	}
+	if len(loaded) == 0 {
+		return nil, fmt.Errorf("no key in key file %v", k.file)
+	}
+	k.fileData = data
+
+	keys := &tokenKeys{current: loaded[0]}
+	if len(loaded) > 1 {
+		keys.previous = loaded[1]
+		keys.previousUntil = loaded[0].created.Add(overlap)
+	}
+	return keys, nil
+}
+
+// save replaces the key file atomically.
+func (k *keyHolder) save(keys *tokenKeys) error {
+	var f keyFile
+	for _, key := range []*tokenKey{keys.current, keys.previous} {
+		if key != nil {
+			f.Keys = append(f.Keys, keyFileEntry{Key: hex.EncodeToString(key.key), Created: key.created,
+				ValidUntil: key.validUntil})
+		}
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("error while encoding keys: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.file), filepath.Base(k.file)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error while saving keys: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), k.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error while saving keys: %w", err)
+	}
+	k.fileData = data
+	return nil
+}
+
+// UseKeyFile makes the server keep its token keys in the file path, so that
+// tokens stay valid across restarts and several servers sharing the file
+// accept each other's tokens. The keys in the file are used if it exists,
+// otherwise it is created with the current keys. Changes made by other
+// servers are picked up within a second.
+func (s *Server) UseKeyFile(path string) error {
+	k := &s.keys
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.file = path
+	k.fileData = nil
+	k.lastCheck = time.Now()
+	keys, err := k.read(s.KeyOverlap)
+	if errors.Is(err, os.ErrNotExist) {
+		return k.save(k.load())
+	}
+	if err != nil {
+		return err
+	}
+	k.store(keys)
+	if time.Now().After(keys.current.validUntil) {
+		return k.rotateLocked(KEY_VALIDITY, s.KeyOverlap)
+	}
+	return nil
+}
+
+func (s *Server) NewKey() {
+	if err := s.keys.rotate(KEY_VALIDITY, s.KeyOverlap); err != nil {
+		s.Logger.Warn("Cannot save token keys", "err", err)
+	}
+}
+
+func (s *Server) RefreshKey() {
+	if err := s.keys.refresh(KEY_VALIDITY, s.KeyOverlap); err != nil {
+		s.Logger.Warn("Cannot refresh token keys", "err", err)
+	}
+}
+
+// createToken returns the token of addr: HMAC-SHA256 of its IP address and
+// port with the current key.
+func (s *Server) createToken(addr net.Addr) [32]uint8 {
+	return tokenMAC(s.keys.load().current.key, addr)
+}
+
+// checkToken reports whether Token is the token of addr created with the
+// current key or, during the overlap after a rotation, the previous one.
+func (s *Server) checkToken(addr net.Addr, Token *[32]uint8) bool {
+	keys := s.keys.load()
+	token := tokenMAC(keys.current.key, addr)
+	if hmac.Equal(token[:], Token[:]) {
+		return true
+	}
+	if keys.previous != nil && time.Now().Before(keys.previousUntil) {
+		token = tokenMAC(keys.previous.key, addr)
+		if hmac.Equal(token[:], Token[:]) {
+			return true
+		}
+	}
+	s.metrics.invalidTokens.Inc()
+	return false
+}
+
+func tokenMAC(key []uint8, addr net.Addr) [32]uint8 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(getPortIPBytes(addr))
+	var token [32]uint8
+	copy(token[:], mac.Sum(nil))
+	return token
+}